@@ -0,0 +1,398 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An archive is an encrypted stream holding a tar file. Its first entry is a
+// manifest listing every file and directory with its mode, size and SHA-256,
+// and its second the Key Vault signature of the manifest; the files follow in
+// manifest order. The manifest can be read and checked without extracting
+// anything, and extraction rejects any file that does not match it.
+
+const (
+	archiveVersion      = "1"
+	archiveManifestName = ".kvcrypt/manifest.json"
+	archiveSigName      = ".kvcrypt/manifest.sig"
+	archiveMaxManifest  = 64 << 20
+)
+
+// DigestSigner signs SHA-256 digests with RS256 using a key that never leaves
+// it. EncryptionClient signs with its Key Vault key.
+type DigestSigner interface {
+	// SignDigest returns the signature and the identifier of the key version
+	// that made it.
+	SignDigest(ctx context.Context, digest []byte) (signature string, keyID string, err error)
+	// VerifyDigest checks a signature made by the key version keyID.
+	VerifyDigest(ctx context.Context, keyID string, digest []byte, signature string) (bool, error)
+}
+
+// ArchiveManifest lists the contents of an archive.
+type ArchiveManifest struct {
+	Version string         `json:"version"`
+	Created time.Time      `json:"created"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// ArchiveEntry is a file or directory of an archive. Name is slash separated
+// and relative to the archived directory.
+type ArchiveEntry struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	SHA256  string      `json:"sha256,omitempty"`
+}
+
+type archiveSignature struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Signature string `json:"signature"`
+}
+
+// CreateArchive writes the directory tree at dir to w as an archive, under a
+// new data key wrapped by kw, with its manifest signed by s. Only regular
+// files and directories can be archived.
+func CreateArchive(ctx context.Context, kw KeyWrapper, s DigestSigner, dir string, w io.Writer) (*ArchiveManifest, error) {
+	manifest, err := scanArchiveDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(encoded)
+	signature, keyID, err := s.SignDigest(ctx, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig, err := json.Marshal(&archiveSignature{KeyID: keyID, Algorithm: "RS256", Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypter, err := NewEncryptWriter(ctx, kw, w)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(encrypter)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{archiveManifestName, encoded}, {archiveSigName, sig}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: manifest.Created, Format: tar.FormatPAX}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range manifest.Entries {
+		if err := writeArchiveEntry(tw, dir, entry); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := encrypter.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func scanArchiveDir(dir string) (*ArchiveManifest, error) {
+	manifest := &ArchiveManifest{Version: archiveVersion, Created: time.Now().UTC().Truncate(time.Second)}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		entry := ArchiveEntry{Name: filepath.ToSlash(rel), Mode: info.Mode() & (os.ModeDir | os.ModePerm), ModTime: info.ModTime().UTC().Truncate(time.Second)}
+		switch {
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if entry.SHA256, err = hashFile(p); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: only regular files and directories can be archived", p)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	return manifest, err
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, dir string, entry ArchiveEntry) error {
+	header := &tar.Header{Name: entry.Name, Mode: int64(entry.Mode.Perm()), Size: entry.Size, ModTime: entry.ModTime, Format: tar.FormatPAX}
+	if entry.Mode.IsDir() {
+		header.Typeflag, header.Name = tar.TypeDir, entry.Name+"/"
+		return tw.WriteHeader(header)
+	}
+	header.Typeflag = tar.TypeReg
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(entry.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(f, entry.Size))
+	if err != nil {
+		return err
+	}
+	if n != entry.Size || hex.EncodeToString(h.Sum(nil)) != entry.SHA256 {
+		return fmt.Errorf("%s changed while it was archived", entry.Name)
+	}
+	return nil
+}
+
+// archiveReader reads an archive whose manifest was verified.
+type archiveReader struct {
+	decrypter io.Reader
+	tar       *tar.Reader
+	manifest  *ArchiveManifest
+}
+
+// openArchive decrypts the start of an archive and verifies its manifest's
+// signature with s.
+func openArchive(ctx context.Context, kw KeyWrapper, s DigestSigner, r io.Reader) (*archiveReader, error) {
+	decrypter, err := NewDecryptReader(ctx, kw, r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(decrypter)
+	encoded, err := readArchiveFile(tr, archiveManifestName)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := readArchiveFile(tr, archiveSigName)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig archiveSignature
+	if err := json.Unmarshal(sigData, &sig); err != nil {
+		return nil, fmt.Errorf("archive signature: %v", err)
+	}
+	if sig.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unsupported archive signature algorithm %q", sig.Algorithm)
+	}
+	digest := sha256.Sum256(encoded)
+	ok, err := s.VerifyDigest(ctx, sig.KeyID, digest[:], sig.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &KeyOperationError{Op: "verify", Kind: ErrInvalidCiphertext, Err: errors.New("archive manifest signature does not verify")}
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return nil, fmt.Errorf("archive manifest: %v", err)
+	}
+	if manifest.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %q", manifest.Version)
+	}
+	if err := checkArchiveNames(manifest.Entries); err != nil {
+		return nil, err
+	}
+	return &archiveReader{decrypter: decrypter, tar: tr, manifest: &manifest}, nil
+}
+
+func readArchiveFile(tr *tar.Reader, name string) ([]byte, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+	if header.Name != name || header.Size > archiveMaxManifest {
+		return nil, fmt.Errorf("not an archive: expected %s, found %s", name, header.Name)
+	}
+	return ioutil.ReadAll(tr)
+}
+
+// checkArchiveNames rejects names that would be extracted outside the
+// destination directory, or twice.
+func checkArchiveNames(entries []ArchiveEntry) error {
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name
+		if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, `\`) {
+			return fmt.Errorf("archive holds unsafe file name %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("archive holds %q twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// ListArchive returns the verified manifest of an archive, decrypting only
+// the start of it.
+func ListArchive(ctx context.Context, kw KeyWrapper, s DigestSigner, r io.Reader) (*ArchiveManifest, error) {
+	a, err := openArchive(ctx, kw, s, r)
+	if err != nil {
+		return nil, err
+	}
+	return a.manifest, nil
+}
+
+// ExtractArchive extracts an archive into dir, checking every file against
+// the verified manifest. Each file is written to a temporary file and only
+// moved into place once its hash matched, so a failed extraction leaves only
+// verified files behind. Existing files are only replaced when overwrite is
+// set, and symbolic links below dir are never followed.
+func ExtractArchive(ctx context.Context, kw KeyWrapper, s DigestSigner, r io.Reader, dir string, overwrite bool) (*ArchiveManifest, error) {
+	a, err := openArchive(ctx, kw, s, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range a.manifest.Entries {
+		header, err := a.tar.Next()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		if strings.TrimSuffix(header.Name, "/") != entry.Name || header.Size != entry.Size || (header.Typeflag == tar.TypeDir) != entry.Mode.IsDir() {
+			return nil, fmt.Errorf("archive entry %s does not match the manifest", header.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(entry.Name))
+		if err := checkNoSymlinks(dir, entry.Name); err != nil {
+			return nil, err
+		}
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := extractArchiveFile(a.tar, entry, target, overwrite); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := a.tar.Next(); err != io.EOF {
+		return nil, errors.New("archive holds files missing from its manifest")
+	}
+	// reading to the end authenticates the final chunk of the stream
+	if _, err := io.Copy(ioutil.Discard, a.decrypter); err != nil {
+		return nil, err
+	}
+
+	// directories get their mode last, so read-only ones could be filled
+	for i := len(a.manifest.Entries) - 1; i >= 0; i-- {
+		entry := a.manifest.Entries[i]
+		target := filepath.Join(dir, filepath.FromSlash(entry.Name))
+		if err := checkNoSymlinks(dir, entry.Name); err != nil {
+			return nil, err
+		}
+		if entry.Mode.IsDir() {
+			if err := os.Chmod(target, entry.Mode.Perm()); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Chtimes(target, entry.ModTime, entry.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	return a.manifest, nil
+}
+
+// checkNoSymlinks fails when a path component of name below dir is a
+// symbolic link, which would have the archive written outside dir.
+// Components that do not exist yet are created by the extraction itself.
+func checkNoSymlinks(dir, name string) error {
+	p := dir
+	for _, component := range strings.Split(name, "/") {
+		p = filepath.Join(p, component)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link, refusing to extract through it", p)
+		}
+	}
+	return nil
+}
+
+func extractArchiveFile(r io.Reader, entry ArchiveEntry, target string, overwrite bool) error {
+	if info, err := os.Lstat(target); err == nil {
+		if !overwrite {
+			return fmt.Errorf("%s already exists", target)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s already exists and is not a regular file", target)
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != entry.SHA256 {
+		tmp.Close()
+		return &KeyOperationError{Op: "verify", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("%s does not match its hash in the manifest", entry.Name)}
+	}
+	if err := tmp.Chmod(entry.Mode.Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArchiveFile is a tar entry of a crafted archive.
+type testArchiveFile struct {
+	name string
+	data []byte
+	dir  bool
+}
+
+func testArchiveEntry(name string, data []byte) ArchiveEntry {
+	sum := sha256.Sum256(data)
+	return ArchiveEntry{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(1500000000, 0).UTC(), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// signTestManifest encodes entries as a manifest and signs it with vault.
+func signTestManifest(t *testing.T, vault *FakeVault, entries ...ArchiveEntry) (manifest, sig []byte) {
+	t.Helper()
+	manifest, err := json.Marshal(&ArchiveManifest{Version: archiveVersion, Created: time.Unix(1500000000, 0).UTC(), Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(manifest)
+	signature, keyID, err := vault.SignDigest(context.Background(), digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = json.Marshal(&archiveSignature{KeyID: keyID, Algorithm: "RS256", Signature: signature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, sig
+}
+
+// writeTestArchive writes an archive holding manifest, sig and files as they
+// are, for archives CreateArchive would not write.
+func writeTestArchive(t *testing.T, vault *FakeVault, manifest, sig []byte, files ...testArchiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(context.Background(), vault, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	files = append([]testArchiveFile{{name: archiveManifestName, data: manifest}, {name: archiveSigName, data: sig}}, files...)
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if f.dir {
+			header.Name, header.Typeflag, header.Mode = f.name+"/", tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "config", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"a.txt": "alpha", "config/db.yaml": "password: hunter2"}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if _, err := CreateArchive(ctx, vault, vault, src, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("hunter2")) {
+		t.Fatal("archive holds plaintext")
+	}
+	manifest, err := ListArchive(ctx, vault, vault, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 4 {
+		t.Errorf("manifest lists %d entries, want 4: %+v", len(manifest.Entries), manifest.Entries)
+	}
+
+	dst := t.TempDir()
+	if _, err := ExtractArchive(ctx, vault, vault, bytes.NewReader(archive.Bytes()), dst, false); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "config", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty directory not extracted: %v", err)
+	}
+	if _, err := ExtractArchive(ctx, vault, vault, bytes.NewReader(archive.Bytes()), dst, false); err == nil {
+		t.Error("extraction replaced existing files without overwrite")
+	}
+}
+
+func TestExtractArchiveRejectsUnsafeArchives(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("payload")
+	entry := testArchiveEntry("a.txt", data)
+
+	escape, escapeSig := signTestManifest(t, vault, testArchiveEntry("../escaped.txt", data))
+	dup, dupSig := signTestManifest(t, vault, entry, entry)
+	valid, validSig := signTestManifest(t, vault, entry)
+	tampered := bytes.Replace(valid, []byte(`"a.txt"`), []byte(`"b.txt"`), 1)
+	other, otherSig := signTestManifest(t, vault, testArchiveEntry("a.txt", []byte("another payload")))
+
+	tests := []struct {
+		name    string
+		archive []byte
+		// invalid is set when the error must wrap ErrInvalidCiphertext
+		invalid bool
+	}{
+		{"parent directory name", writeTestArchive(t, vault, escape, escapeSig, testArchiveFile{name: "../escaped.txt", data: data}), false},
+		{"duplicate name", writeTestArchive(t, vault, dup, dupSig, testArchiveFile{name: "a.txt", data: data}, testArchiveFile{name: "a.txt", data: data}), false},
+		{"tampered manifest", writeTestArchive(t, vault, tampered, validSig, testArchiveFile{name: "b.txt", data: data}), true},
+		{"file not matching its hash", writeTestArchive(t, vault, valid, validSig, testArchiveFile{name: "a.txt", data: []byte("PAYLOAD")}), true},
+		{"file not matching its size", writeTestArchive(t, vault, other, otherSig, testArchiveFile{name: "a.txt", data: data}), false},
+		{"file not in the manifest", writeTestArchive(t, vault, valid, validSig, testArchiveFile{name: "a.txt", data: data}, testArchiveFile{name: "extra.txt", data: data}), false},
+		{"file in place of a directory", writeTestArchive(t, vault, valid, validSig, testArchiveFile{name: "a.txt", dir: true}), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "dst")
+			_, err := ExtractArchive(context.Background(), vault, vault, bytes.NewReader(tc.archive), dst, false)
+			if err == nil {
+				t.Fatal("archive extracted")
+			}
+			if tc.invalid && !errors.Is(err, ErrInvalidCiphertext) {
+				t.Errorf("got %v, want ErrInvalidCiphertext", err)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped.txt")); !os.IsNotExist(err) {
+				t.Error("file written outside the destination")
+			}
+			if _, err := os.Lstat(filepath.Join(dst, "b.txt")); !os.IsNotExist(err) {
+				t.Error("file from a tampered manifest extracted")
+			}
+			if got, err := ioutil.ReadFile(filepath.Join(dst, "a.txt")); err == nil && !bytes.Equal(got, data) {
+				t.Errorf("unverified a.txt extracted: %q", got)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRefusesSymlinkedParent(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("payload")
+	manifest, sig := signTestManifest(t, vault, ArchiveEntry{Name: "sub", Mode: os.ModeDir | 0755, ModTime: time.Unix(1500000000, 0).UTC()}, testArchiveEntry("sub/a.txt", data))
+	archive := writeTestArchive(t, vault, manifest, sig, testArchiveFile{name: "sub", dir: true}, testArchiveFile{name: "sub/a.txt", data: data})
+
+	dst, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dst, "sub")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	_, err = ExtractArchive(context.Background(), vault, vault, bytes.NewReader(archive), dst, true)
+	if err == nil || !strings.Contains(err.Error(), "symbolic link") {
+		t.Fatalf("got %v, want extraction through a symbolic link refused", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "a.txt")); !os.IsNotExist(err) {
+		t.Error("file written through the symbolic link")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A blind index makes a randomly encrypted column searchable without
+// deterministic encryption: next to the ciphertext, each row stores a
+// truncated HMAC-SHA256 of the normalized plaintext, and a search computes
+// the HMAC of what it looks for. Truncation makes unrelated values collide,
+// so a search returns a few false positives to drop after decrypting, but
+// the index also reveals less than deterministic ciphertexts: equal indexes
+// only suggest equal values. Each index, named after its column, gets its own
+// HMAC key derived from a secret wrapped by the Key Vault key.
+
+const (
+	blindIndexSecretSize  = 32
+	defaultBlindIndexBits = 32
+)
+
+// BlindIndexKey is the secret all blind indexes are derived from, along with
+// its wrapped form.
+type BlindIndexKey struct {
+	KeyID   string
+	Wrapped string
+	secret  []byte
+}
+
+// NewBlindIndexKey generates a blind index secret and wraps it with w.
+func NewBlindIndexKey(ctx context.Context, w KeyWrapper) (*BlindIndexKey, error) {
+	secret := make([]byte, blindIndexSecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := w.WrapDataKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &BlindIndexKey{KeyID: keyID, Wrapped: wrapped, secret: secret}, nil
+}
+
+// OpenBlindIndexKey unwraps a secret wrapped by NewBlindIndexKey.
+func OpenBlindIndexKey(ctx context.Context, w KeyWrapper, keyID, wrapped string) (*BlindIndexKey, error) {
+	secret, err := w.UnwrapDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != blindIndexSecretSize {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("blind index secret is %d bytes, expected %d", len(secret), blindIndexSecretSize)}
+	}
+	return &BlindIndexKey{KeyID: keyID, Wrapped: wrapped, secret: secret}, nil
+}
+
+// BlindIndexOptions configure a blind index.
+type BlindIndexOptions struct {
+	// Bits is the length of the index, 32 when zero. A search matches
+	// about N/2^Bits unrelated rows, N being the number of indexes stored,
+	// one per row and token: fewer bits leak less about which rows are
+	// equal, at the cost of more false positives as the table grows.
+	Bits int
+	// Normalize is applied to values before they are indexed or searched,
+	// such as NormalizeEmail. Values are indexed as they are when nil.
+	Normalize func(string) string
+	// Tokenize splits a normalized value into the tokens stored for it,
+	// such as PrefixTokens. Each value is its only token when nil.
+	Tokenize func(string) []string
+}
+
+// BlindIndex computes the index of one column.
+type BlindIndex struct {
+	bits int
+	key  []byte
+	opts BlindIndexOptions
+}
+
+// Index returns the blind index called name, such as "users.email". Indexes
+// with different names are unrelated.
+func (k *BlindIndexKey) Index(name string, opts BlindIndexOptions) (*BlindIndex, error) {
+	bits := opts.Bits
+	if bits == 0 {
+		bits = defaultBlindIndexBits
+	}
+	if bits < 1 || bits > sha256.Size*8 {
+		return nil, fmt.Errorf("blind index %s: length of %d bits is outside 1 to %d", name, bits, sha256.Size*8)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte("kvcrypt blind index\x00" + name))
+	return &BlindIndex{bits: bits, key: mac.Sum(nil), opts: opts}, nil
+}
+
+// Bits returns the length of the index in bits. Indexes are stored in
+// Bits/8 bytes, rounded up.
+func (ix *BlindIndex) Bits() int {
+	return ix.bits
+}
+
+func (ix *BlindIndex) normalize(value string) string {
+	if ix.opts.Normalize == nil {
+		return value
+	}
+	return ix.opts.Normalize(value)
+}
+
+func (ix *BlindIndex) mac(token string) []byte {
+	mac := hmac.New(sha256.New, ix.key)
+	mac.Write([]byte(token))
+	sum := mac.Sum(nil)[:(ix.bits+7)/8]
+	if extra := uint(len(sum)*8 - ix.bits); extra > 0 {
+		sum[len(sum)-1] &= 0xff << extra
+	}
+	return sum
+}
+
+// Search returns the index to look value up with: rows holding it have
+// value among their tokens, along with a few false positives.
+func (ix *BlindIndex) Search(value string) []byte {
+	return ix.mac(ix.normalize(value))
+}
+
+// Tokens returns the indexes to store for value, one per distinct token.
+func (ix *BlindIndex) Tokens(value string) [][]byte {
+	normalized := ix.normalize(value)
+	tokens := []string{normalized}
+	if ix.opts.Tokenize != nil {
+		tokens = ix.opts.Tokenize(normalized)
+	}
+
+	seen := map[string]bool{}
+	var indexes [][]byte
+	for _, token := range tokens {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		indexes = append(indexes, ix.mac(token))
+	}
+	return indexes
+}
+
+// NormalizeEmail trims and lower-cases an email address.
+func NormalizeEmail(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// NormalizeFold trims value, lower-cases it and collapses runs of spaces,
+// for names and other free text.
+func NormalizeFold(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+// PrefixTokens returns a Tokenize function indexing every prefix of at
+// least min characters, so that prefix searches of min characters or more
+// find the value. Each prefix is a token, which reveals the length of the
+// value through the number of tokens stored. It panics when min is less
+// than 1.
+func PrefixTokens(min int) func(string) []string {
+	if min < 1 {
+		panic(fmt.Sprintf("PrefixTokens: minimum prefix length must be at least 1, got %d", min))
+	}
+	return func(value string) []string {
+		if utf8.RuneCountInString(value) <= min {
+			return []string{value}
+		}
+		var tokens []string
+		n := 0
+		for i := range value {
+			if n >= min {
+				tokens = append(tokens, value[:i])
+			}
+			n++
+		}
+		return append(tokens, value)
+	}
+}
+
+// BlindIndexEntry holds the indexes of one row.
+type BlindIndexEntry struct {
+	ID      interface{}
+	Indexes [][]byte
+}
+
+// Backfill builds the index of existing rows, such as when a column gains a
+// blind index. next returns the identifier and plaintext of one row at a
+// time, and io.EOF after the last one; store writes the indexes of up to
+// batchSize rows. It returns how many rows were indexed.
+func (ix *BlindIndex) Backfill(ctx context.Context, next func() (id interface{}, value string, err error), store func(ctx context.Context, batch []BlindIndexEntry) error, batchSize int) (int, error) {
+	if batchSize < 1 {
+		return 0, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	var batch []BlindIndexEntry
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		id, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, BlindIndexEntry{ID: id, Indexes: ix.Tokens(value)})
+		if len(batch) == batchSize {
+			if err := store(ctx, batch); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		if err := store(ctx, batch); err != nil {
+			return count, err
+		}
+		count += len(batch)
+	}
+	return count, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func newTestBlindIndexKey(t *testing.T) *BlindIndexKey {
+	t.Helper()
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewBlindIndexKey(context.Background(), vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestBlindIndexBits(t *testing.T) {
+	key := newTestBlindIndexKey(t)
+	full, err := key.Index("users.email", BlindIndexOptions{Bits: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := full.Search("ada@example.com")
+
+	for _, bits := range []int{1, 7, 8, 9, 12, 31, 32, 255} {
+		ix, err := key.Index("users.email", BlindIndexOptions{Bits: bits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ix.Search("ada@example.com")
+		if len(got) != (bits+7)/8 {
+			t.Errorf("%d bits: index is %d bytes, want %d", bits, len(got), (bits+7)/8)
+			continue
+		}
+		// the index is the first bits of the full HMAC, the rest masked
+		expected := append([]byte(nil), want[:len(got)]...)
+		if extra := len(got)*8 - bits; extra > 0 {
+			expected[len(expected)-1] &= 0xff << uint(extra)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%d bits: index %x, want %x", bits, got, expected)
+		}
+	}
+
+	if ix, err := key.Index("users.email", BlindIndexOptions{}); err != nil || ix.Bits() != defaultBlindIndexBits {
+		t.Errorf("default length = %v, %v, want %d bits", ix, err, defaultBlindIndexBits)
+	}
+	for _, bits := range []int{-1, 257} {
+		if _, err := key.Index("users.email", BlindIndexOptions{Bits: bits}); err == nil {
+			t.Errorf("index of %d bits accepted", bits)
+		}
+	}
+
+	other, err := key.Index("users.name", BlindIndexOptions{Bits: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.Search("ada@example.com"), want) {
+		t.Error("indexes with different names are equal")
+	}
+}
+
+func TestPrefixTokensMultiByte(t *testing.T) {
+	tests := []struct {
+		min   int
+		value string
+		want  []string
+	}{
+		{2, "héllo", []string{"hé", "hél", "héll", "héllo"}},
+		{1, "日本語", []string{"日", "日本", "日本語"}},
+		{3, "日本", []string{"日本"}},
+		{3, "日本語", []string{"日本語"}},
+		{2, "", []string{""}},
+	}
+	for _, tc := range tests {
+		got := PrefixTokens(tc.min)(tc.value)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("PrefixTokens(%d)(%q) = %q, want %q", tc.min, tc.value, got, tc.want)
+		}
+		for _, token := range got {
+			if !utf8.ValidString(token) {
+				t.Errorf("PrefixTokens(%d)(%q) split a character: %q", tc.min, tc.value, token)
+			}
+		}
+	}
+
+	key := newTestBlindIndexKey(t)
+	ix, err := key.Index("users.name", BlindIndexOptions{Normalize: NormalizeFold, Tokenize: PrefixTokens(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := ix.Tokens("  ÉLODIE ")
+	if len(tokens) != 5 {
+		t.Fatalf("got %d tokens, want 5", len(tokens))
+	}
+	if !bytes.Equal(tokens[0], ix.Search("él")) || !bytes.Equal(tokens[4], ix.Search("Élodie")) {
+		t.Error("prefix searches do not match the stored tokens")
+	}
+}
+
+func TestBlindIndexBackfill(t *testing.T) {
+	key := newTestBlindIndexKey(t)
+	ix, err := key.Index("users.email", BlindIndexOptions{Normalize: NormalizeEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	values := []string{"a@example.com", "B@example.com", "c@example.com", "d@example.com", "e@example.com", "f@example.com", "g@example.com"}
+	rows := func() func() (interface{}, string, error) {
+		i := 0
+		return func() (interface{}, string, error) {
+			if i == len(values) {
+				return nil, "", io.EOF
+			}
+			i++
+			return i, values[i-1], nil
+		}
+	}
+
+	var sizes []int
+	var stored []BlindIndexEntry
+	n, err := ix.Backfill(ctx, rows(), func(ctx context.Context, batch []BlindIndexEntry) error {
+		sizes = append(sizes, len(batch))
+		stored = append(stored, batch...)
+		return nil
+	}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(values) || !reflect.DeepEqual(sizes, []int{3, 3, 1}) {
+		t.Errorf("indexed %d rows in batches of %v, want %d in batches of [3 3 1]", n, sizes, len(values))
+	}
+	for i, entry := range stored {
+		if entry.ID != i+1 || len(entry.Indexes) != 1 || !bytes.Equal(entry.Indexes[0], ix.Search(values[i])) {
+			t.Errorf("row %d stored as %v", i+1, entry)
+		}
+	}
+
+	// a failed batch stops the backfill, counting only what was stored
+	failure := errors.New("store failed")
+	calls := 0
+	n, err = ix.Backfill(ctx, rows(), func(ctx context.Context, batch []BlindIndexEntry) error {
+		if calls++; calls == 2 {
+			return failure
+		}
+		return nil
+	}, 3)
+	if err != failure || n != 3 {
+		t.Errorf("failed backfill = %d, %v, want 3, %v", n, err, failure)
+	}
+
+	if _, err := ix.Backfill(ctx, rows(), func(context.Context, []BlindIndexEntry) error { return nil }, 0); err == nil {
+		t.Error("batch size of 0 accepted")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if n, err := ix.Backfill(cancelled, rows(), func(context.Context, []BlindIndexEntry) error { return nil }, 3); err != context.Canceled || n != 0 {
+		t.Errorf("cancelled backfill = %d, %v, want 0, %v", n, err, context.Canceled)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Caller identifies the client of an EncryptionServer request, either by its
+// TLS client certificate or, on a unix socket, by its peer credentials.
+type Caller struct {
+	// SPIFFEID is the spiffe:// URI SAN of the client certificate, if any.
+	SPIFFEID   string
+	Subject    string
+	CommonName string
+	DNSNames   []string
+
+	// PeerCredentials is set for unix socket callers.
+	PeerCredentials *PeerCredentials
+}
+
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// String is the identity recorded in the audit log.
+func (c *Caller) String() string {
+	switch {
+	case c == nil:
+		return "anonymous"
+	case c.SPIFFEID != "":
+		return c.SPIFFEID
+	case c.Subject != "":
+		return "x509:" + c.Subject
+	case c.PeerCredentials != nil:
+		return fmt.Sprintf("unix:uid=%d,gid=%d,pid=%d", c.PeerCredentials.UID, c.PeerCredentials.GID, c.PeerCredentials.PID)
+	}
+	return "anonymous"
+}
+
+func callerFromCertificate(cert *x509.Certificate) *Caller {
+	caller := &Caller{
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			caller.SPIFFEID = uri.String()
+			break
+		}
+	}
+	return caller
+}
+
+type callerKey struct{}
+type peerCredentialsKey struct{}
+
+func callerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// identify attaches the Caller of r to its context.
+func identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var caller *Caller
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			caller = callerFromCertificate(r.TLS.PeerCertificates[0])
+		}
+		if creds, ok := r.Context().Value(peerCredentialsKey{}).(*PeerCredentials); ok {
+			if caller == nil {
+				caller = &Caller{}
+			}
+			caller.PeerCredentials = creds
+		}
+		if caller != nil {
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connContext records the peer credentials of unix socket connections.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	creds, err := peerCredentials(unixConn)
+	if err != nil {
+		slog.Warn("cannot read peer credentials", slog.String("error", err.Error()))
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, creds)
+}
+
+// CallerPolicy decides which callers may run which operations with which key
+// profiles. Callers that match no rule are denied.
+type CallerPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+type PolicyRule struct {
+	Name string `json:"name"`
+	// Callers lists the callers the rule applies to; any of them may match.
+	Callers []CallerMatch `json:"callers"`
+	// Profiles and Operations may contain "*" to allow all.
+	Profiles   []string `json:"profiles"`
+	Operations []string `json:"operations"`
+}
+
+// CallerMatch matches a caller when every field that is set matches.
+type CallerMatch struct {
+	// SPIFFEID is an exact ID, or when it ends in "/*", matches every ID
+	// below that path.
+	SPIFFEID   string  `json:"spiffe_id,omitempty"`
+	Subject    string  `json:"subject,omitempty"`
+	CommonName string  `json:"common_name,omitempty"`
+	DNSName    string  `json:"dns_name,omitempty"`
+	UID        *uint32 `json:"uid,omitempty"`
+	GID        *uint32 `json:"gid,omitempty"`
+}
+
+var policyOperations = map[string]bool{"*": true, "encrypt": true, "decrypt": true, "sign": true, "verify": true}
+
+// LoadCallerPolicy reads a JSON policy file:
+//
+//	{"rules": [{"name": "a-encrypts", "callers": [{"spiffe_id": "spiffe://example.org/a"}],
+//	            "profiles": ["x"], "operations": ["encrypt"]}]}
+func LoadCallerPolicy(path string) (*CallerPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy CallerPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, rule := range policy.Rules {
+		if len(rule.Callers) == 0 {
+			return nil, fmt.Errorf("%s: rule %d has no callers", path, i)
+		}
+		for _, m := range rule.Callers {
+			if m == (CallerMatch{}) {
+				return nil, fmt.Errorf("%s: rule %d has an empty caller match", path, i)
+			}
+			if base := strings.TrimSuffix(m.SPIFFEID, "/*"); strings.Contains(base, "*") {
+				return nil, fmt.Errorf("%s: rule %d: spiffe_id %s may only end in /* as a wildcard", path, i, m.SPIFFEID)
+			} else if base != m.SPIFFEID && (!strings.HasPrefix(base, "spiffe://") || len(base) == len("spiffe://")) {
+				return nil, fmt.Errorf("%s: rule %d: spiffe_id wildcard %s needs a trust domain", path, i, m.SPIFFEID)
+			}
+		}
+		for _, op := range rule.Operations {
+			if !policyOperations[op] {
+				return nil, fmt.Errorf("%s: rule %d: unknown operation %s", path, i, op)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// Allows reports whether caller may run operation with profile, and the name
+// of the rule that allowed it.
+func (p *CallerPolicy) Allows(caller *Caller, operation, profile string) (bool, string) {
+	if caller == nil {
+		return false, ""
+	}
+	for i, rule := range p.Rules {
+		if !containsOrWildcard(rule.Operations, operation) || !containsOrWildcard(rule.Profiles, profile) {
+			continue
+		}
+		for _, m := range rule.Callers {
+			if m.matches(caller) {
+				name := rule.Name
+				if name == "" {
+					name = fmt.Sprintf("rule %d", i)
+				}
+				return true, name
+			}
+		}
+	}
+	return false, ""
+}
+
+func (m CallerMatch) matches(c *Caller) bool {
+	if m.SPIFFEID != "" {
+		if base := strings.TrimSuffix(m.SPIFFEID, "/*"); base != m.SPIFFEID {
+			if !strings.HasPrefix(c.SPIFFEID, base+"/") || len(c.SPIFFEID) == len(base)+1 {
+				return false
+			}
+		} else if c.SPIFFEID != m.SPIFFEID {
+			return false
+		}
+	}
+	if m.Subject != "" && c.Subject != m.Subject {
+		return false
+	}
+	if m.CommonName != "" && c.CommonName != m.CommonName {
+		return false
+	}
+	if m.DNSName != "" && !containsString(c.DNSNames, m.DNSName) {
+		return false
+	}
+	if m.UID != nil && (c.PeerCredentials == nil || c.PeerCredentials.UID != *m.UID) {
+		return false
+	}
+	if m.GID != nil && (c.PeerCredentials == nil || c.PeerCredentials.GID != *m.GID) {
+		return false
+	}
+	return true
+}
+
+func containsOrWildcard(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionDeniedError is returned when the policy does not allow a request.
+type permissionDeniedError struct {
+	caller    string
+	operation string
+	profile   string
+}
+
+func (e *permissionDeniedError) Error() string {
+	return fmt.Sprintf("%s may not %s with profile %s", e.caller, e.operation, e.profile)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCallerMatchSPIFFEWildcard(t *testing.T) {
+	m := CallerMatch{SPIFFEID: "spiffe://example.org/svc/*"}
+	for id, want := range map[string]bool{
+		"spiffe://example.org/svc/a":     true,
+		"spiffe://example.org/svc/a/b":   true,
+		"spiffe://example.org/svc":       false,
+		"spiffe://example.org/svc/":      false,
+		"spiffe://example.org/svc-evil":  false,
+		"spiffe://example.org/svcx/a":    false,
+		"spiffe://example.org.evil/svc/": false,
+	} {
+		if got := m.matches(&Caller{SPIFFEID: id}); got != want {
+			t.Errorf("%s matching %s = %v, want %v", m.SPIFFEID, id, got, want)
+		}
+	}
+
+	exact := CallerMatch{SPIFFEID: "spiffe://example.org/svc"}
+	if exact.matches(&Caller{SPIFFEID: "spiffe://example.org/svc/a"}) {
+		t.Error("exact ID matched a longer one")
+	}
+}
+
+func TestLoadCallerPolicyRejectsInnerWildcards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	for id, valid := range map[string]bool{
+		"spiffe://example.org/svc/*": true,
+		"spiffe://example.org/svc":   true,
+		"spiffe://example.org/svc*":  false,
+		"spiffe://example.org/*/a":   false,
+		"spiffe://*":                 false,
+	} {
+		policy := `{"rules": [{"callers": [{"spiffe_id": "` + id + `"}], "profiles": ["*"], "operations": ["*"]}]}`
+		if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCallerPolicy(path); (err == nil) != valid {
+			t.Errorf("LoadCallerPolicy with spiffe_id %s: %v", id, err)
+		}
+	}
+}
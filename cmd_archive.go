@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const archiveUsage = "usage: kvcrypt archive <create [-out path] <dir> | extract [-C dir] [-force] <archive> | list <archive>>"
+
+func runArchive(args []string) error {
+	if len(args) == 0 {
+		return errors.New(archiveUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("archive "+action, flag.ExitOnError)
+	out := fs.String("out", "", "with create, file to write instead of standard output")
+	dest := fs.String("C", ".", "with extract, directory to extract into")
+	force := fs.Bool("force", false, "with extract, replace existing files")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return errors.New(archiveUsage)
+	}
+
+	// the configured key both wraps and signs, and is the only key whose
+	// signatures extract and list accept
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		return err
+	}
+	client, err := NewEncryptionClientFromEnv(azureConfiguration)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch action {
+	case "create":
+		return writeStream(*out, func(w io.Writer) error {
+			manifest, err := CreateArchive(ctx, client, client, fs.Arg(0), w)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "archived %d entries\n", len(manifest.Entries))
+			}
+			return err
+		})
+	case "extract", "list":
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if action == "list" {
+			manifest, err := ListArchive(ctx, client, client, f)
+			if err != nil {
+				return err
+			}
+			for _, entry := range manifest.Entries {
+				fmt.Printf("%s %12d %s %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), entry.Name)
+			}
+			return nil
+		}
+		manifest, err := ExtractArchive(ctx, client, client, f, *dest, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "extracted %d entries into %s\n", len(manifest.Entries), *dest)
+		return nil
+	}
+	return errors.New(archiveUsage)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const csvUsage = "usage: kvcrypt csv <encrypt|decrypt> [-columns email,ssn] [-no-header] [-delimiter ,] [-out path] [path]"
+
+func runCSV(args []string) error {
+	if len(args) == 0 {
+		return errors.New(csvUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("csv "+action, flag.ExitOnError)
+	columns := fs.String("columns", "", "comma separated columns to encrypt: header names, or column numbers with -no-header")
+	noHeader := fs.Bool("no-header", false, "the first row holds data rather than column names")
+	delimiter := fs.String("delimiter", ",", "field delimiter")
+	out := fs.String("out", "", "file to write instead of standard output")
+	fs.Parse(args[1:])
+
+	if fs.NArg() > 1 {
+		return errors.New(csvUsage)
+	}
+	comma, size := utf8.DecodeRuneInString(*delimiter)
+	if size == 0 || size != len(*delimiter) {
+		return fmt.Errorf("-delimiter must be a single character, got %q", *delimiter)
+	}
+	opts := CSVOptions{NoHeader: *noHeader, Comma: comma}
+	if *columns != "" {
+		for _, c := range strings.Split(*columns, ",") {
+			opts.Columns = append(opts.Columns, strings.TrimSpace(c))
+		}
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	input := bufio.NewReaderSize(in, csvMaxMetadata)
+	ctx := context.Background()
+
+	var client *EncryptionClient
+	switch action {
+	case "encrypt":
+		if len(opts.Columns) == 0 {
+			return errors.New("-columns is required")
+		}
+		azureConfiguration, err := ParseEnvironment()
+		if err != nil {
+			return err
+		}
+		if client, err = NewEncryptionClientFromEnv(azureConfiguration); err != nil {
+			return err
+		}
+	case "decrypt":
+		m, err := readCSVMetadata(input)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("file has no %s metadata: not encrypted", fileMetadataKey)
+		}
+		// the key comes from the file, so only an allowed one is used
+		if client, err = clientForKey(m.KeyID); err != nil {
+			return fmt.Errorf("%s metadata: %w", fileMetadataKey, err)
+		}
+	default:
+		return errors.New(csvUsage)
+	}
+
+	return writeStream(*out, func(w io.Writer) error {
+		output := bufio.NewWriter(w)
+		var err error
+		if action == "encrypt" {
+			err = EncryptCSV(ctx, client, input, output, opts)
+		} else {
+			err = DecryptCSV(ctx, client, input, output, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return output.Flush()
+	})
+}
+
+// writeStream calls write with standard output, or with a temporary file
+// that replaces path once write succeeds, so that no partial output is left
+// behind.
+func writeStream(path string, write func(io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
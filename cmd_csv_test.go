@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCSVDecryptRefusesForeignKeys(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	err = EncryptCSV(context.Background(), vault, strings.NewReader("email,name\nann@example.com,Ann\n"), &encrypted, CSVOptions{Columns: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encrypted.String(), fakeVaultKeyPrefix) {
+		t.Fatalf("metadata does not name the key:\n%s", encrypted.String())
+	}
+	setAllowedKeys(t, "https://myvault.vault.azure.net/keys/mykey", "")
+
+	for name, prefix := range map[string]string{
+		"unlisted vault": fakeVaultKeyPrefix,
+		"other host":     "https://attacker.example/fake.vault.azure.net/keys/fake/",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.csv")
+			data := strings.Replace(encrypted.String(), fakeVaultKeyPrefix, prefix, -1)
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := runCSV([]string{"decrypt", path}); !errors.Is(err, ErrInvalidKeyIdentifier) {
+				t.Errorf("got %v, want ErrInvalidKeyIdentifier", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+const deletedUsage = "usage: kvcrypt deleted <list|show|recover|purge> [-name key] [-yes]"
+
+func runDeleted(args []string) error {
+	if len(args) == 0 {
+		return errors.New(deletedUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("deleted "+action, flag.ExitOnError)
+	name := fs.String("name", "", "key name (defaults to the configured key)")
+	yes := fs.Bool("yes", false, "confirm a purge, which cannot be undone")
+	fs.Parse(args[1:])
+
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		return err
+	}
+	client, err := NewEncryptionClientFromEnv(azureConfiguration)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = client.kvInfo.keyName
+	}
+
+	ctx := context.Background()
+
+	switch action {
+	case "list":
+		keys, err := client.DeletedKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			printDeletedKey(k)
+		}
+	case "show":
+		key, err := client.DeletedKey(ctx, *name)
+		if err != nil {
+			return err
+		}
+		printDeletedKey(*key)
+	case "recover":
+		if err := client.RecoverDeletedKey(ctx, *name); err != nil {
+			return err
+		}
+		fmt.Printf("recovered %s\n", *name)
+	case "purge":
+		if !*yes {
+			return fmt.Errorf("purging %s is permanent and makes its ciphertext undecryptable; re-run with -yes", *name)
+		}
+		if err := client.PurgeDeletedKey(ctx, *name); err != nil {
+			return err
+		}
+		fmt.Printf("purged %s\n", *name)
+	default:
+		return errors.New(deletedUsage)
+	}
+
+	return nil
+}
+
+func printDeletedKey(k DeletedKey) {
+	fmt.Printf("%-32s deleted %-20s purge %-20s %s\n", k.Name, formatTime(k.DeletedDate), formatTime(k.ScheduledPurgeDate), k.RecoveryLevel)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "overall timeout for the diagnostics")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report := &PreflightReport{}
+	defer printPreflightReport(report)
+
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		report.add("config", CheckFail, "%v", err)
+		return report.Err()
+	}
+	kvInfo, err := parseKeyVaultKeyInfo(azureConfiguration.KeyVaultKeyIdentifier)
+	if err != nil {
+		report.add("config", CheckFail, "%v", err)
+		return report.Err()
+	}
+	report.KeyID = kvInfo.keyID()
+	report.add("config", CheckOK, "tenant %s, client %s", azureConfiguration.TenantID, azureConfiguration.ClientID)
+
+	vaultURL, _ := url.Parse(kvInfo.vaultURL)
+	loginURL, _ := url.Parse(environment().ActiveDirectoryEndpoint)
+	for _, host := range []string{vaultURL.Hostname(), loginURL.Hostname()} {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			report.add("dns", CheckFail, "%s: %v", host, err)
+		} else {
+			report.add("dns", CheckOK, "%s: %v", host, addrs)
+		}
+	}
+
+	token, err := getServicePrincipalToken(azureConfiguration.TenantID, azureConfiguration.ClientID, azureConfiguration.ClientSecret)
+	if err == nil {
+		err = token.RefreshWithContext(ctx)
+	}
+	if err != nil {
+		report.add("auth", CheckFail, "%v", wrapKeyOperationError("authenticate", err))
+		return report.Err()
+	}
+	report.add("auth", CheckOK, "token acquired, expires %s", token.Token().Expires().UTC().Format(time.RFC3339))
+
+	client, err := NewEncryptionClientFromEnv(azureConfiguration)
+	if err != nil {
+		report.add("client", CheckFail, "%v", err)
+		return report.Err()
+	}
+	preflight := client.Preflight(ctx)
+	report.KeyID = preflight.KeyID
+	report.Checks = append(report.Checks, preflight.Checks...)
+
+	return report.Err()
+}
+
+func printPreflightReport(report *PreflightReport) {
+	if report.KeyID != "" {
+		fmt.Printf("key: %s\n", report.KeyID)
+	}
+	for _, c := range report.Checks {
+		fmt.Printf("  [%-4s] %-9s %s\n", c.Status, c.Name, c.Detail)
+	}
+}
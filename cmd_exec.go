@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+const (
+	execUsage = "usage: kvcrypt exec [-env-file path] -- <command> [args...]"
+	// execValuePrefix marks environment variables holding a ciphertext of
+	// the configured key, as returned by POST /v1/encrypt.
+	execValuePrefix = "kvcrypt:"
+)
+
+// execCredentialVariables are kvcrypt's own credentials, which the command
+// is not given.
+var execCredentialVariables = []string{"AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID"}
+
+// exitStatus is returned by commands that exit with a status of their own
+// rather than failing.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// runExec runs a command with the kvcrypt: values of its environment
+// decrypted and kvcrypt's credentials removed. Plaintext only lives in
+// memory and in the environment of the command, which is sent the signals
+// kvcrypt receives and whose exit status kvcrypt exits with.
+func runExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	envFile := fs.String("env-file", "", "dotenv file of further variables; the environment takes precedence")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New(execUsage)
+	}
+	ctx := context.Background()
+
+	var env []string
+	if *envFile != "" {
+		fileEnv, err := readEnvFile(ctx, *envFile)
+		if err != nil {
+			return err
+		}
+		env = fileEnv
+	}
+	env, err := decryptEnv(ctx, mergeEnv(env, os.Environ()))
+	if err != nil {
+		return err
+	}
+
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, fs.Args()[1:]...)
+	cmd.Env = withoutVariables(env, execCredentialVariables)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, append(forwardedSignals, terminalSignals...)...)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		for s := range signals {
+			// the terminal already sent it to the command
+			if containsSignal(terminalSignals, s) && inTerminalForeground() {
+				continue
+			}
+			cmd.Process.Signal(s)
+		}
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(childExitStatus(exitErr.ProcessState))
+	}
+	return err
+}
+
+// mergeEnv returns the variables of base overridden by those of overrides,
+// each defined once.
+func mergeEnv(base, overrides []string) []string {
+	index := map[string]int{}
+	var env []string
+	for _, kv := range append(base, overrides...) {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if i, ok := index[name]; ok {
+			env[i] = kv
+			continue
+		}
+		index[name] = len(env)
+		env = append(env, kv)
+	}
+	return env
+}
+
+// withoutVariables returns env without the variables called names.
+func withoutVariables(env, names []string) []string {
+	var kept []string
+	for _, kv := range env {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if !containsString(names, name) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+func containsSignal(signals []os.Signal, s os.Signal) bool {
+	for _, candidate := range signals {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptEnv replaces the kvcrypt: values of env with their plaintext. The
+// configured key is only needed when there is something to decrypt.
+func decryptEnv(ctx context.Context, env []string) ([]string, error) {
+	var client *EncryptionClient
+	decrypted := make([]string, len(env))
+	for i, kv := range env {
+		decrypted[i] = kv
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 || !strings.HasPrefix(kv[eq+1:], execValuePrefix) {
+			continue
+		}
+		name := kv[:eq]
+
+		if client == nil {
+			azureConfiguration, err := ParseEnvironment()
+			if err != nil {
+				return nil, err
+			}
+			if client, err = NewEncryptionClientFromEnv(azureConfiguration); err != nil {
+				return nil, err
+			}
+		}
+		ciphertext := strings.TrimPrefix(kv[eq+1:], execValuePrefix)
+		plaintext, err := client.Decrypt(ctx, &ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if strings.IndexByte(string(plaintext), 0) >= 0 {
+			return nil, fmt.Errorf("%s: decrypted value holds a NUL byte", name)
+		}
+		decrypted[i] = name + "=" + string(plaintext)
+	}
+	return decrypted, nil
+}
+
+// readEnvFile reads the variables of a dotenv file. Files encrypted with
+// kvcrypt file are decrypted in memory.
+func readEnvFile(ctx context.Context, path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, m, err := (dotenvFormat{}).splitMetadata(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	} else if m != nil {
+		// the file names its key, so only an allowed one is used
+		if data, err = DecryptFile(ctx, credentialsUnwrapper{}, "dotenv", data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var env []string
+	_, err = (dotenvFormat{}).transform(data, func(name, raw string) (string, error) {
+		env = append(env, name+"="+unquoteEnvValue(raw))
+		return raw, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return env, nil
+}
+
+// unquoteEnvValue returns the value a dotenv line assigns: double quoted
+// values may hold escapes, single quoted ones are taken literally and
+// unquoted ones end at a comment.
+func unquoteEnvValue(raw string) string {
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return ""
+	}
+	switch value[0] {
+	case '"':
+		if end := closingQuote(value); end > 0 {
+			if unquoted, err := strconv.Unquote(value[:end]); err == nil {
+				return unquoted
+			}
+			return value[1 : end-1]
+		}
+	case '\'':
+		if end := closingQuote(value); end > 0 {
+			return value[1 : end-1]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
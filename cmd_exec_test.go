@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadEnvFileRefusesForeignKeys(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	encrypted, err := EncryptFile(ctx, vault, "dotenv", []byte("DB_PASSWORD=hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := ioutil.WriteFile(path, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	setAllowedKeys(t, "https://myvault.vault.azure.net/keys/mykey", "")
+
+	if _, err := readEnvFile(ctx, path); !errors.Is(err, ErrInvalidKeyIdentifier) {
+		t.Errorf("got %v, want ErrInvalidKeyIdentifier", err)
+	}
+}
+
+func TestWithoutVariables(t *testing.T) {
+	env := []string{"PATH=/bin", "AZURE_CLIENT_SECRET=s", "AZURE_CLIENT_ID=c", "HOME=/root", "AZURE_TENANT_ID=t"}
+	got := withoutVariables(env, execCredentialVariables)
+	want := []string{"PATH=/bin", "HOME=/root"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
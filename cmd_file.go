@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const fileUsage = "usage: kvcrypt file <encrypt|decrypt|edit> [-format yaml|json|dotenv] [-i] [-out path] <path>"
+
+func runFile(args []string) error {
+	if len(args) == 0 {
+		return errors.New(fileUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("file "+action, flag.ExitOnError)
+	format := fs.String("format", "", "file format, guessed from the file name when empty")
+	inPlace := fs.Bool("i", false, "overwrite the file instead of writing to standard output")
+	out := fs.String("out", "", "file to write instead of standard output")
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		return errors.New(fileUsage)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		if *format = FileFormatForPath(path); *format == "" {
+			return fmt.Errorf("cannot tell the format of %s: set -format", path)
+		}
+	}
+	if *inPlace || action == "edit" {
+		*out = path
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var result []byte
+	switch action {
+	case "encrypt":
+		azureConfiguration, err := ParseEnvironment()
+		if err != nil {
+			return err
+		}
+		client, err := NewEncryptionClientFromEnv(azureConfiguration)
+		if err != nil {
+			return err
+		}
+		if result, err = EncryptFile(ctx, client, *format, data); err != nil {
+			return err
+		}
+	case "decrypt":
+		client, err := fileClient(*format, data)
+		if err != nil {
+			return err
+		}
+		if result, err = DecryptFile(ctx, client, *format, data); err != nil {
+			return err
+		}
+	case "edit":
+		client, err := fileClient(*format, data)
+		if err != nil {
+			return err
+		}
+		if result, err = editFile(ctx, client, *format, path, data); err != nil || result == nil {
+			return err
+		}
+	default:
+		return errors.New(fileUsage)
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(result)
+		return err
+	}
+	return writeFileAtomic(*out, result)
+}
+
+// fileClient returns a client for the key the file's data key is wrapped
+// with, so decrypting needs only the service principal.
+func fileClient(format string, data []byte) (*EncryptionClient, error) {
+	keyID, err := FileKeyID(format, data)
+	if err != nil {
+		return nil, err
+	}
+	return clientForKey(keyID)
+}
+
+// clientForKey returns a client for the key identifier keyID, taken from
+// encrypted data rather than the environment. Since the data may come from
+// anyone, keyID must name a version of an allowed key: otherwise the
+// service principal's token would be sent to whatever vault it names.
+func clientForKey(keyID string) (*EncryptionClient, error) {
+	info, err := allowedKeyInfo(keyID, ParseAllowedKeys())
+	if err != nil {
+		return nil, err
+	}
+	azureConfiguration, err := ParseCredentialsEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptionClient(azureConfiguration.TenantID, azureConfiguration.ClientID, azureConfiguration.ClientSecret, info.keyID())
+}
+
+// allowedKeyInfo parses keyID, which must name the vault and key of one of
+// allowed.
+func allowedKeyInfo(keyID string, allowed []string) (*KeyVaultKeyInfo, error) {
+	info, err := parseKeyVaultKeyInfo(keyID)
+	if err != nil {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidKeyIdentifier, Err: err}
+	}
+	if len(allowed) == 0 {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidKeyIdentifier, Err: fmt.Errorf("data names key %s, but no key is allowed: set AZURE_KEY_VAULT_KEY_IDENTIFIER or KVCRYPT_ALLOWED_KEYS", info.keyID())}
+	}
+	for _, a := range allowed {
+		allowedInfo, err := parseKeyVaultKeyInfo(a)
+		if err != nil {
+			return nil, fmt.Errorf("allowed key %s: %v", a, err)
+		}
+		if strings.EqualFold(info.vaultURL, allowedInfo.vaultURL) && info.keyName == allowedInfo.keyName {
+			return info, nil
+		}
+	}
+	return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidKeyIdentifier, Err: fmt.Errorf("data names key %s, which is not allowed: add it to KVCRYPT_ALLOWED_KEYS to trust it", info.keyID())}
+}
+
+// credentialsUnwrapper unwraps data keys with the key they name, for
+// commands that decrypt data whose key is only known once it is read. Only
+// allowed keys are used, as with clientForKey.
+type credentialsUnwrapper struct{}
+
+func (credentialsUnwrapper) KeyID() string {
+	return ""
+}
+
+func (credentialsUnwrapper) WrapDataKey(ctx context.Context, key []byte) (string, string, error) {
+	return "", "", errors.New("no key configured to wrap data keys with")
+}
+
+func (credentialsUnwrapper) UnwrapDataKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	client, err := clientForKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return client.UnwrapDataKey(ctx, client.KeyID(), wrapped)
+}
+
+// editFile decrypts the file into a private temporary file, opens $EDITOR on
+// it and re-encrypts the result. It returns nil when nothing was changed.
+func editFile(ctx context.Context, w KeyWrapper, format, path string, encrypted []byte) ([]byte, error) {
+	plaintext, err := DecryptFile(ctx, w, format, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "kvcrypt-edit-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, plaintext, 0600); err != nil {
+		return nil, err
+	}
+
+	editor := strings.Fields(getEnvOrDefault("EDITOR", "vi"))
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], tmp)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s: %v", editor[0], err)
+		}
+
+		edited, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(edited, plaintext) {
+			fmt.Fprintln(os.Stderr, "file unchanged")
+			return nil, nil
+		}
+
+		result, err := ReencryptFile(ctx, w, format, encrypted, edited)
+		if err == nil {
+			return result, nil
+		}
+		fmt.Fprintf(os.Stderr, "cannot encrypt %s: %v\npress enter to edit again, or interrupt to discard the changes\n", path, err)
+		if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
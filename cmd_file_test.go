@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAllowedKeyInfo(t *testing.T) {
+	allowed := []string{"https://myvault.vault.azure.net/keys/mykey/0123456789abcdef"}
+
+	for _, keyID := range []string{
+		"https://myvault.vault.azure.net/keys/mykey",
+		"https://MyVault.vault.azure.net/keys/mykey/fedcba9876543210",
+	} {
+		if _, err := allowedKeyInfo(keyID, allowed); err != nil {
+			t.Errorf("%s: %v", keyID, err)
+		}
+	}
+
+	for _, keyID := range []string{
+		"https://othervault.vault.azure.net/keys/mykey",
+		"https://myvault.vault.azure.net/keys/otherkey",
+		"https://attacker.example/myvault.vault.azure.net/keys/mykey",
+	} {
+		if _, err := allowedKeyInfo(keyID, allowed); !errors.Is(err, ErrInvalidKeyIdentifier) {
+			t.Errorf("%s: got %v, want ErrInvalidKeyIdentifier", keyID, err)
+		}
+	}
+
+	if _, err := allowedKeyInfo("https://myvault.vault.azure.net/keys/mykey", nil); !errors.Is(err, ErrInvalidKeyIdentifier) {
+		t.Errorf("no allowed keys: got %v, want ErrInvalidKeyIdentifier", err)
+	}
+}
+
+// setAllowedKeys configures service principal credentials that are never
+// used and the allowed keys, so that tests can check that data naming other
+// keys is refused before anything is sent.
+func setAllowedKeys(t *testing.T, configured, allowed string) {
+	t.Setenv("AZURE_CLIENT_ID", "00000000-0000-0000-0000-000000000000")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+	t.Setenv("AZURE_TENANT_ID", "00000000-0000-0000-0000-000000000000")
+	t.Setenv("AZURE_KEY_VAULT_KEY_IDENTIFIER", configured)
+	t.Setenv("KVCRYPT_ALLOWED_KEYS", allowed)
+}
+
+func TestCredentialsUnwrapperRefusesForeignKeys(t *testing.T) {
+	setAllowedKeys(t, "https://myvault.vault.azure.net/keys/mykey", "https://second.vault.azure.net/keys/other")
+
+	for _, keyID := range []string{
+		"https://attacker.example/x.vault.azure.net/keys/mykey/v",
+		"https://evil.vault.azure.net/keys/mykey/v",
+	} {
+		_, err := credentialsUnwrapper{}.UnwrapDataKey(context.Background(), keyID, "d3JhcHBlZA")
+		if !errors.Is(err, ErrInvalidKeyIdentifier) {
+			t.Errorf("%s: got %v, want ErrInvalidKeyIdentifier", keyID, err)
+		}
+	}
+
+	for _, keyID := range []string{
+		"https://myvault.vault.azure.net/keys/mykey/v1",
+		"https://second.vault.azure.net/keys/other/v2",
+	} {
+		client, err := clientForKey(keyID)
+		if err != nil {
+			t.Errorf("%s: %v", keyID, err)
+			continue
+		}
+		if client.KeyID() != keyID {
+			t.Errorf("client for %s uses %s", keyID, client.KeyID())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gitFilterUsage = "usage: kvcrypt git-filter <clean | smudge | process | textconv <path>>"
+	gitInitUsage   = "usage: kvcrypt git-init [pattern...]"
+)
+
+// runGitFilter is what git runs, as configured by git-init: clean and smudge
+// filter standard input to standard output, process serves every file of a
+// git command, and textconv decrypts a file for git diff.
+func runGitFilter(args []string) error {
+	if len(args) == 0 {
+		return errors.New(gitFilterUsage)
+	}
+	f := newGitFilter()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "clean", "smudge":
+		if len(args) != 1 {
+			return errors.New(gitFilterUsage)
+		}
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		var result []byte
+		if args[0] == "clean" {
+			result, err = f.clean(ctx, data)
+		} else {
+			result, err = f.smudge(ctx, data)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(result)
+		return err
+	case "process":
+		if len(args) != 1 {
+			return errors.New(gitFilterUsage)
+		}
+		return serveGitFilterProcess(ctx, f, os.Stdin, os.Stdout)
+	case "textconv":
+		if len(args) != 2 {
+			return errors.New(gitFilterUsage)
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		plaintext, err := f.smudge(ctx, data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	}
+	return errors.New(gitFilterUsage)
+}
+
+// runGitInit sets up the current repository: it creates the repository key
+// unless one is committed already, points the kvcrypt filter and diff driver
+// at this executable, and marks files matching each pattern for encryption.
+func runGitInit(args []string) error {
+	for _, pattern := range args {
+		if strings.HasPrefix(pattern, "-") {
+			return errors.New(gitInitUsage)
+		}
+		if pattern == "" || strings.ContainsAny(pattern, " \t\n") {
+			return fmt.Errorf("pattern %q: patterns cannot be empty or hold whitespace", pattern)
+		}
+	}
+	top, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+
+	if _, err := readGitRepoKey(); err == nil {
+		fmt.Fprintf(os.Stderr, "using the repository key in %s\n", gitKeyPath)
+	} else if err := createGitRepoKey(top); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	quoted := "'" + strings.Replace(filepath.ToSlash(executable), "'", `'\''`, -1) + "'"
+	config := [][2]string{
+		{"filter." + gitFilterName + ".clean", quoted + " git-filter clean"},
+		{"filter." + gitFilterName + ".smudge", quoted + " git-filter smudge"},
+		{"filter." + gitFilterName + ".process", quoted + " git-filter process"},
+		{"filter." + gitFilterName + ".required", "true"},
+		{"diff." + gitFilterName + ".textconv", quoted + " git-filter textconv"},
+	}
+	for _, c := range config {
+		if _, err := gitOutput("config", "--local", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+
+	if err := updateGitAttributes(filepath.Join(top, ".gitattributes"), args); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "configured the %s filter; commit .gitattributes and %s\n", gitFilterName, gitKeyPath)
+	return nil
+}
+
+// createGitRepoKey generates a repository key and writes it wrapped with the
+// configured Key Vault key.
+func createGitRepoKey(top string) error {
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		return err
+	}
+	client, err := NewEncryptionClientFromEnv(azureConfiguration)
+	if err != nil {
+		return err
+	}
+
+	repoKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, repoKey); err != nil {
+		return err
+	}
+	wrapped, keyID, err := client.WrapDataKey(context.Background(), repoKey)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(gitRepoKey{Version: gitKeyVersion, KeyID: keyID, WrappedKey: wrapped}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(top, filepath.FromSlash(gitKeyPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "created %s wrapped with %s\n", gitKeyPath, keyID)
+	return nil
+}
+
+// updateGitAttributes adds a line for each new pattern to the attributes
+// file at path. The lines exempting .gitattributes and the repository key
+// are kept last, since later lines take precedence.
+func updateGitAttributes(path string, patterns []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exemptions := []string{
+		".gitattributes !filter !diff",
+		gitKeyPath + " !filter !diff",
+	}
+	attributes := " filter=" + gitFilterName + " diff=" + gitFilterName
+
+	var lines []string
+	present := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if containsString(exemptions, strings.TrimSpace(line)) {
+			continue
+		}
+		lines = append(lines, line)
+		present[strings.TrimSpace(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, pattern := range patterns {
+		if line := pattern + attributes; !present[line] {
+			lines = append(lines, line)
+			present[line] = true
+		}
+	}
+	lines = append(lines, exemptions...)
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
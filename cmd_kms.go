@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	kmsUsage         = "usage: kvcrypt kms-plugin <serve|check> [-listen unix:///path] [-fake-vault]"
+	kmsDefaultSocket = "unix:///var/run/kmsplugin/socket.sock"
+)
+
+func runKMSPlugin(args []string) error {
+	if len(args) == 0 {
+		return errors.New(kmsUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("kms-plugin "+action, flag.ExitOnError)
+	listen := fs.String("listen", kmsDefaultSocket, "unix socket the API server connects to")
+	fakeVault := fs.Bool("fake-vault", false, "wrap keys with an in-memory key instead of Key Vault, for local testing")
+	timeout := fs.Duration("timeout", 10*time.Second, "time allowed for check")
+	fs.Parse(args[1:])
+
+	if !strings.HasPrefix(*listen, "unix://") {
+		return fmt.Errorf("-listen must be a unix:// socket: %s", *listen)
+	}
+
+	switch action {
+	case "serve":
+		wrapper, err := keyWrapperFromEnv(*fakeVault)
+		if err != nil {
+			return err
+		}
+		plugin, err := NewKMSPlugin(wrapper)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return plugin.Serve(ctx, *listen)
+	case "check":
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		return checkKMSPlugin(ctx, strings.TrimPrefix(*listen, "unix://"))
+	}
+	return errors.New(kmsUsage)
+}
+
+// keyWrapperFromEnv wraps with the configured Key Vault key, or with a
+// FakeVault for local testing.
+func keyWrapperFromEnv(fake bool) (KeyWrapper, error) {
+	if fake {
+		return NewFakeVault()
+	}
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptionClientFromEnv(azureConfiguration)
+}
+
+// checkKMSPlugin round-trips a payload through both API versions of a
+// running plugin, the way the API server would.
+func checkKMSPlugin(ctx context.Context, socket string) error {
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", address)
+		}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := []byte("kvcrypt kms-plugin check")
+
+	version := &kmsV1VersionResponse{}
+	if err := conn.Invoke(ctx, "/"+kmsV1Service+"/Version", &kmsV1VersionRequest{Version: kmsAPIVersionV1}, version); err != nil {
+		return fmt.Errorf("v1 version: %v", err)
+	}
+	encrypted := &kmsV1EncryptResponse{}
+	if err := conn.Invoke(ctx, "/"+kmsV1Service+"/Encrypt", &kmsV1EncryptRequest{Version: kmsAPIVersionV1, Plain: payload}, encrypted); err != nil {
+		return fmt.Errorf("v1 encrypt: %v", err)
+	}
+	decrypted := &kmsV1DecryptResponse{}
+	if err := conn.Invoke(ctx, "/"+kmsV1Service+"/Decrypt", &kmsV1DecryptRequest{Version: kmsAPIVersionV1, Cipher: encrypted.Cipher}, decrypted); err != nil {
+		return fmt.Errorf("v1 decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted.Plain, payload) {
+		return errors.New("v1 decrypt returned a different payload")
+	}
+	fmt.Printf("v1beta1  ok  runtime %s %s\n", version.RuntimeName, version.RuntimeVersion)
+
+	status := &kmsV2StatusResponse{}
+	if err := conn.Invoke(ctx, "/"+kmsV2Service+"/Status", &kmsV2StatusRequest{}, status); err != nil {
+		return fmt.Errorf("v2 status: %v", err)
+	}
+	if status.Healthz != "ok" {
+		return fmt.Errorf("v2 status: unhealthy: %s", status.Healthz)
+	}
+	encryptedV2 := &kmsV2EncryptResponse{}
+	if err := conn.Invoke(ctx, "/"+kmsV2Service+"/Encrypt", &kmsV2EncryptRequest{Plaintext: payload, UID: "check"}, encryptedV2); err != nil {
+		return fmt.Errorf("v2 encrypt: %v", err)
+	}
+	decryptedV2 := &kmsV2DecryptResponse{}
+	request := &kmsV2DecryptRequest{Ciphertext: encryptedV2.Ciphertext, UID: "check", KeyID: encryptedV2.KeyID, Annotations: encryptedV2.Annotations}
+	if err := conn.Invoke(ctx, "/"+kmsV2Service+"/Decrypt", request, decryptedV2); err != nil {
+		return fmt.Errorf("v2 decrypt: %v", err)
+	}
+	if !bytes.Equal(decryptedV2.Plaintext, payload) {
+		return errors.New("v2 decrypt returned a different payload")
+	}
+	fmt.Printf("v2       ok  key %s\n", status.KeyID)
+	return nil
+}
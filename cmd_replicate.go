@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func runReplicate(args []string) error {
+	fs := flag.NewFlagSet("replicate", flag.ExitOnError)
+	target := fs.String("target", "", "target vault name or URL (required)")
+	dryRun := fs.Bool("dry-run", false, "print the changes without applying them")
+	allowRecreate := fs.Bool("allow-recreate", false, "delete, purge and restore the target key when it is missing versions")
+	interval := fs.Duration("interval", 0, "repeat replication on this interval until interrupted")
+	fs.Parse(args)
+
+	if *target == "" {
+		fs.Usage()
+		return fmt.Errorf("-target is required")
+	}
+	targetVaultURL, err := parseKeyVaultURL(*target)
+	if err != nil {
+		return err
+	}
+
+	azureConfiguration, err := ParseEnvironment()
+	if err != nil {
+		return err
+	}
+	client, err := NewEncryptionClientFromEnv(azureConfiguration)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for {
+		err := replicateOnce(ctx, client, targetVaultURL, *dryRun, *allowRecreate)
+		if *interval == 0 {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s replicate: %v\n", time.Now().UTC().Format(time.RFC3339), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func replicateOnce(ctx context.Context, client *EncryptionClient, targetVaultURL string, dryRun, allowRecreate bool) error {
+	plan, err := client.PlanReplication(ctx, targetVaultURL, allowRecreate)
+	if err != nil {
+		return err
+	}
+
+	printReplicationPlan(plan, dryRun)
+	if !dryRun {
+		if err := client.ApplyReplication(ctx, plan); err != nil {
+			return err
+		}
+	}
+
+	if conflicts := plan.Conflicts(); len(conflicts) > 0 {
+		return fmt.Errorf("%d conflict(s) need manual resolution", len(conflicts))
+	}
+	return nil
+}
+
+func printReplicationPlan(plan *ReplicationPlan, dryRun bool) {
+	prefix := ""
+	if dryRun {
+		prefix = "(dry-run) "
+	}
+
+	fmt.Printf("%s%s: %s -> %s\n", prefix, plan.KeyName, plan.SourceVault, plan.TargetVault)
+	if plan.InSync() {
+		fmt.Printf("%s  in sync\n", prefix)
+		return
+	}
+	for _, a := range plan.Actions {
+		version := a.Version
+		if version == "" {
+			version = "*"
+		}
+		fmt.Printf("%s  %-9s %-32s %s\n", prefix, a.Kind, version, a.Detail)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	preflightRetryMinDelay = 5 * time.Second
+	preflightRetryMaxDelay = 5 * time.Minute
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "TCP address, or unix:///path for a unix socket")
+	profilesPath := fs.String("profiles", "", "JSON file mapping profile names to key identifiers")
+	maxRequestBytes := fs.Int64("max-request-bytes", defaultMaxRequestBytes, "largest accepted request body")
+	preflight := fs.Bool("preflight", true, "check every profile's key before reporting ready")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate to serve TLS with")
+	tlsKey := fs.String("tls-key", "", "PEM private key for -tls-cert")
+	clientCA := fs.String("client-ca", "", "PEM CA bundle client certificates must chain to (requires -tls-cert)")
+	policyPath := fs.String("policy", "", "JSON file of callers allowed to use each profile and operation")
+	auditLog := fs.String("audit-log", "", "file authorization decisions are appended to (default stderr)")
+	fs.Parse(args)
+
+	azureConfiguration, err := ParseCredentialsEnvironment()
+	if err != nil {
+		return err
+	}
+
+	profiles := map[string]string{}
+	if *profilesPath != "" {
+		if profiles, err = LoadKeyProfiles(*profilesPath); err != nil {
+			return err
+		}
+	}
+	if _, ok := profiles[defaultProfile]; !ok && azureConfiguration.KeyVaultKeyIdentifier != "" {
+		profiles[defaultProfile] = azureConfiguration.KeyVaultKeyIdentifier
+	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("no key profiles: set AZURE_KEY_VAULT_KEY_IDENTIFIER or -profiles")
+	}
+
+	clients, err := newProfileClients(azureConfiguration, profiles)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := NewEncryptionServer(clients, *maxRequestBytes)
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		config, err := serverTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			return err
+		}
+		server.SetTLSConfig(config)
+	}
+	if *policyPath != "" {
+		policy, err := LoadCallerPolicy(*policyPath)
+		if err != nil {
+			return err
+		}
+		audit, closeAudit, err := openAuditLog(*auditLog)
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
+		if *clientCA == "" && !strings.HasPrefix(*listen, "unix://") {
+			slog.Warn("policy set without -client-ca or a unix socket: callers cannot be identified and every request will be denied")
+		}
+		server.SetPolicy(policy, audit)
+	} else {
+		slog.Warn("no -policy: every caller that can reach the server may use every profile")
+	}
+	go func() {
+		if *preflight && !retryPreflight(ctx, clients) {
+			return
+		}
+		server.SetReady(true)
+	}()
+
+	extra := map[string]http.Handler{}
+	if err := RegisterMetricViews(); err != nil {
+		return err
+	}
+	extra["/metrics"] = MetricsHandler()
+
+	return server.ListenAndServe(ctx, *listen, extra)
+}
+
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key are both required for TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// openAuditLog returns a JSON logger appending to path, or to stderr when
+// path is empty.
+func openAuditLog(path string) (*slog.Logger, func(), error) {
+	if path == "" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil)).With(slog.String("log", "audit")), func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return slog.New(slog.NewJSONHandler(f, nil)), func() { f.Close() }, nil
+}
+
+func newProfileClients(azureConfiguration AzureConfiguration, profiles map[string]string) (map[string]*EncryptionClient, error) {
+	clients := make(map[string]*EncryptionClient, len(profiles))
+	for name, keyID := range profiles {
+		client, err := NewEncryptionClient(azureConfiguration.TenantID, azureConfiguration.ClientID, azureConfiguration.ClientSecret, keyID)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+func preflightProfiles(ctx context.Context, clients map[string]*EncryptionClient) bool {
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ok := true
+	for _, name := range names {
+		report := clients[name].Preflight(ctx)
+		if err := report.Err(); err != nil {
+			slog.Error("profile not usable", slog.String("profile", name), slog.String("error", err.Error()))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// retryPreflight runs preflightProfiles until every profile passes, backing
+// off between attempts, so that the server turns ready once a key or role
+// assignment is fixed. It returns false when ctx is done first.
+func retryPreflight(ctx context.Context, clients map[string]*EncryptionClient) bool {
+	delay := preflightRetryMinDelay
+	for !preflightProfiles(ctx, clients) {
+		slog.Warn("preflight failed, retrying", slog.Duration("after", delay))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > preflightRetryMaxDelay {
+			delay = preflightRetryMaxDelay
+		}
+	}
+	return true
+}
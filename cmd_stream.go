@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const streamUsage = "usage: kvcrypt stream <encrypt|decrypt> [-in path] [-out path] [-workers n] [-offset n -length n]"
+
+func runStream(args []string) error {
+	if len(args) == 0 {
+		return errors.New(streamUsage)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("stream "+action, flag.ExitOnError)
+	inPath := fs.String("in", "", "file to read instead of standard input")
+	out := fs.String("out", "", "file to write instead of standard output")
+	workers := fs.Int("workers", 1, "with encrypt, how many goroutines seal chunks; one per CPU when 0")
+	offset := fs.Int64("offset", 0, "with decrypt -in, where in the plaintext to start")
+	length := fs.Int64("length", -1, "with decrypt -in, how many bytes of plaintext to write; all when negative")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return errors.New(streamUsage)
+	}
+	ranged := *offset != 0 || *length >= 0
+	if ranged && (action != "decrypt" || *inPath == "") {
+		return errors.New("-offset and -length need decrypt with -in")
+	}
+
+	in := io.Reader(os.Stdin)
+	var file *os.File
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in, file = f, f
+	}
+	ctx := context.Background()
+
+	switch action {
+	case "encrypt":
+		azureConfiguration, err := ParseEnvironment()
+		if err != nil {
+			return err
+		}
+		client, err := NewEncryptionClientFromEnv(azureConfiguration)
+		if err != nil {
+			return err
+		}
+		return writeStream(*out, func(w io.Writer) error {
+			output := bufio.NewWriter(w)
+			var encrypter io.WriteCloser
+			var err error
+			if *workers == 1 {
+				encrypter, err = NewEncryptWriter(ctx, client, output)
+			} else {
+				encrypter, err = NewParallelEncryptWriter(ctx, client, output, *workers)
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(encrypter, in); err != nil {
+				return err
+			}
+			if err := encrypter.Close(); err != nil {
+				return err
+			}
+			return output.Flush()
+		})
+	case "decrypt":
+		if ranged {
+			return writeStream(*out, func(w io.Writer) error {
+				return decryptRange(ctx, file, *offset, *length, w)
+			})
+		}
+		return writeStream(*out, func(w io.Writer) error {
+			decrypter, err := NewDecryptReader(ctx, credentialsUnwrapper{}, bufio.NewReader(in))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, decrypter)
+			return err
+		})
+	}
+	return errors.New(streamUsage)
+}
+
+// decryptRange writes length bytes of the plaintext of the encrypted file f,
+// from offset, reading only the chunks that hold them.
+func decryptRange(ctx context.Context, f *os.File, offset, length int64, w io.Writer) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	decrypter, err := NewDecryptReaderAt(ctx, credentialsUnwrapper{}, f, info.Size())
+	if err != nil {
+		return err
+	}
+	if length < 0 || offset+length > decrypter.Size() {
+		length = decrypter.Size() - offset
+	}
+	if offset < 0 || offset > decrypter.Size() || length < 0 {
+		return fmt.Errorf("offset %d is outside the %d bytes of plaintext", offset, decrypter.Size())
+	}
+	_, err = io.Copy(w, io.NewSectionReader(decrypter, offset, length))
+	return err
+}
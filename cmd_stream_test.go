@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestStream encrypts plaintext with vault into a temporary file.
+func writeTestStream(t *testing.T, vault *FakeVault, plaintext []byte) string {
+	t.Helper()
+	var encrypted bytes.Buffer
+	w, err := NewEncryptWriter(context.Background(), vault, &encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "data.kvs")
+	if err := ioutil.WriteFile(path, encrypted.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStreamDecryptRefusesForeignKeys(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestStream(t, vault, []byte("secret"))
+	setAllowedKeys(t, "https://myvault.vault.azure.net/keys/mykey", "")
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := runStream([]string{"decrypt", "-in", path, "-out", out}); !errors.Is(err, ErrInvalidKeyIdentifier) {
+		t.Errorf("got %v, want ErrInvalidKeyIdentifier", err)
+	}
+}
+
+func TestStreamRangeDecryptRefusesForeignKeys(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestStream(t, vault, []byte("secret"))
+	setAllowedKeys(t, "https://myvault.vault.azure.net/keys/mykey", "")
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := runStream([]string{"decrypt", "-in", path, "-out", out, "-offset", "1", "-length", "2"}); !errors.Is(err, ErrInvalidKeyIdentifier) {
+		t.Errorf("got %v, want ErrInvalidKeyIdentifier", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func runTerraformBackend(args []string) error {
+	fs := flag.NewFlagSet("tf-backend", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8081", "TCP address, or unix:///path for a unix socket")
+	dir := fs.String("dir", "tfstate", "directory encrypted state is stored in")
+	history := fs.Int("history", defaultStateHistory, "previous versions of each state to keep")
+	fakeVault := fs.Bool("fake-vault", false, "wrap keys with an in-memory key instead of Key Vault, for local testing")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate to serve TLS with")
+	tlsKey := fs.String("tls-key", "", "PEM private key for -tls-cert")
+	clientCA := fs.String("client-ca", "", "PEM CA bundle client certificates must chain to (requires -tls-cert)")
+	fs.Parse(args)
+
+	wrapper, err := keyWrapperFromEnv(*fakeVault)
+	if err != nil {
+		return err
+	}
+	store, err := NewFileStateStore(*dir)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		if tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *clientCA); err != nil {
+			return err
+		}
+	}
+
+	var handler http.Handler = NewTerraformBackend(store, wrapper, *history)
+	if configuration := ParseTerraformBackendEnvironment(); configuration.Password != "" {
+		handler = requireBasicAuth(handler, configuration.Username, configuration.Password)
+	} else if *clientCA == "" {
+		slog.Warn("no KVCRYPT_TF_BACKEND_PASSWORD or -client-ca: any caller that can reach the backend can read state")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serveHTTP(ctx, *listen, handler, tlsConfig)
+}
+
+func requireBasicAuth(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvcrypt"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
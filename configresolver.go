@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConfigValuePrefix marks a string in decoded configuration as a ciphertext
+// of the configured key, as returned by POST /v1/encrypt.
+const ConfigValuePrefix = "enc:"
+
+const configDecryptConcurrency = 8
+
+// Decrypter decrypts ciphertexts of a Key Vault key. EncryptionClient is a
+// Decrypter.
+type Decrypter interface {
+	Decrypt(ctx context.Context, data *string) ([]byte, error)
+}
+
+// ResolveConfig replaces every "enc:<ciphertext>" string reachable from
+// config, a pointer to a decoded configuration struct or a map such as one
+// decoded from YAML or JSON, with its plaintext. Strings are found through
+// pointers, interfaces, structs, slices, arrays and maps; unexported struct
+// fields are skipped. Every distinct ciphertext is decrypted once, and
+// config is only changed once they all were, so a failure leaves it as it
+// was.
+//
+// Struct fields can be tagged kvcrypt:"-" to be left alone, or
+// kvcrypt:"required" to fail when a string below them is not encrypted,
+// which catches secrets committed in plaintext. Errors name the path of the
+// value, never its content. Store secrets in Redacted fields to keep them
+// out of logs.
+func ResolveConfig(ctx context.Context, d Decrypter, config interface{}) error {
+	v := reflect.ValueOf(config)
+	if !v.IsValid() || (v.Kind() != reflect.Ptr && v.Kind() != reflect.Map) || v.IsNil() {
+		return fmt.Errorf("cannot resolve config in %T: need a non-nil pointer or map", config)
+	}
+
+	r := &configResolver{visited: map[uintptr]bool{}}
+	if err := r.walk(v, "", nil, false); err != nil {
+		return err
+	}
+	if len(r.placeholders) == 0 {
+		return nil
+	}
+
+	plaintexts, err := r.decrypt(ctx, d)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.placeholders {
+		p.assign(plaintexts[p.ciphertext])
+	}
+	for _, commit := range r.commits {
+		commit()
+	}
+	return nil
+}
+
+type configPlaceholder struct {
+	path       string
+	ciphertext string
+	assign     func(plaintext string)
+}
+
+type configResolver struct {
+	placeholders []configPlaceholder
+	// commits write copies of values that are not addressable, such as
+	// structs held in maps, back once their strings were replaced.
+	commits []func()
+	visited map[uintptr]bool
+}
+
+// walk collects the placeholders below v. set replaces v when v cannot be
+// set itself; it is nil otherwise.
+func (r *configResolver) walk(v reflect.Value, path string, set func(reflect.Value), required bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if !strings.HasPrefix(s, ConfigValuePrefix) {
+			if required && s != "" {
+				return fmt.Errorf("config %s: not encrypted, expected %s<ciphertext>", configPath(path), ConfigValuePrefix)
+			}
+			return nil
+		}
+		r.placeholders = append(r.placeholders, configPlaceholder{
+			path:       path,
+			ciphertext: strings.TrimPrefix(s, ConfigValuePrefix),
+			assign: func(plaintext string) {
+				if set == nil {
+					v.SetString(plaintext)
+					return
+				}
+				replacement := reflect.New(v.Type()).Elem()
+				replacement.SetString(plaintext)
+				set(replacement)
+			},
+		})
+		return nil
+
+	case reflect.Ptr:
+		if v.IsNil() || r.visited[v.Pointer()] {
+			return nil
+		}
+		r.visited[v.Pointer()] = true
+		return r.walk(v.Elem(), path, nil, required)
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		setInterface := set
+		if setInterface == nil {
+			setInterface = v.Set
+		}
+		return r.walkCopy(v.Elem(), path, setInterface, required)
+
+	case reflect.Struct:
+		if set != nil {
+			return r.walkCopy(v, path, set, required)
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			tag := field.Tag.Get("kvcrypt")
+			if tag == "-" {
+				continue
+			}
+			if err := r.walk(v.Field(i), joinConfigPath(path, field.Name), nil, required || tag == "required"); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Array:
+		if set != nil {
+			return r.walkCopy(v, path, set, required)
+		}
+		fallthrough
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.walk(v.Index(i), path+"["+strconv.Itoa(i)+"]", nil, required); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if v.IsNil() || r.visited[v.Pointer()] {
+			return nil
+		}
+		r.visited[v.Pointer()] = true
+		for _, key := range v.MapKeys() {
+			key := key
+			setValue := func(value reflect.Value) { v.SetMapIndex(key, value) }
+			if err := r.walk(v.MapIndex(key), path+"["+fmt.Sprint(key.Interface())+"]", setValue, required); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// walkCopy walks an addressable copy of v, which cannot be set in place,
+// and has the copy written back with set if it held placeholders.
+func (r *configResolver) walkCopy(v reflect.Value, path string, set func(reflect.Value), required bool) error {
+	switch v.Kind() {
+	case reflect.Struct, reflect.Array:
+	default:
+		// strings are replaced whole and the rest is reached by reference
+		return r.walk(v, path, set, required)
+	}
+	copied := reflect.New(v.Type()).Elem()
+	copied.Set(v)
+	found := len(r.placeholders)
+	if err := r.walk(copied, path, nil, required); err != nil {
+		return err
+	}
+	if len(r.placeholders) > found {
+		r.commits = append(r.commits, func() { set(copied) })
+	}
+	return nil
+}
+
+// decrypt decrypts every distinct ciphertext, a few at a time.
+func (r *configResolver) decrypt(ctx context.Context, d Decrypter) (map[string]string, error) {
+	var ciphertexts []string
+	seen := map[string]bool{}
+	for _, p := range r.placeholders {
+		if !seen[p.ciphertext] {
+			seen[p.ciphertext] = true
+			ciphertexts = append(ciphertexts, p.ciphertext)
+		}
+	}
+
+	results := make([][]byte, len(ciphertexts))
+	failures := make([]error, len(ciphertexts))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, configDecryptConcurrency)
+	for i := range ciphertexts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			ciphertext := ciphertexts[i]
+			results[i], failures[i] = d.Decrypt(ctx, &ciphertext)
+		}(i)
+	}
+	wg.Wait()
+
+	plaintexts := map[string]string{}
+	failed := map[string]error{}
+	for i, ciphertext := range ciphertexts {
+		if failures[i] != nil {
+			failed[ciphertext] = failures[i]
+			continue
+		}
+		plaintexts[ciphertext] = string(results[i])
+	}
+	// report the first failing value in walk order
+	for _, p := range r.placeholders {
+		if err := failed[p.ciphertext]; err != nil {
+			return nil, fmt.Errorf("config %s: %w", configPath(p.path), err)
+		}
+	}
+	slog.Debug("resolved config", slog.Int("values", len(r.placeholders)), slog.Int("decrypted", len(ciphertexts)))
+	return plaintexts, nil
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func configPath(path string) string {
+	if path == "" {
+		return "value"
+	}
+	return path
+}
+
+const redactedText = "[REDACTED]"
+
+// Redacted holds a secret that formatting, logging and marshalling show as
+// [REDACTED]. Decoders fill it like any string, and ResolveConfig decrypts
+// it; Reveal returns the secret.
+type Redacted string
+
+// Reveal returns the secret.
+func (r Redacted) Reveal() string {
+	return string(r)
+}
+
+func (r Redacted) String() string {
+	return redactedText
+}
+
+// Format applies to every verb, including %#v and %x.
+func (r Redacted) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redactedText))
+}
+
+func (r Redacted) LogValue() slog.Value {
+	return slog.StringValue(redactedText)
+}
+
+func (r Redacted) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(redactedText)), nil
+}
+
+func (r Redacted) MarshalText() ([]byte, error) {
+	return []byte(redactedText), nil
+}
+
+// MarshalYAML is used by the common YAML encoders.
+func (r Redacted) MarshalYAML() (interface{}, error) {
+	return redactedText, nil
+}
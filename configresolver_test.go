@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var errTestDecrypt = errors.New("decryption failed")
+
+// mapDecrypter decrypts the ciphertexts it holds, counting calls.
+type mapDecrypter struct {
+	mu          sync.Mutex
+	plaintexts  map[string]string
+	ciphertexts []string
+}
+
+func (d *mapDecrypter) Decrypt(ctx context.Context, data *string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ciphertexts = append(d.ciphertexts, *data)
+	plaintext, ok := d.plaintexts[*data]
+	if !ok {
+		return nil, errTestDecrypt
+	}
+	return []byte(plaintext), nil
+}
+
+type testDatabaseConfig struct {
+	Host     string
+	Password Redacted `kvcrypt:"required"`
+}
+
+type testConfig struct {
+	Database  testDatabaseConfig
+	Replica   *testDatabaseConfig
+	Tokens    []string
+	Pair      [2]string
+	Services  map[string]testDatabaseConfig
+	Extra     map[string]interface{}
+	Any       interface{}
+	Literal   string `kvcrypt:"-"`
+	unexposed string
+	Self      *testConfig
+}
+
+func TestResolveConfig(t *testing.T) {
+	d := &mapDecrypter{plaintexts: map[string]string{"c-password": "hunter2", "c-token": "t0ken", "c-api": "api-key"}}
+	config := &testConfig{
+		Database:  testDatabaseConfig{Host: "db", Password: "enc:c-password"},
+		Replica:   &testDatabaseConfig{Host: "replica", Password: "enc:c-password"},
+		Tokens:    []string{"enc:c-token", "plain"},
+		Pair:      [2]string{"enc:c-token", ""},
+		Services:  map[string]testDatabaseConfig{"billing": {Password: "enc:c-api"}},
+		Extra:     map[string]interface{}{"api": "enc:c-api", "nested": []interface{}{"enc:c-token", 3}},
+		Any:       testDatabaseConfig{Password: "enc:c-password"},
+		Literal:   "enc:left-alone",
+		unexposed: "enc:left-alone",
+	}
+	config.Self = config
+
+	if err := ResolveConfig(context.Background(), d, config); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.ciphertexts) != 3 {
+		t.Errorf("decrypted %v, want each of the 3 distinct ciphertexts once", d.ciphertexts)
+	}
+	checks := []struct {
+		path      string
+		got, want interface{}
+	}{
+		{"Database.Password", config.Database.Password.Reveal(), "hunter2"},
+		{"Database.Host", config.Database.Host, "db"},
+		{"Replica.Password", config.Replica.Password.Reveal(), "hunter2"},
+		{"Tokens", config.Tokens, []string{"t0ken", "plain"}},
+		{"Pair", config.Pair, [2]string{"t0ken", ""}},
+		{"Services[billing].Password", config.Services["billing"].Password.Reveal(), "api-key"},
+		{"Extra[api]", config.Extra["api"], "api-key"},
+		{"Extra[nested]", config.Extra["nested"], []interface{}{"t0ken", 3}},
+		{"Any.Password", config.Any.(testDatabaseConfig).Password.Reveal(), "hunter2"},
+		{"Literal", config.Literal, "enc:left-alone"},
+		{"unexposed", config.unexposed, "enc:left-alone"},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %#v, want %#v", c.path, c.got, c.want)
+		}
+	}
+}
+
+func TestResolveConfigFailureLeavesConfigUnchanged(t *testing.T) {
+	d := &mapDecrypter{plaintexts: map[string]string{"c-password": "hunter2"}}
+	config := map[string]interface{}{
+		"password": "enc:c-password",
+		"token":    "enc:c-unknown",
+	}
+	err := ResolveConfig(context.Background(), d, config)
+	if !errors.Is(err, errTestDecrypt) {
+		t.Fatalf("got %v, want the decryption error", err)
+	}
+	if !strings.Contains(err.Error(), "[token]") || strings.Contains(err.Error(), "c-unknown") {
+		t.Errorf("error %q should name the path and not the value", err)
+	}
+	if config["password"] != "enc:c-password" {
+		t.Errorf("config changed by a failed resolution: %v", config)
+	}
+}
+
+func TestResolveConfigRequired(t *testing.T) {
+	d := &mapDecrypter{}
+	config := &testConfig{Database: testDatabaseConfig{Password: "hunter2"}}
+	err := ResolveConfig(context.Background(), d, config)
+	if err == nil {
+		t.Fatal("plaintext accepted in a required field")
+	}
+	if !strings.Contains(err.Error(), "Database.Password") || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error %q should name the path and not the value", err)
+	}
+	if len(d.ciphertexts) != 0 {
+		t.Errorf("decrypted %v before checking required fields", d.ciphertexts)
+	}
+
+	// empty required values are allowed
+	if err := ResolveConfig(context.Background(), d, &testConfig{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveConfigRejectsValues(t *testing.T) {
+	var nilConfig *testConfig
+	for _, config := range []interface{}{nil, testConfig{}, nilConfig, "enc:x"} {
+		if err := ResolveConfig(context.Background(), &mapDecrypter{}, config); err == nil {
+			t.Errorf("ResolveConfig(%T) accepted", config)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	secret := Redacted("hunter2")
+	for _, format := range []string{"%s", "%v", "%+v", "%#v", "%q", "%x"} {
+		if got := fmt.Sprintf(format, secret); got != redactedText {
+			t.Errorf("Sprintf(%q) = %q", format, got)
+		}
+	}
+	encoded, err := json.Marshal(struct{ Password Redacted }{secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"Password":"[REDACTED]"}` {
+		t.Errorf("marshalled to %s", encoded)
+	}
+	if secret.Reveal() != "hunter2" {
+		t.Errorf("Reveal() = %q", secret.Reveal())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSV column encryption encrypts chosen columns of a CSV file cell by cell,
+// streaming rows so files of any size can be processed. One data key is
+// wrapped per file and recorded, with the encrypted columns, in a comment
+// line before the first row:
+//
+//	#kvcrypt {"version":"1","kid":"...","wrapped_key":"...","columns":["email"],"header":true}
+//
+// Cells are written like the values of structured files, with their column
+// as additional data, so rows may be filtered or sorted but values cannot be
+// moved to another column. Empty cells stay empty.
+
+const (
+	csvMetadataPrefix = "#" + fileMetadataKey + " "
+	csvFormatVersion  = "1"
+	csvMaxMetadata    = 64 << 10
+)
+
+// CSVOptions describe the layout of a CSV file.
+type CSVOptions struct {
+	// Columns to encrypt: names from the header row, or 1-based column
+	// numbers when NoHeader is set. Decryption reads them from the file.
+	Columns []string
+	// NoHeader is set when the first row holds data rather than names.
+	NoHeader bool
+	// Comma is the field delimiter, ',' when zero.
+	Comma rune
+}
+
+type csvMetadata struct {
+	Version    string   `json:"version"`
+	KeyID      string   `json:"kid"`
+	WrappedKey string   `json:"wrapped_key"`
+	Columns    []string `json:"columns"`
+	Header     bool     `json:"header"`
+}
+
+// EncryptCSV copies the CSV file r to out with the chosen columns encrypted,
+// under a new data key wrapped by w.
+func EncryptCSV(ctx context.Context, w KeyWrapper, r io.Reader, out io.Writer, opts CSVOptions) error {
+	if len(opts.Columns) == 0 {
+		return errors.New("no columns to encrypt")
+	}
+	seen := map[string]bool{}
+	for _, c := range opts.Columns {
+		if seen[c] {
+			return fmt.Errorf("column %q is listed more than once", c)
+		}
+		seen[c] = true
+	}
+	br := bufio.NewReaderSize(r, csvMaxMetadata)
+	if m, err := readCSVMetadata(br); err != nil {
+		return err
+	} else if m != nil {
+		return errors.New("file is already encrypted")
+	}
+
+	key, err := NewDataKey(ctx, w)
+	if err != nil {
+		return err
+	}
+	m := &csvMetadata{Version: csvFormatVersion, KeyID: key.KeyID, WrappedKey: key.Wrapped, Columns: opts.Columns, Header: !opts.NoHeader}
+	metadata, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, csvMetadataPrefix+string(metadata)+"\n"); err != nil {
+		return err
+	}
+
+	return transformCSV(br, out, m, opts.Comma, func(column, cell string) (string, error) {
+		if isFileValue(cell) {
+			return "", fmt.Errorf("column %s: value is already encrypted", column)
+		}
+		return encodeFileValue(key.Seal([]byte(cell), []byte(column))), nil
+	})
+}
+
+// DecryptCSV copies the CSV file r, encrypted by EncryptCSV, to out with its
+// encrypted columns decrypted.
+func DecryptCSV(ctx context.Context, w KeyWrapper, r io.Reader, out io.Writer, opts CSVOptions) error {
+	br := bufio.NewReaderSize(r, csvMaxMetadata)
+	m, err := readCSVMetadata(br)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("file has no %s metadata: not encrypted", fileMetadataKey)
+	}
+	if _, err := br.ReadString('\n'); err != nil {
+		return err
+	}
+	key, err := OpenDataKey(ctx, w, m.KeyID, m.WrappedKey)
+	if err != nil {
+		return err
+	}
+
+	return transformCSV(br, out, m, opts.Comma, func(column, cell string) (string, error) {
+		value, err := decodeFileValue(key, cell, column)
+		if err != nil {
+			return "", fmt.Errorf("column %s: %w", column, err)
+		}
+		return value, nil
+	})
+}
+
+// readCSVMetadata returns the metadata of an encrypted CSV file without
+// consuming it, or nil if the file is not encrypted.
+func readCSVMetadata(r *bufio.Reader) (*csvMetadata, error) {
+	prefix, err := r.Peek(len(csvMetadataPrefix))
+	if err == io.EOF || (err == nil && string(prefix) != csvMetadataPrefix) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	line, err := r.Peek(r.Size())
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("%s metadata line is too long", fileMetadataKey)
+	}
+
+	var m csvMetadata
+	if err := json.Unmarshal(line[len(csvMetadataPrefix):end], &m); err != nil {
+		return nil, fmt.Errorf("%s metadata: %v", fileMetadataKey, err)
+	}
+	if m.Version != csvFormatVersion {
+		return nil, fmt.Errorf("unsupported %s metadata version %q", fileMetadataKey, m.Version)
+	}
+	if m.KeyID == "" || m.WrappedKey == "" || len(m.Columns) == 0 {
+		return nil, fmt.Errorf("incomplete %s metadata", fileMetadataKey)
+	}
+	return &m, nil
+}
+
+// transformCSV copies the rows of r to out, replacing the non-empty cells of
+// the metadata's columns with what fn returns for them.
+func transformCSV(r io.Reader, out io.Writer, m *csvMetadata, comma rune, fn func(column, cell string) (string, error)) error {
+	reader := csv.NewReader(r)
+	writer := csv.NewWriter(out)
+	if comma != 0 {
+		reader.Comma, writer.Comma = comma, comma
+	}
+	reader.ReuseRecord = true
+
+	var columns []int
+	if !m.Header {
+		for _, c := range m.Columns {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 1 {
+				return fmt.Errorf("column %q: expected a column number since the file has no header", c)
+			}
+			columns = append(columns, n-1)
+		}
+	}
+
+	for row := 0; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if row == 0 && m.Header {
+			if columns, err = csvColumnIndexes(record, m.Columns); err != nil {
+				return err
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i, index := range columns {
+			if index >= len(record) {
+				line, _ := reader.FieldPos(0)
+				return fmt.Errorf("line %d: no column %s", line, m.Columns[i])
+			}
+			if record[index] == "" {
+				continue
+			}
+			if record[index], err = fn(m.Columns[i], record[index]); err != nil {
+				line, _ := reader.FieldPos(index)
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvColumnIndexes(header, columns []string) ([]int, error) {
+	indexes := make([]int, 0, len(columns))
+	for _, c := range columns {
+		index := -1
+		for i, name := range header {
+			if i == 0 {
+				name = strings.TrimPrefix(name, "\ufeff")
+			}
+			if name == c {
+				if index >= 0 {
+					return nil, fmt.Errorf("column %q appears more than once in the header", c)
+				}
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("unknown column %q: the header has %s", c, strings.Join(header, ", "))
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
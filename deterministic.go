@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Deterministic encryption gives equal ciphertexts for equal plaintexts,
+// so encrypted columns can be matched with WHERE email = ? and indexed.
+// Values are encrypted with AES-SIV under a 512-bit data key wrapped by the
+// Key Vault key, and bound to a context such as the table and column name.
+//
+// What it leaks: anyone who can read the ciphertexts learns which values
+// are equal within one key and context, and so how often each value occurs,
+// which is enough to guess common values such as countries or popular
+// passwords. The length of every value is revealed too. It reveals nothing
+// else, and ciphertexts still cannot be forged or moved to another context.
+// Prefer SealEnvelope or EncryptedString unless values must be looked up,
+// and only use it for values with many possible, evenly spread values.
+// A ciphertext is laid out as:
+//
+//	version | synthetic IV (16 bytes) | AES-CTR ciphertext
+
+const (
+	deterministicKeySize = 64
+	deterministicVersion = 1
+)
+
+// DeterministicKey is an AES-SIV data key along with its wrapped form.
+// Store the wrapped form with the data: every value looked up together must
+// be encrypted with the same key.
+type DeterministicKey struct {
+	KeyID   string
+	Wrapped string
+	siv     *sivCipher
+}
+
+// NewDeterministicKey generates a deterministic data key and wraps it with
+// w.
+func NewDeterministicKey(ctx context.Context, w KeyWrapper) (*DeterministicKey, error) {
+	key := make([]byte, deterministicKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := w.WrapDataKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return newDeterministicKey(key, keyID, wrapped)
+}
+
+// OpenDeterministicKey unwraps a key wrapped by NewDeterministicKey. Use
+// DataKeyCache.OpenDeterministicKey to unwrap it once.
+func OpenDeterministicKey(ctx context.Context, w KeyWrapper, keyID, wrapped string) (*DeterministicKey, error) {
+	key, err := w.UnwrapDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newDeterministicKey(key, keyID, wrapped)
+}
+
+func newDeterministicKey(key []byte, keyID, wrapped string) (*DeterministicKey, error) {
+	if len(key) != deterministicKeySize {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("deterministic key is %d bytes, expected %d", len(key), deterministicKeySize)}
+	}
+	siv, err := newSIVCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DeterministicKey{KeyID: keyID, Wrapped: wrapped, siv: siv}, nil
+}
+
+// Encrypt returns the same ciphertext whenever it is given the same
+// plaintext and context. The context, for example the table and column,
+// must be given again to decrypt.
+func (k *DeterministicKey) Encrypt(plaintext []byte, context ...string) ([]byte, error) {
+	sealed, err := k.siv.seal(plaintext, deterministicContext(context))
+	if err != nil {
+		return nil, &KeyOperationError{Op: "encrypt", Err: err}
+	}
+	return append([]byte{deterministicVersion}, sealed...), nil
+}
+
+// Decrypt decrypts a ciphertext made by Encrypt with the same context.
+func (k *DeterministicKey) Decrypt(ciphertext []byte, context ...string) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: errors.New("empty ciphertext")}
+	}
+	if ciphertext[0] != deterministicVersion {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("unsupported deterministic ciphertext version %d", ciphertext[0])}
+	}
+	plaintext, err := k.siv.open(ciphertext[1:], deterministicContext(context))
+	if err != nil {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+	}
+	return plaintext, nil
+}
+
+// deterministicContext makes each context string an associated data
+// component, so that ("ab", "c") and ("a", "bc") differ.
+func deterministicContext(context []string) [][]byte {
+	components := make([][]byte, len(context))
+	for i, c := range context {
+		components[i] = []byte(c)
+	}
+	return components
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"go.opencensus.io/trace"
+)
+
+const dataKeySize = 32
+
+// KeyWrapper wraps data keys with a key encryption key that never leaves it.
+// EncryptionClient wraps with its Key Vault key; FakeVault stands in for Key
+// Vault when running locally.
+type KeyWrapper interface {
+	// KeyID identifies the key encryption key new data keys are wrapped with.
+	KeyID() string
+	// WrapDataKey returns key wrapped, and the identifier of the key version
+	// that wrapped it.
+	WrapDataKey(ctx context.Context, key []byte) (wrapped string, keyID string, err error)
+	// UnwrapDataKey unwraps a key wrapped by the key version keyID.
+	UnwrapDataKey(ctx context.Context, keyID, wrapped string) ([]byte, error)
+}
+
+// DataKey is a random AES-256-GCM key along with its wrapped form, so that
+// payloads of any size can be encrypted locally while only the data key goes
+// to Key Vault.
+type DataKey struct {
+	KeyID   string
+	Wrapped string
+	aead    cipher.AEAD
+}
+
+// Envelope is a payload sealed with a data key, carrying everything but the
+// key encryption key needed to open it.
+type Envelope struct {
+	KeyID      string `json:"kid"`
+	WrappedKey string `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewDataKey generates a data key and wraps it with w.
+func NewDataKey(ctx context.Context, w KeyWrapper) (*DataKey, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := w.WrapDataKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(key, keyID, wrapped)
+}
+
+// OpenDataKey unwraps a data key wrapped by NewDataKey.
+func OpenDataKey(ctx context.Context, w KeyWrapper, keyID, wrapped string) (*DataKey, error) {
+	key, err := w.UnwrapDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(key, keyID, wrapped)
+}
+
+func newDataKey(key []byte, keyID, wrapped string) (*DataKey, error) {
+	if len(key) != dataKeySize {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("data key is %d bytes, expected %d", len(key), dataKeySize)}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{KeyID: keyID, Wrapped: wrapped, aead: aead}, nil
+}
+
+// Seal encrypts plaintext with a random nonce, which is prepended to the
+// returned ciphertext. additionalData is authenticated but not encrypted.
+func (k *DataKey) Seal(plaintext, additionalData []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(plaintext)+k.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+// Open decrypts ciphertext produced by Seal with the same additionalData.
+func (k *DataKey) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < k.aead.NonceSize()+k.aead.Overhead() {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: errors.New("ciphertext too short")}
+	}
+	nonce, sealed := ciphertext[:k.aead.NonceSize()], ciphertext[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+	}
+	return plaintext, nil
+}
+
+// Envelope seals plaintext into an Envelope.
+func (k *DataKey) Envelope(plaintext, additionalData []byte) *Envelope {
+	return &Envelope{KeyID: k.KeyID, WrappedKey: k.Wrapped, Ciphertext: k.Seal(plaintext, additionalData)}
+}
+
+// SealEnvelope encrypts plaintext under a new data key wrapped by w.
+func SealEnvelope(ctx context.Context, w KeyWrapper, plaintext, additionalData []byte) (*Envelope, error) {
+	key, err := NewDataKey(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	return key.Envelope(plaintext, additionalData), nil
+}
+
+// OpenEnvelope decrypts an Envelope produced by SealEnvelope.
+func OpenEnvelope(ctx context.Context, w KeyWrapper, envelope *Envelope, additionalData []byte) ([]byte, error) {
+	key, err := OpenDataKey(ctx, w, envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return key.Open(envelope.Ciphertext, additionalData)
+}
+
+// DataKeyCache keeps unwrapped data keys in memory for a while, so that
+// repeatedly opening payloads sealed under the same data key calls Key Vault
+// once.
+type DataKeyCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+	ttl time.Duration
+}
+
+type cachedDataKey struct {
+	key           *DataKey
+	deterministic *DeterministicKey
+	expires       time.Time
+}
+
+func NewDataKeyCache(size int, ttl time.Duration) (*DataKeyCache, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKeyCache{lru: lru, ttl: ttl}, nil
+}
+
+// OpenDataKey is OpenDataKey, served from the cache when possible.
+func (c *DataKeyCache) OpenDataKey(ctx context.Context, w KeyWrapper, keyID, wrapped string) (*DataKey, error) {
+	cacheKey := keyID + "\x00" + wrapped
+	if entry, ok := c.get(ctx, cacheKey); ok {
+		return entry.key, nil
+	}
+
+	key, err := OpenDataKey(ctx, w, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c.add(cacheKey, cachedDataKey{key: key})
+	return key, nil
+}
+
+// OpenDeterministicKey is OpenDeterministicKey, served from the cache when
+// possible.
+func (c *DataKeyCache) OpenDeterministicKey(ctx context.Context, w KeyWrapper, keyID, wrapped string) (*DeterministicKey, error) {
+	cacheKey := "siv\x00" + keyID + "\x00" + wrapped
+	if entry, ok := c.get(ctx, cacheKey); ok {
+		return entry.deterministic, nil
+	}
+
+	key, err := OpenDeterministicKey(ctx, w, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c.add(cacheKey, cachedDataKey{deterministic: key})
+	return key, nil
+}
+
+func (c *DataKeyCache) get(ctx context.Context, cacheKey string) (cachedDataKey, bool) {
+	c.mu.Lock()
+	entry, ok := c.lru.Get(cacheKey)
+	if ok && time.Now().After(entry.(cachedDataKey).expires) {
+		c.lru.Remove(cacheKey)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.BoolAttribute(attributeCacheHit, ok))
+	}
+	recordCacheLookup(ctx, "datakey", ok)
+	if !ok {
+		return cachedDataKey{}, false
+	}
+	return entry.(cachedDataKey), true
+}
+
+func (c *DataKeyCache) add(cacheKey string, entry cachedDataKey) {
+	entry.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	c.lru.Add(cacheKey, entry)
+	c.mu.Unlock()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Sentinel errors for key operation failures. Errors returned by EncryptionClient
+// can be matched against them with errors.Is; errors.As with *KeyOperationError
+// gives access to the HTTP status, Key Vault error code and request ID.
+var (
+	ErrAuthentication       = errors.New("keyvault: authentication failed")
+	ErrForbidden            = errors.New("keyvault: operation not permitted")
+	ErrKeyNotFound          = errors.New("keyvault: key not found")
+	ErrKeyDisabled          = errors.New("keyvault: key is disabled")
+	ErrKeyExpired           = errors.New("keyvault: key is expired or not yet valid")
+	ErrThrottled            = errors.New("keyvault: request throttled")
+	ErrInvalidCiphertext    = errors.New("keyvault: invalid ciphertext")
+	ErrUnsupportedAlgorithm = errors.New("keyvault: unsupported algorithm")
+	ErrInvalidKeyIdentifier = errors.New("keyvault: invalid key identifier")
+)
+
+type KeyOperationError struct {
+	// Op is the key operation that failed, e.g. "encrypt".
+	Op string
+	// Kind is one of the sentinel errors above, or nil when the failure is not classified.
+	Kind       error
+	StatusCode int
+	// Code is the Key Vault error code, e.g. "KeyNotFound".
+	Code       string
+	RequestID  string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *KeyOperationError) Error() string {
+	msg := e.Op
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request id %s)", e.RequestID)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *KeyOperationError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *KeyOperationError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the operation may succeed if retried later.
+func (e *KeyOperationError) Temporary() bool {
+	return e.Kind == ErrThrottled || e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsTemporary reports whether err is a key operation failure worth retrying.
+func IsTemporary(err error) bool {
+	var opErr *KeyOperationError
+	return errors.As(err, &opErr) && opErr.Temporary()
+}
+
+// wrapKeyOperationError classifies an error returned by the Key Vault client.
+func wrapKeyOperationError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var opErr *KeyOperationError
+	if errors.As(err, &opErr) {
+		return err
+	}
+
+	opErr = &KeyOperationError{Op: op, Err: err}
+
+	// autorest errors do not implement Unwrap, so the service error has to be
+	// taken from DetailedError.Original by hand
+	original := err
+	var detailed autorest.DetailedError
+	if errors.As(err, &detailed) {
+		original = detailed.Original
+		if status, ok := detailed.StatusCode.(int); ok {
+			opErr.StatusCode = status
+		}
+		if detailed.Response != nil {
+			opErr.RequestID = azure.ExtractRequestID(detailed.Response)
+			if opErr.StatusCode == http.StatusTooManyRequests {
+				opErr.RetryAfter = autorest.GetRetryAfter(detailed.Response, 0)
+			}
+		}
+		// a token request that never got a response is a network problem, not a rejected credential
+		if detailed.PackageType == "azure.BearerAuthorizer" && detailed.Response != nil {
+			opErr.Kind = ErrAuthentication
+			return opErr
+		}
+	}
+
+	var message string
+	var requestErr *azure.RequestError
+	if errors.As(original, &requestErr) && requestErr.ServiceError != nil {
+		opErr.Code = requestErr.ServiceError.Code
+		message = requestErr.ServiceError.Message
+		if code, ok := requestErr.ServiceError.InnerError["code"].(string); ok {
+			opErr.Code = code
+		}
+		if opErr.RequestID == "" {
+			opErr.RequestID = requestErr.RequestID
+		}
+	}
+
+	var refreshErr adal.TokenRefreshError
+	if errors.As(original, &refreshErr) && refreshErr.Response() != nil {
+		opErr.Kind = ErrAuthentication
+		return opErr
+	}
+
+	opErr.Kind = classifyKeyVaultError(op, opErr.StatusCode, opErr.Code, message)
+	return opErr
+}
+
+func classifyKeyVaultError(op string, status int, code, message string) error {
+	lower := strings.ToLower(code + " " + message)
+
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrAuthentication
+	case http.StatusForbidden:
+		switch {
+		case strings.Contains(lower, "disabled"):
+			return ErrKeyDisabled
+		case strings.Contains(lower, "expired") || strings.Contains(lower, "not yet valid") || strings.Contains(lower, "notbefore"):
+			return ErrKeyExpired
+		}
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrKeyNotFound
+	case http.StatusTooManyRequests:
+		return ErrThrottled
+	case http.StatusBadRequest:
+		switch {
+		case strings.Contains(lower, "algorithm"):
+			return ErrUnsupportedAlgorithm
+		case op == "decrypt" || op == "unwrap":
+			return ErrInvalidCiphertext
+		}
+	}
+
+	if code == "Throttled" {
+		return ErrThrottled
+	}
+	return nil
+}
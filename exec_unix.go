@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// terminalSignals are sent by the terminal to its whole foreground process
+// group, the command included.
+var terminalSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGWINCH,
+}
+
+// inTerminalForeground reports whether kvcrypt is in the foreground process
+// group of its controlling terminal, where the command gets terminalSignals
+// from the terminal itself.
+func inTerminalForeground() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	defer tty.Close()
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
+
+// childExitStatus follows the shell's convention of 128 plus the signal
+// number for commands killed by a signal.
+func childExitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+var forwardedSignals []os.Signal
+
+// terminalSignals are sent by the console to every process attached to it,
+// the command included.
+var terminalSignals = []os.Signal{os.Interrupt}
+
+func inTerminalForeground() bool {
+	return true
+}
+
+func childExitStatus(state *os.ProcessState) int {
+	return state.ExitCode()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The git filter encrypts files as they are committed and decrypts them as
+// they are checked out. Files are sealed with a repository key, a data key
+// wrapped by the Key Vault key and committed in .kvcrypt/git-key.json. The
+// encryption is deterministic, like git-crypt's: the nonce is an HMAC of the
+// plaintext, so unchanged files clean to the same blob and git sees no
+// spurious changes, while identical files are the only thing it reveals.
+// An encrypted file is laid out as:
+//
+//	magic "\x00KVCRYPT\x00" | version | nonce (12 bytes) | AES-256-GCM ciphertext
+
+const (
+	gitFileMagic   = "\x00KVCRYPT\x00"
+	gitFileVersion = 1
+	gitKeyVersion  = "1"
+	gitKeyPath     = ".kvcrypt/git-key.json"
+	gitFilterName  = "kvcrypt"
+)
+
+// gitRepoKey is the committed, wrapped repository key.
+type gitRepoKey struct {
+	Version    string `json:"version"`
+	KeyID      string `json:"kid"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+type gitCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// newGitCipher derives separate encryption and nonce keys from the
+// repository key.
+func newGitCipher(repoKey []byte) (*gitCipher, error) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, repoKey)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("kvcrypt git-filter encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gitCipher{aead: aead, nonceKey: derive("kvcrypt git-filter nonce")}, nil
+}
+
+func isGitEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(gitFileMagic))
+}
+
+// clean encrypts plaintext. Files that are already encrypted, as in a
+// checkout made without access to the key, are returned as they are.
+func (c *gitCipher) clean(plaintext []byte) []byte {
+	if isGitEncrypted(plaintext) {
+		return plaintext
+	}
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	header := append([]byte(gitFileMagic), gitFileVersion)
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+c.aead.Overhead())
+	out = append(append(out, header...), nonce...)
+	return c.aead.Seal(out, nonce, plaintext, header)
+}
+
+// smudge decrypts a file encrypted by clean. Files that are not encrypted,
+// such as those committed before the filter was set up, are returned as they
+// are.
+func (c *gitCipher) smudge(data []byte) ([]byte, error) {
+	if !isGitEncrypted(data) {
+		return data, nil
+	}
+	headerSize := len(gitFileMagic) + 1
+	if len(data) < headerSize+c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, invalidStream(errors.New("encrypted file too short"))
+	}
+	if version := data[len(gitFileMagic)]; version != gitFileVersion {
+		return nil, invalidStream(fmt.Errorf("unsupported encrypted file version %d", version))
+	}
+	nonce := data[headerSize : headerSize+c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, data[headerSize+c.aead.NonceSize():], data[:headerSize])
+	if err != nil {
+		return nil, invalidStream(err)
+	}
+	return plaintext, nil
+}
+
+// gitFilter loads the repository key once, when the first file needs it.
+type gitFilter struct {
+	unwrapper KeyWrapper
+	// allowed are the keys the committed repository key may be wrapped
+	// with: anyone able to push to the repository can change it.
+	allowed []string
+	cipher  *gitCipher
+	// locked is set when no credentials are configured: files are then left
+	// encrypted on checkout, and only encrypted files can be committed.
+	locked bool
+}
+
+func newGitFilter() *gitFilter {
+	if _, err := ParseCredentialsEnvironment(); err != nil {
+		return &gitFilter{locked: true}
+	}
+	return &gitFilter{unwrapper: credentialsUnwrapper{}, allowed: ParseAllowedKeys()}
+}
+
+func (f *gitFilter) load(ctx context.Context) (*gitCipher, error) {
+	if f.cipher != nil {
+		return f.cipher, nil
+	}
+	key, err := readGitRepoKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := allowedKeyInfo(key.KeyID, f.allowed); err != nil {
+		return nil, fmt.Errorf("%s: %w", gitKeyPath, err)
+	}
+	repoKey, err := f.unwrapper.UnwrapDataKey(ctx, key.KeyID, key.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if f.cipher, err = newGitCipher(repoKey); err != nil {
+		return nil, err
+	}
+	return f.cipher, nil
+}
+
+func (f *gitFilter) clean(ctx context.Context, data []byte) ([]byte, error) {
+	if isGitEncrypted(data) {
+		return data, nil
+	}
+	if f.locked {
+		return nil, errors.New("cannot encrypt: no Azure credentials are configured")
+	}
+	c, err := f.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.clean(data), nil
+}
+
+func (f *gitFilter) smudge(ctx context.Context, data []byte) ([]byte, error) {
+	if !isGitEncrypted(data) || f.locked {
+		return data, nil
+	}
+	c, err := f.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.smudge(data)
+}
+
+// readGitRepoKey reads the repository key from the work tree or, while a
+// clone has not checked it out yet, from HEAD.
+func readGitRepoKey() (*gitRepoKey, error) {
+	top, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(top, filepath.FromSlash(gitKeyPath)))
+	if os.IsNotExist(err) {
+		data, err = gitOutputBytes("cat-file", "blob", "HEAD:"+gitKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("no repository key in %s: run kvcrypt git-init", gitKeyPath)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var key gitRepoKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %v", gitKeyPath, err)
+	}
+	if key.Version != gitKeyVersion || key.KeyID == "" || key.WrappedKey == "" {
+		return nil, fmt.Errorf("%s: unsupported or incomplete repository key", gitKeyPath)
+	}
+	return &key, nil
+}
+
+func gitOutput(args ...string) (string, error) {
+	out, err := gitOutputBytes(args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func gitOutputBytes(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Git's long-running filter protocol lets one filter process serve every
+// file of a git command, so the repository key is unwrapped once rather than
+// once per file. Messages are pkt-lines: a four digit hex length, counting
+// itself, followed by the data; "0000" is a flush packet ending a list.
+
+const gitPktMaxData = 65516
+
+var errGitFlush = errors.New("flush packet")
+
+type gitPktReader struct {
+	r *bufio.Reader
+}
+
+// readPacket returns the data of the next packet, or errGitFlush.
+func (p *gitPktReader) readPacket() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(p.r, size[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad pkt-line length %q", size)
+	}
+	if n == 0 {
+		return nil, errGitFlush
+	}
+	if n < 4 {
+		return nil, fmt.Errorf("bad pkt-line length %d", n)
+	}
+	data := make([]byte, n-4)
+	_, err = io.ReadFull(p.r, data)
+	return data, err
+}
+
+// readList reads text packets up to a flush packet.
+func (p *gitPktReader) readList() ([]string, error) {
+	var list []string
+	for {
+		data, err := p.readPacket()
+		if err == errGitFlush {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// readContent reads binary packets up to a flush packet.
+func (p *gitPktReader) readContent() ([]byte, error) {
+	var content []byte
+	for {
+		data, err := p.readPacket()
+		if err == errGitFlush {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, data...)
+	}
+}
+
+type gitPktWriter struct {
+	w *bufio.Writer
+}
+
+func (p *gitPktWriter) writePacket(data []byte) error {
+	if _, err := fmt.Fprintf(p.w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *gitPktWriter) flush() error {
+	if _, err := p.w.WriteString("0000"); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+func (p *gitPktWriter) writeList(lines ...string) error {
+	for _, line := range lines {
+		if err := p.writePacket([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+func (p *gitPktWriter) writeContent(content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > gitPktMaxData {
+			n = gitPktMaxData
+		}
+		if err := p.writePacket(content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return p.flush()
+}
+
+// serveGitFilterProcess speaks the filter protocol, version 2, on r and w
+// until git closes r.
+func serveGitFilterProcess(ctx context.Context, f *gitFilter, r io.Reader, w io.Writer) error {
+	in := &gitPktReader{r: bufio.NewReader(r)}
+	out := &gitPktWriter{w: bufio.NewWriter(w)}
+
+	welcome, err := in.readList()
+	if err != nil {
+		return err
+	}
+	if len(welcome) == 0 || welcome[0] != "git-filter-client" || !containsString(welcome[1:], "version=2") {
+		return fmt.Errorf("unexpected filter protocol greeting %q", welcome)
+	}
+	if err := out.writeList("git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	capabilities, err := in.readList()
+	if err != nil {
+		return err
+	}
+	var supported []string
+	for _, c := range []string{"capability=clean", "capability=smudge"} {
+		if containsString(capabilities, c) {
+			supported = append(supported, c)
+		}
+	}
+	if err := out.writeList(supported...); err != nil {
+		return err
+	}
+
+	for {
+		request, err := in.readList()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := in.readContent()
+		if err != nil {
+			return err
+		}
+
+		var command, pathname string
+		for _, line := range request {
+			if strings.HasPrefix(line, "command=") {
+				command = strings.TrimPrefix(line, "command=")
+			} else if strings.HasPrefix(line, "pathname=") {
+				pathname = strings.TrimPrefix(line, "pathname=")
+			}
+		}
+
+		var result []byte
+		switch command {
+		case "clean":
+			result, err = f.clean(ctx, content)
+		case "smudge":
+			result, err = f.smudge(ctx, content)
+		default:
+			err = fmt.Errorf("unknown command %q", command)
+		}
+		if err != nil {
+			slog.Error("git filter failed", slog.String("command", command), slog.String("path", pathname), slog.Any("error", err))
+			if err := out.writeList("status=error"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := out.writeList("status=success"); err != nil {
+			return err
+		}
+		if err := out.writeContent(result); err != nil {
+			return err
+		}
+		// an empty list keeps the status
+		if err := out.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// gitTestRepo creates a repository committing key as its repository key and
+// makes it the working directory.
+func gitTestRepo(t *testing.T, key gitRepoKey) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".kvcrypt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(gitKeyPath)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+}
+
+func TestGitFilterRoundTrip(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoKey := make([]byte, 32)
+	if _, err := rand.Read(repoKey); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, keyID, err := vault.WrapDataKey(context.Background(), repoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitTestRepo(t, gitRepoKey{Version: gitKeyVersion, KeyID: keyID, WrappedKey: wrapped})
+
+	f := &gitFilter{unwrapper: vault, allowed: []string{vault.KeyID()}}
+	ctx := context.Background()
+	plaintext := []byte("password=hunter2\n")
+	encrypted, err := f.clean(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGitEncrypted(encrypted) {
+		t.Fatal("clean left the file unencrypted")
+	}
+	decrypted, err := f.smudge(ctx, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("smudge = %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestGitFilterRefusesForeignRepoKey(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyID := range []string{
+		"https://attacker.example/x.vault.azure.net/keys/fake/v",
+		"https://attacker.vault.azure.net/keys/fake/v",
+	} {
+		t.Run(keyID, func(t *testing.T) {
+			gitTestRepo(t, gitRepoKey{Version: gitKeyVersion, KeyID: keyID, WrappedKey: "d3JhcHBlZA"})
+			f := &gitFilter{unwrapper: vault, allowed: []string{vault.KeyID()}}
+			encrypted := append([]byte(gitFileMagic), make([]byte, 64)...)
+			if _, err := f.smudge(context.Background(), encrypted); !errors.Is(err, ErrInvalidKeyIdentifier) {
+				t.Errorf("got %v, want ErrInvalidKeyIdentifier", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JSON field encryption seals chosen values of a JSON document, such as the
+// PII of an event, and leaves the rest readable. Each chosen value becomes a
+// tagged ciphertext object:
+//
+//	{"kvcrypt":"1","kid":"...","wrapped_key":"...","ciphertext":"..."}
+//
+// All values of a document share one data key, and each is sealed with its
+// path as additional data, so it cannot be moved elsewhere in the document.
+
+const jsonFieldVersion = "1"
+
+// EncryptedJSONValue is the tagged ciphertext object that replaces an
+// encrypted value. The plaintext is the value's JSON text.
+type EncryptedJSONValue struct {
+	Version string `json:"kvcrypt"`
+	Envelope
+}
+
+// JSONSelector picks values of a JSON document, like a subset of JSONPath:
+// "$.customer.ssn", "$.cards[*].number", "$['odd key']", "$..email".
+type JSONSelector struct {
+	text  string
+	steps []jsonSelectorStep
+}
+
+type jsonSelectorStep struct {
+	key        string
+	index      int // when not negative, the step is an array index
+	wildcard   bool
+	descendant bool
+}
+
+var jsonIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$-]*`)
+
+// ParseJSONSelector parses a selector. Supported steps are .key, ['key'],
+// [index], .* and [*], and ..key or ..* to match at any depth.
+func ParseJSONSelector(selector string) (*JSONSelector, error) {
+	if !strings.HasPrefix(selector, "$") {
+		return nil, fmt.Errorf("selector %q: must start with $", selector)
+	}
+
+	s := &JSONSelector{text: selector}
+	rest := selector[1:]
+	for rest != "" {
+		step := jsonSelectorStep{index: -1}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.descendant = true
+			rest = rest[1:]
+			fallthrough
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "[") {
+				if !step.descendant {
+					return nil, fmt.Errorf("selector %q: unexpected [ after .", selector)
+				}
+				break
+			}
+			if strings.HasPrefix(rest, "*") {
+				step.wildcard = true
+				rest = rest[1:]
+				break
+			}
+			name := jsonIdentifierRegexp.FindString(rest)
+			if name == "" {
+				return nil, fmt.Errorf("selector %q: expected a key after .", selector)
+			}
+			step.key = name
+			rest = rest[len(name):]
+		case !strings.HasPrefix(rest, "["):
+			return nil, fmt.Errorf("selector %q: unexpected %q", selector, rest)
+		}
+
+		if step.key == "" && !step.wildcard {
+			end := strings.IndexByte(rest, ']')
+			if !strings.HasPrefix(rest, "[") || end < 0 {
+				return nil, fmt.Errorf("selector %q: unterminated [", selector)
+			}
+			inner := rest[1:end]
+			if quote := inner[:min(1, len(inner))]; quote == "'" || quote == `"` {
+				// the closing bracket may be inside the quoted key
+				end = strings.Index(rest[2:], quote+"]")
+				if end < 0 {
+					return nil, fmt.Errorf("selector %q: unterminated quoted key", selector)
+				}
+				end += 2 + len(quote)
+				step.key = rest[2 : end-1]
+			} else if inner == "*" {
+				step.wildcard = true
+			} else if i, err := strconv.Atoi(inner); err == nil && i >= 0 {
+				step.index = i
+			} else {
+				return nil, fmt.Errorf("selector %q: bad index [%s]", selector, inner)
+			}
+			rest = rest[end+1:]
+		}
+		s.steps = append(s.steps, step)
+	}
+	if len(s.steps) == 0 {
+		return nil, fmt.Errorf("selector %q: selects the whole document", selector)
+	}
+	return s, nil
+}
+
+// ParseJSONSelectors parses each selector.
+func ParseJSONSelectors(selectors ...string) ([]*JSONSelector, error) {
+	parsed := make([]*JSONSelector, 0, len(selectors))
+	for _, selector := range selectors {
+		s, err := ParseJSONSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, s)
+	}
+	return parsed, nil
+}
+
+func (s *JSONSelector) String() string {
+	return s.text
+}
+
+func (s *JSONSelector) matches(path []jsonSegment) bool {
+	return matchJSONSteps(s.steps, path)
+}
+
+func matchJSONSteps(steps []jsonSelectorStep, path []jsonSegment) bool {
+	if len(steps) == 0 {
+		return len(path) == 0
+	}
+	if !steps[0].descendant {
+		return len(path) > 0 && steps[0].matches(path[0]) && matchJSONSteps(steps[1:], path[1:])
+	}
+	for i := range path {
+		if steps[0].matches(path[i]) && matchJSONSteps(steps[1:], path[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (step jsonSelectorStep) matches(segment jsonSegment) bool {
+	switch {
+	case step.wildcard:
+		return true
+	case step.index >= 0:
+		return segment.index == step.index
+	default:
+		return segment.index < 0 && segment.key == step.key
+	}
+}
+
+// formatJSONPath returns the normalized path of a value, such as
+// $.cards[0].number, which is the additional data its ciphertext is bound to.
+func formatJSONPath(path []jsonSegment) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, segment := range path {
+		switch {
+		case segment.index >= 0:
+			b.WriteString("[" + strconv.Itoa(segment.index) + "]")
+		case segment.key != "" && jsonIdentifierRegexp.FindString(segment.key) == segment.key:
+			b.WriteString("." + segment.key)
+		default:
+			b.WriteString("[" + strconv.Quote(segment.key) + "]")
+		}
+	}
+	return b.String()
+}
+
+// EncryptJSONFields replaces every value of doc matched by a selector with a
+// tagged ciphertext object, sealed under one new data key wrapped by w.
+// Values nested in a matched value are encrypted along with it; documents
+// without matches are returned unchanged without calling w.
+func EncryptJSONFields(ctx context.Context, w KeyWrapper, doc []byte, selectors []*JSONSelector) ([]byte, error) {
+	s, err := scanJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []jsonNode
+	end := 0
+	for _, node := range s.nodes {
+		if node.start < end || !matchesAnyJSONSelector(selectors, node.segments) {
+			continue
+		}
+		if node.object && isEncryptedJSONValue(doc[node.start:node.end]) {
+			return nil, fmt.Errorf("%s: value is already encrypted", formatJSONPath(node.segments))
+		}
+		matched = append(matched, node)
+		end = node.end
+	}
+	if len(matched) == 0 {
+		return doc, nil
+	}
+
+	key, err := NewDataKey(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	return spliceJSON(doc, matched, func(node jsonNode) ([]byte, error) {
+		path := formatJSONPath(node.segments)
+		value := &EncryptedJSONValue{Version: jsonFieldVersion, Envelope: *key.Envelope(doc[node.start:node.end], []byte(path))}
+		return json.Marshal(value)
+	})
+}
+
+// DecryptJSONFields replaces every tagged ciphertext object in doc with the
+// value it holds. Each data key is unwrapped once per document.
+func DecryptJSONFields(ctx context.Context, w KeyWrapper, doc []byte) ([]byte, error) {
+	s, err := scanJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []jsonNode
+	for _, node := range s.nodes {
+		if node.object && isEncryptedJSONValue(doc[node.start:node.end]) {
+			encrypted = append(encrypted, node)
+		}
+	}
+
+	keys := map[string]*DataKey{}
+	return spliceJSON(doc, encrypted, func(node jsonNode) ([]byte, error) {
+		path := formatJSONPath(node.segments)
+		var value EncryptedJSONValue
+		if err := json.Unmarshal(doc[node.start:node.end], &value); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if value.Version != jsonFieldVersion {
+			return nil, fmt.Errorf("%s: unsupported encrypted value version %q", path, value.Version)
+		}
+
+		cacheKey := value.KeyID + "\x00" + value.WrappedKey
+		key, ok := keys[cacheKey]
+		if !ok {
+			if key, err = OpenDataKey(ctx, w, value.KeyID, value.WrappedKey); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			keys[cacheKey] = key
+		}
+		plaintext, err := key.Open(value.Ciphertext, []byte(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !json.Valid(plaintext) {
+			return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("%s: plaintext is not JSON", path)}
+		}
+		return plaintext, nil
+	})
+}
+
+func matchesAnyJSONSelector(selectors []*JSONSelector, path []jsonSegment) bool {
+	for _, s := range selectors {
+		if s.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEncryptedJSONValue reports whether the object raw is a tagged ciphertext
+// object: it has exactly the members of EncryptedJSONValue.
+func isEncryptedJSONValue(raw []byte) bool {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(raw, &members) != nil || len(members) != 4 {
+		return false
+	}
+	for _, name := range []string{"kvcrypt", "kid", "wrapped_key", "ciphertext"} {
+		if _, ok := members[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// spliceJSON replaces the non-overlapping nodes of doc, in document order,
+// with what fn returns for them.
+func spliceJSON(doc []byte, nodes []jsonNode, fn func(jsonNode) ([]byte, error)) ([]byte, error) {
+	if len(nodes) == 0 {
+		return doc, nil
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, node := range nodes {
+		if node.start < last {
+			return nil, errors.New("overlapping JSON values")
+		}
+		replacement, err := fn(node)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(doc[last:node.start])
+		out.Write(replacement)
+		last = node.end
+	}
+	out.Write(doc[last:])
+	return out.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONSelector(t *testing.T) {
+	key := func(k string) jsonSelectorStep { return jsonSelectorStep{key: k, index: -1} }
+	tests := []struct {
+		selector string
+		want     []jsonSelectorStep
+	}{
+		{"$.customer.ssn", []jsonSelectorStep{key("customer"), key("ssn")}},
+		{"$.cards[*].number", []jsonSelectorStep{key("cards"), {index: -1, wildcard: true}, key("number")}},
+		{"$.cards[2]", []jsonSelectorStep{key("cards"), {index: 2}}},
+		{"$['odd key']", []jsonSelectorStep{key("odd key")}},
+		{`$["a]b"].c`, []jsonSelectorStep{key("a]b"), key("c")}},
+		{"$..email", []jsonSelectorStep{{key: "email", index: -1, descendant: true}}},
+		{"$..*", []jsonSelectorStep{{index: -1, wildcard: true, descendant: true}}},
+		{"$..[0]", []jsonSelectorStep{{index: 0, descendant: true}}},
+		{"$.*.x-id", []jsonSelectorStep{{index: -1, wildcard: true}, key("x-id")}},
+	}
+	for _, tc := range tests {
+		s, err := ParseJSONSelector(tc.selector)
+		if err != nil {
+			t.Errorf("ParseJSONSelector(%q): %v", tc.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.steps, tc.want) {
+			t.Errorf("ParseJSONSelector(%q) = %+v, want %+v", tc.selector, s.steps, tc.want)
+		}
+		if s.String() != tc.selector {
+			t.Errorf("String() = %q, want %q", s.String(), tc.selector)
+		}
+	}
+
+	for _, selector := range []string{
+		"", "$", "customer.ssn", "$x", "$.", "$..", "$.[0]", "$[", "$[0", "$[]",
+		"$[-1]", "$[x]", "$['key", "$['key]", "$.9key", "$.a b",
+	} {
+		if _, err := ParseJSONSelector(selector); err == nil {
+			t.Errorf("ParseJSONSelector(%q) accepted", selector)
+		}
+	}
+}
+
+func TestJSONSelectorMatches(t *testing.T) {
+	k := func(key string) jsonSegment { return jsonSegment{key: key, index: -1} }
+	i := func(index int) jsonSegment { return jsonSegment{index: index} }
+	tests := []struct {
+		selector string
+		path     []jsonSegment
+		want     bool
+	}{
+		{"$.customer.ssn", []jsonSegment{k("customer"), k("ssn")}, true},
+		{"$.customer.ssn", []jsonSegment{k("customer")}, false},
+		{"$.customer.ssn", []jsonSegment{k("customer"), k("ssn"), k("x")}, false},
+		{"$.cards[*].number", []jsonSegment{k("cards"), i(3), k("number")}, true},
+		{"$.cards[1]", []jsonSegment{k("cards"), i(1)}, true},
+		{"$.cards[1]", []jsonSegment{k("cards"), k("1")}, false},
+		{"$..email", []jsonSegment{k("email")}, true},
+		{"$..email", []jsonSegment{k("a"), i(0), k("email")}, true},
+		{"$..email", []jsonSegment{k("email"), k("x")}, false},
+		{"$.a..b", []jsonSegment{k("a"), k("x"), k("b")}, true},
+		{"$.a..b", []jsonSegment{k("x"), k("a"), k("b")}, false},
+	}
+	for _, tc := range tests {
+		s, err := ParseJSONSelector(tc.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.matches(tc.path); got != tc.want {
+			t.Errorf("%s matches %s = %v, want %v", tc.selector, formatJSONPath(tc.path), got, tc.want)
+		}
+	}
+}
+
+func TestJSONFieldsRoundTrip(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	selectors, err := ParseJSONSelectors("$.customer.ssn", "$.cards[*].number", "$['odd key']")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := []byte(`{"customer":{"name":"Ada","ssn":"078-05-1120"},"cards":[{"number":"4111"},{"number":"5500"}],"odd key":{"nested":[1,2]}}`)
+
+	encrypted, err := EncryptJSONFields(ctx, vault, doc, selectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"078-05-1120", "4111", "5500", "nested"} {
+		if bytes.Contains(encrypted, []byte(secret)) {
+			t.Errorf("%s left in plaintext: %s", secret, encrypted)
+		}
+	}
+	if !bytes.Contains(encrypted, []byte(`"name":"Ada"`)) {
+		t.Errorf("unselected value changed: %s", encrypted)
+	}
+	if _, err := EncryptJSONFields(ctx, vault, encrypted, selectors); err == nil {
+		t.Error("encrypted values encrypted again")
+	}
+
+	decrypted, err := DecryptJSONFields(ctx, vault, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, doc) {
+		t.Errorf("round trip = %s, want %s", decrypted, doc)
+	}
+
+	// a ciphertext moved to another path must not decrypt
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encrypted, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var cards []map[string]json.RawMessage
+	if err := json.Unmarshal(fields["cards"], &cards); err != nil {
+		t.Fatal(err)
+	}
+	cards[0]["number"], cards[1]["number"] = cards[1]["number"], cards[0]["number"]
+	if fields["cards"], err = json.Marshal(cards); err != nil {
+		t.Fatal(err)
+	}
+	swapped, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptJSONFields(ctx, vault, swapped); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("swapped ciphertexts: got %v, want ErrInvalidCiphertext", err)
+	}
+
+	unmatched := []byte(`{"other":1}`)
+	if out, err := EncryptJSONFields(ctx, vault, unmatched, selectors); err != nil || !bytes.Equal(out, unmatched) {
+		t.Errorf("document without matches = %s, %v, want it unchanged", out, err)
+	}
+}
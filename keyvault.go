@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"regexp"
 	"strings"
@@ -28,6 +29,7 @@ type KeyVaultKeyInfo struct {
 type EncryptionClient struct {
 	kvClient *keyvault.BaseClient
 	kvInfo   *KeyVaultKeyInfo
+	logger   *slog.Logger
 }
 
 func NewEncryptionClientFromEnv(azureConfiguration AzureConfiguration) (*EncryptionClient, error) {
@@ -47,7 +49,7 @@ func NewEncryptionClient(tenantID, clientID, clientSecret, keyVaultKeyIdentifier
 		return &EncryptionClient{}, err
 	}
 
-	return &EncryptionClient{kvClient, kvInfo}, nil
+	return &EncryptionClient{kvClient: kvClient, kvInfo: kvInfo}, nil
 }
 
 func environment() *azure.Environment {
@@ -60,45 +62,65 @@ func environment() *azure.Environment {
 }
 
 func getKeyvaultAuthorizer(tenantID, clientID, clientSecret string) (autorest.Authorizer, error) {
+	var a autorest.Authorizer
+
+	token, err := getServicePrincipalToken(tenantID, clientID, clientSecret)
+	if err != nil {
+		return a, err
+	}
+
+	keyvaultAuthorizer := autorest.NewBearerAuthorizer(tracedTokenProvider{token})
+
+	return keyvaultAuthorizer, err
+}
+
+func getServicePrincipalToken(tenantID, clientID, clientSecret string) (*adal.ServicePrincipalToken, error) {
 	// BUG: default value for KeyVaultEndpoint is wrong
 	vaultEndpoint := strings.TrimSuffix(environment().KeyVaultEndpoint, "/")
 	// BUG: alternateEndpoint replaces other endpoints in the configs below
 	alternateEndpoint, _ := url.Parse("https://login.windows.net/" + tenantID + "/oauth2/token")
 
-	var a autorest.Authorizer
-	var err error
-
 	oauthconfig, err := adal.NewOAuthConfig(environment().ActiveDirectoryEndpoint, tenantID)
 	if err != nil {
-		return a, err
+		return nil, err
 	}
 	oauthconfig.AuthorizeEndpoint = *alternateEndpoint
 
-	token, err := adal.NewServicePrincipalToken(
+	return adal.NewServicePrincipalToken(
 		*oauthconfig, clientID, clientSecret, vaultEndpoint)
-
-	if err != nil {
-		return a, err
-	}
-
-	keyvaultAuthorizer := autorest.NewBearerAuthorizer(token)
-
-	return keyvaultAuthorizer, err
 }
 
 func getKeysClient(authorizer autorest.Authorizer) *keyvault.BaseClient {
 	keyClient := keyvault.New()
 	keyClient.Authorizer = authorizer
+	keyClient.Sender = newKeyVaultSender()
 	keyClient.AddToUserAgent(kvClientUserAgent)
 	return &keyClient
 }
 
+func (k *KeyVaultKeyInfo) keyID() string {
+	id := fmt.Sprintf("%s/keys/%s", k.vaultURL, k.keyName)
+	if k.keyVersion != "" {
+		id += "/" + k.keyVersion
+	}
+	return id
+}
+
+// keyIdentifierRegexp matches a whole key identifier, capturing the vault
+// name, key name and optional version. It is anchored and allows no other
+// characters, since identifiers are also read from encrypted data and the
+// vault URL is rebuilt from the name alone.
+func keyIdentifierRegexp() *regexp.Regexp {
+	r, _ := regexp.Compile(`^https://([a-zA-Z0-9-]{3,24})\.vault\.azure\.net/keys/([a-zA-Z0-9-]+)(?:/([a-zA-Z0-9]*))?$`)
+	return r
+}
+
 func parseKeyVaultKeyInfo(keyVaultKeyIdentifier string) (*KeyVaultKeyInfo, error) {
-	r, _ := regexp.Compile("https?://(.+)\\.vault\\.azure\\.net/keys/([^\\/.]+)/?([^\\/.]*)")
+	r := keyIdentifierRegexp()
 
 	str := r.FindStringSubmatch(keyVaultKeyIdentifier)
 	if len(str) < 4 {
-		return &KeyVaultKeyInfo{}, fmt.Errorf("Expected a key identifier from Key Vault. e.g.: https://keyvaultname.vault.azure.net/keys/myKey/99d67321dd9841af859129cd5551a871")
+		return &KeyVaultKeyInfo{}, fmt.Errorf("%w: expected a key identifier from Key Vault. e.g.: https://keyvaultname.vault.azure.net/keys/myKey/99d67321dd9841af859129cd5551a871", ErrInvalidKeyIdentifier)
 	}
 
 	info := KeyVaultKeyInfo{}
@@ -109,6 +131,17 @@ func parseKeyVaultKeyInfo(keyVaultKeyIdentifier string) (*KeyVaultKeyInfo, error
 	return &info, nil
 }
 
+func parseKeyVaultURL(vault string) (string, error) {
+	r, _ := regexp.Compile("^(?:https?://)?([a-zA-Z0-9-]{3,24})(?:\\.vault\\.azure\\.net)?/?$")
+
+	str := r.FindStringSubmatch(vault)
+	if len(str) < 2 {
+		return "", fmt.Errorf("Expected a Key Vault name or URL. e.g.: https://keyvaultname.vault.azure.net")
+	}
+
+	return fmt.Sprintf("https://%s.vault.azure.net", str[1]), nil
+}
+
 func (e *EncryptionClient) getKeyOperationsParameters(value *string) keyvault.KeyOperationsParameters {
 	parameters := keyvault.KeyOperationsParameters{}
 	parameters.Algorithm = keyvault.RSAOAEP256
@@ -116,38 +149,210 @@ func (e *EncryptionClient) getKeyOperationsParameters(value *string) keyvault.Ke
 	return parameters
 }
 
-func (e *EncryptionClient) Encrypt(ctx context.Context, data []byte) (*string, error) {
+func (e *EncryptionClient) Encrypt(ctx context.Context, data []byte) (_ *string, err error) {
 	if len(data) == 0 {
 		v := ""
 		return &v, nil
 	}
 
+	ctx, op := e.startOperation(ctx, "Encrypt", string(keyvault.RSAOAEP256), len(data))
+	defer func() { op.end(err) }()
+
 	encoded := base64.RawStdEncoding.EncodeToString(data)
 
 	parameters := e.getKeyOperationsParameters(&encoded)
 	result, err := e.kvClient.Encrypt(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
 	if err != nil {
-		return nil, err
+		return nil, e.checkSoftDeleted(ctx, wrapKeyOperationError("encrypt", err))
 	}
 
 	return result.Result, nil
 }
 
-func (e *EncryptionClient) Decrypt(ctx context.Context, data *string) ([]byte, error) {
+func (e *EncryptionClient) Decrypt(ctx context.Context, data *string) (_ []byte, err error) {
 	if data == nil || len(*data) == 0 {
 		return make([]byte, 0), nil
 	}
 
+	ctx, op := e.startOperation(ctx, "Decrypt", string(keyvault.RSAOAEP256), len(*data))
+	defer func() { op.end(err) }()
+
+	if _, err := base64.RawURLEncoding.DecodeString(*data); err != nil {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+	}
+
 	parameters := e.getKeyOperationsParameters(data)
 	result, err := e.kvClient.Decrypt(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
 	if err != nil {
-		return nil, err
+		return nil, e.checkSoftDeleted(ctx, wrapKeyOperationError("decrypt", err))
 	}
 
 	decoded, err := base64.RawStdEncoding.DecodeString(*result.Result)
+	if err != nil {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+	}
+
+	return decoded, nil
+}
+
+// WrapKey encrypts a symmetric data key with the Key Vault key.
+func (e *EncryptionClient) WrapKey(ctx context.Context, key []byte) (*string, error) {
+	result, err := e.wrapKey(ctx, key)
 	if err != nil {
 		return nil, err
 	}
+	return result.Result, nil
+}
+
+func (e *EncryptionClient) wrapKey(ctx context.Context, key []byte) (_ keyvault.KeyOperationResult, err error) {
+	ctx, op := e.startOperation(ctx, "WrapKey", string(keyvault.RSAOAEP256), len(key))
+	defer func() { op.end(err) }()
+
+	encoded := base64.RawURLEncoding.EncodeToString(key)
+
+	parameters := e.getKeyOperationsParameters(&encoded)
+	result, err := e.kvClient.WrapKey(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
+	if err != nil {
+		return result, e.checkSoftDeleted(ctx, wrapKeyOperationError("wrap", err))
+	}
+
+	return result, nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func (e *EncryptionClient) UnwrapKey(ctx context.Context, wrapped *string) (_ []byte, err error) {
+	if wrapped == nil || len(*wrapped) == 0 {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("empty wrapped key")}
+	}
+
+	ctx, op := e.startOperation(ctx, "UnwrapKey", string(keyvault.RSAOAEP256), len(*wrapped))
+	defer func() { op.end(err) }()
+
+	parameters := e.getKeyOperationsParameters(wrapped)
+	result, err := e.kvClient.UnwrapKey(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
+	if err != nil {
+		return nil, e.checkSoftDeleted(ctx, wrapKeyOperationError("unwrap", err))
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(*result.Result)
+	if err != nil {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidCiphertext, Err: err}
+	}
 
 	return decoded, nil
 }
+
+// KeyID is the configured key identifier.
+func (e *EncryptionClient) KeyID() string {
+	return e.kvInfo.keyID()
+}
+
+// WrapDataKey implements KeyWrapper. The returned key identifier always names
+// a version, even when the client is configured with the latest one.
+func (e *EncryptionClient) WrapDataKey(ctx context.Context, key []byte) (string, string, error) {
+	result, err := e.wrapKey(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyID := e.kvInfo.keyID()
+	if result.Kid != nil {
+		keyID = *result.Kid
+	}
+	return *result.Result, keyID, nil
+}
+
+// UnwrapDataKey implements KeyWrapper. keyID may name any version of the
+// configured key, so data keys wrapped before a rotation still unwrap.
+func (e *EncryptionClient) UnwrapDataKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	client, err := e.forKeyID(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return client.UnwrapKey(ctx, &wrapped)
+}
+
+// forKeyID returns a client for the version of the configured key that keyID
+// names.
+func (e *EncryptionClient) forKeyID(keyID string) (*EncryptionClient, error) {
+	if keyID == "" || keyID == e.kvInfo.keyID() {
+		return e, nil
+	}
+	info, err := parseKeyVaultKeyInfo(keyID)
+	if err != nil {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidKeyIdentifier, Err: err}
+	}
+	if !strings.EqualFold(info.vaultURL, e.kvInfo.vaultURL) || info.keyName != e.kvInfo.keyName {
+		return nil, &KeyOperationError{Op: "unwrap", Kind: ErrInvalidKeyIdentifier, Err: fmt.Errorf("%s is not a version of %s", keyID, e.kvInfo.keyID())}
+	}
+	client := *e
+	client.kvInfo = info
+	return &client, nil
+}
+
+// Sign signs a SHA-256 digest with the Key Vault key using RS256.
+func (e *EncryptionClient) Sign(ctx context.Context, digest []byte) (*string, error) {
+	result, err := e.sign(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	return result.Result, nil
+}
+
+func (e *EncryptionClient) sign(ctx context.Context, digest []byte) (_ keyvault.KeyOperationResult, err error) {
+	ctx, op := e.startOperation(ctx, "Sign", string(keyvault.RS256), len(digest))
+	defer func() { op.end(err) }()
+
+	encoded := base64.RawURLEncoding.EncodeToString(digest)
+
+	parameters := keyvault.KeySignParameters{Algorithm: keyvault.RS256, Value: &encoded}
+	result, err := e.kvClient.Sign(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
+	if err != nil {
+		return result, e.checkSoftDeleted(ctx, wrapKeyOperationError("sign", err))
+	}
+
+	return result, nil
+}
+
+// SignDigest implements DigestSigner. Like WrapDataKey, the returned key
+// identifier always names a version.
+func (e *EncryptionClient) SignDigest(ctx context.Context, digest []byte) (string, string, error) {
+	result, err := e.sign(ctx, digest)
+	if err != nil {
+		return "", "", err
+	}
+	keyID := e.kvInfo.keyID()
+	if result.Kid != nil {
+		keyID = *result.Kid
+	}
+	return *result.Result, keyID, nil
+}
+
+// VerifyDigest implements DigestSigner. keyID must name a version of the
+// configured key, so only signatures made with it are accepted.
+func (e *EncryptionClient) VerifyDigest(ctx context.Context, keyID string, digest []byte, signature string) (bool, error) {
+	client, err := e.forKeyID(keyID)
+	if err != nil {
+		return false, err
+	}
+	return client.Verify(ctx, digest, &signature)
+}
+
+// Verify checks an RS256 signature produced by Sign over a SHA-256 digest.
+func (e *EncryptionClient) Verify(ctx context.Context, digest []byte, signature *string) (_ bool, err error) {
+	if signature == nil || len(*signature) == 0 {
+		return false, nil
+	}
+
+	ctx, op := e.startOperation(ctx, "Verify", string(keyvault.RS256), len(digest))
+	defer func() { op.end(err) }()
+
+	encoded := base64.RawURLEncoding.EncodeToString(digest)
+
+	parameters := keyvault.KeyVerifyParameters{Algorithm: keyvault.RS256, Digest: &encoded, Signature: signature}
+	result, err := e.kvClient.Verify(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion, parameters)
+	if err != nil {
+		return false, e.checkSoftDeleted(ctx, wrapKeyOperationError("verify", err))
+	}
+
+	return result.Value != nil && *result.Value, nil
+}
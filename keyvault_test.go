@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseKeyVaultKeyInfo(t *testing.T) {
+	valid := map[string]string{
+		"https://myvault.vault.azure.net/keys/mykey":                                   "https://myvault.vault.azure.net/keys/mykey",
+		"https://myvault.vault.azure.net/keys/mykey/":                                  "https://myvault.vault.azure.net/keys/mykey",
+		"https://myvault.vault.azure.net/keys/my-key/99d67321dd9841af859129cd5551a871": "https://myvault.vault.azure.net/keys/my-key/99d67321dd9841af859129cd5551a871",
+	}
+	for keyID, want := range valid {
+		info, err := parseKeyVaultKeyInfo(keyID)
+		if err != nil {
+			t.Errorf("%s: %v", keyID, err)
+			continue
+		}
+		if info.keyID() != want {
+			t.Errorf("%s parsed as %s, want %s", keyID, info.keyID(), want)
+		}
+	}
+
+	invalid := []string{
+		"https://attacker.example/x.vault.azure.net/keys/k/v",
+		"https://attacker.example?x.vault.azure.net/keys/k/v",
+		"https://attacker.example#x.vault.azure.net/keys/k/v",
+		"https://attacker.example/.vault.azure.net/keys/k",
+		"https://myvault.vault.azure.net.attacker.example/keys/k",
+		"https://myvault.vault.azure.net/keys/k/v/extra",
+		"https://myvault.vault.azure.net/keys/k?x=1",
+		"https://myvault.vault.azure.net/keys/k#x",
+		"http://myvault.vault.azure.net/keys/k",
+		"https://user@myvault.vault.azure.net/keys/k",
+		"https://myvault.vault.azure.net:8443/keys/k",
+		"prefix https://myvault.vault.azure.net/keys/k",
+	}
+	for _, keyID := range invalid {
+		if info, err := parseKeyVaultKeyInfo(keyID); err == nil {
+			t.Errorf("%s accepted as %s", keyID, info.keyID())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// Messages and service descriptions of the Kubernetes KMS provider APIs,
+// written out by hand from k8s.io/apiserver's v1beta1 service.proto and
+// k8s.io/kms's v2 api.proto so that no generated code or extra dependency is
+// needed. Field numbers and names must match the upstream definitions.
+
+const (
+	kmsV1Service = "v1beta1.KeyManagementService"
+	kmsV2Service = "v2.KeyManagementService"
+)
+
+type kmsV1VersionRequest struct {
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+type kmsV1VersionResponse struct {
+	Version        string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	RuntimeName    string `protobuf:"bytes,2,opt,name=runtime_name,json=runtimeName,proto3" json:"runtime_name,omitempty"`
+	RuntimeVersion string `protobuf:"bytes,3,opt,name=runtime_version,json=runtimeVersion,proto3" json:"runtime_version,omitempty"`
+}
+
+type kmsV1EncryptRequest struct {
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Plain   []byte `protobuf:"bytes,2,opt,name=plain,proto3" json:"plain,omitempty"`
+}
+
+type kmsV1EncryptResponse struct {
+	Cipher []byte `protobuf:"bytes,1,opt,name=cipher,proto3" json:"cipher,omitempty"`
+}
+
+type kmsV1DecryptRequest struct {
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Cipher  []byte `protobuf:"bytes,2,opt,name=cipher,proto3" json:"cipher,omitempty"`
+}
+
+type kmsV1DecryptResponse struct {
+	Plain []byte `protobuf:"bytes,1,opt,name=plain,proto3" json:"plain,omitempty"`
+}
+
+type kmsV2StatusRequest struct{}
+
+type kmsV2StatusResponse struct {
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Healthz string `protobuf:"bytes,2,opt,name=healthz,proto3" json:"healthz,omitempty"`
+	KeyID   string `protobuf:"bytes,3,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+}
+
+type kmsV2EncryptRequest struct {
+	Plaintext []byte `protobuf:"bytes,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	UID       string `protobuf:"bytes,2,opt,name=uid,proto3" json:"uid,omitempty"`
+}
+
+type kmsV2EncryptResponse struct {
+	Ciphertext  []byte            `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	KeyID       string            `protobuf:"bytes,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Annotations map[string][]byte `protobuf:"bytes,3,rep,name=annotations,proto3" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+type kmsV2DecryptRequest struct {
+	Ciphertext  []byte            `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	UID         string            `protobuf:"bytes,2,opt,name=uid,proto3" json:"uid,omitempty"`
+	KeyID       string            `protobuf:"bytes,3,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Annotations map[string][]byte `protobuf:"bytes,4,rep,name=annotations,proto3" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+type kmsV2DecryptResponse struct {
+	Plaintext []byte `protobuf:"bytes,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+}
+
+func (m *kmsV1VersionRequest) Reset()         { *m = kmsV1VersionRequest{} }
+func (m *kmsV1VersionRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV1VersionRequest) ProtoMessage()    {}
+
+func (m *kmsV1VersionResponse) Reset()         { *m = kmsV1VersionResponse{} }
+func (m *kmsV1VersionResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV1VersionResponse) ProtoMessage()    {}
+
+func (m *kmsV1EncryptRequest) Reset()         { *m = kmsV1EncryptRequest{} }
+func (m *kmsV1EncryptRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV1EncryptRequest) ProtoMessage()    {}
+
+func (m *kmsV1EncryptResponse) Reset()         { *m = kmsV1EncryptResponse{} }
+func (m *kmsV1EncryptResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV1EncryptResponse) ProtoMessage()    {}
+
+func (m *kmsV1DecryptRequest) Reset()         { *m = kmsV1DecryptRequest{} }
+func (m *kmsV1DecryptRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV1DecryptRequest) ProtoMessage()    {}
+
+func (m *kmsV1DecryptResponse) Reset()         { *m = kmsV1DecryptResponse{} }
+func (m *kmsV1DecryptResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV1DecryptResponse) ProtoMessage()    {}
+
+func (m *kmsV2StatusRequest) Reset()         { *m = kmsV2StatusRequest{} }
+func (m *kmsV2StatusRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV2StatusRequest) ProtoMessage()    {}
+
+func (m *kmsV2StatusResponse) Reset()         { *m = kmsV2StatusResponse{} }
+func (m *kmsV2StatusResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV2StatusResponse) ProtoMessage()    {}
+
+func (m *kmsV2EncryptRequest) Reset()         { *m = kmsV2EncryptRequest{} }
+func (m *kmsV2EncryptRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV2EncryptRequest) ProtoMessage()    {}
+
+func (m *kmsV2EncryptResponse) Reset()         { *m = kmsV2EncryptResponse{} }
+func (m *kmsV2EncryptResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV2EncryptResponse) ProtoMessage()    {}
+
+func (m *kmsV2DecryptRequest) Reset()         { *m = kmsV2DecryptRequest{} }
+func (m *kmsV2DecryptRequest) String() string { return proto.CompactTextString(m) }
+func (*kmsV2DecryptRequest) ProtoMessage()    {}
+
+func (m *kmsV2DecryptResponse) Reset()         { *m = kmsV2DecryptResponse{} }
+func (m *kmsV2DecryptResponse) String() string { return proto.CompactTextString(m) }
+func (*kmsV2DecryptResponse) ProtoMessage()    {}
+
+type kmsV1Server interface {
+	Version(context.Context, *kmsV1VersionRequest) (*kmsV1VersionResponse, error)
+	Encrypt(context.Context, *kmsV1EncryptRequest) (*kmsV1EncryptResponse, error)
+	Decrypt(context.Context, *kmsV1DecryptRequest) (*kmsV1DecryptResponse, error)
+}
+
+type kmsV2Server interface {
+	Status(context.Context, *kmsV2StatusRequest) (*kmsV2StatusResponse, error)
+	Encrypt(context.Context, *kmsV2EncryptRequest) (*kmsV2EncryptResponse, error)
+	Decrypt(context.Context, *kmsV2DecryptRequest) (*kmsV2DecryptResponse, error)
+}
+
+var kmsV1ServiceDesc = grpc.ServiceDesc{
+	ServiceName: kmsV1Service,
+	HandlerType: (*kmsV1Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Version", Handler: unaryHandler(kmsV1Service, "Version", func() interface{} { return new(kmsV1VersionRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV1Server).Version(ctx, req.(*kmsV1VersionRequest))
+			})},
+		{MethodName: "Encrypt", Handler: unaryHandler(kmsV1Service, "Encrypt", func() interface{} { return new(kmsV1EncryptRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV1Server).Encrypt(ctx, req.(*kmsV1EncryptRequest))
+			})},
+		{MethodName: "Decrypt", Handler: unaryHandler(kmsV1Service, "Decrypt", func() interface{} { return new(kmsV1DecryptRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV1Server).Decrypt(ctx, req.(*kmsV1DecryptRequest))
+			})},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "service.proto",
+}
+
+var kmsV2ServiceDesc = grpc.ServiceDesc{
+	ServiceName: kmsV2Service,
+	HandlerType: (*kmsV2Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Status", Handler: unaryHandler(kmsV2Service, "Status", func() interface{} { return new(kmsV2StatusRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV2Server).Status(ctx, req.(*kmsV2StatusRequest))
+			})},
+		{MethodName: "Encrypt", Handler: unaryHandler(kmsV2Service, "Encrypt", func() interface{} { return new(kmsV2EncryptRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV2Server).Encrypt(ctx, req.(*kmsV2EncryptRequest))
+			})},
+		{MethodName: "Decrypt", Handler: unaryHandler(kmsV2Service, "Decrypt", func() interface{} { return new(kmsV2DecryptRequest) },
+			func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(kmsV2Server).Decrypt(ctx, req.(*kmsV2DecryptRequest))
+			})},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api.proto",
+}
+
+// unaryHandler builds what protoc-gen-go would generate for a unary method.
+func unaryHandler(service, method string, newRequest func() interface{}, call func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	fullMethod := "/" + service + "/" + method
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv, ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv, ctx, req)
+		})
+	}
+}
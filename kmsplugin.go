@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	kmsAPIVersionV1   = "v1beta1"
+	kmsAPIVersionV2   = "v2"
+	kmsRuntimeName    = "kvcrypt"
+	kmsRuntimeVersion = "0.1.0"
+
+	// kmsWrappedKeyAnnotation carries the wrapped data key of a v2 ciphertext.
+	// Annotation keys must be fully qualified domain names.
+	kmsWrappedKeyAnnotation = "wrapped-key.kvcrypt.azure.com"
+
+	// The plugin reuses a data key for a while, so that not every write to
+	// etcd costs a Key Vault call.
+	kmsDataKeyMaxAge  = time.Hour
+	kmsDataKeyMaxUses = 1 << 20
+	kmsDataKeyCache   = 1024
+)
+
+// KMSPlugin is a Kubernetes KMS provider for encrypting secrets in etcd. It
+// serves both the v1beta1 and v2 gRPC APIs, sealing the API server's keys
+// with data keys that are wrapped by the Key Vault key.
+type KMSPlugin struct {
+	wrapper KeyWrapper
+	cache   *DataKeyCache
+
+	mu      sync.Mutex
+	current *DataKey
+	created time.Time
+	uses    int
+}
+
+func NewKMSPlugin(w KeyWrapper) (*KMSPlugin, error) {
+	cache, err := NewDataKeyCache(kmsDataKeyCache, kmsDataKeyMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &KMSPlugin{wrapper: w, cache: cache}, nil
+}
+
+// dataKey returns the data key new ciphertext is sealed with, wrapping a new
+// one when the current one is too old or too used.
+func (p *KMSPlugin) dataKey(ctx context.Context) (*DataKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil || time.Since(p.created) > kmsDataKeyMaxAge || p.uses >= kmsDataKeyMaxUses {
+		key, err := NewDataKey(ctx, p.wrapper)
+		if err != nil {
+			return nil, err
+		}
+		if p.current != nil && p.current.KeyID != key.KeyID {
+			slog.Info("key encryption key changed", slog.String("from", p.current.KeyID), slog.String("to", key.KeyID))
+		}
+		p.current, p.created, p.uses = key, time.Now(), 0
+	}
+	p.uses++
+	return p.current, nil
+}
+
+func (p *KMSPlugin) seal(ctx context.Context, plaintext []byte) (*Envelope, error) {
+	key, err := p.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return key.Envelope(plaintext, nil), nil
+}
+
+func (p *KMSPlugin) open(ctx context.Context, envelope *Envelope) ([]byte, error) {
+	key, err := p.cache.OpenDataKey(ctx, p.wrapper, envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return key.Open(envelope.Ciphertext, nil)
+}
+
+// Serve serves both API versions on the unix socket at address until ctx is
+// done.
+func (p *KMSPlugin) Serve(ctx context.Context, address string) error {
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logKMSErrors))
+	server.RegisterService(&kmsV1ServiceDesc, kmsV1Plugin{p})
+	server.RegisterService(&kmsV2ServiceDesc, kmsV2Plugin{p})
+
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		server.GracefulStop()
+	}()
+	slog.Info("serving", slog.String("address", address))
+	return server.Serve(listener)
+}
+
+type kmsV1Plugin struct {
+	*KMSPlugin
+}
+
+func (p kmsV1Plugin) Version(ctx context.Context, req *kmsV1VersionRequest) (*kmsV1VersionResponse, error) {
+	return &kmsV1VersionResponse{Version: kmsAPIVersionV1, RuntimeName: kmsRuntimeName, RuntimeVersion: kmsRuntimeVersion}, nil
+}
+
+func (p kmsV1Plugin) Encrypt(ctx context.Context, req *kmsV1EncryptRequest) (*kmsV1EncryptResponse, error) {
+	if err := checkKMSVersion(req.Version); err != nil {
+		return nil, err
+	}
+	envelope, err := p.seal(ctx, req.Plain)
+	if err != nil {
+		return nil, kmsError(err)
+	}
+	cipher, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, kmsError(err)
+	}
+	return &kmsV1EncryptResponse{Cipher: cipher}, nil
+}
+
+func (p kmsV1Plugin) Decrypt(ctx context.Context, req *kmsV1DecryptRequest) (*kmsV1DecryptResponse, error) {
+	if err := checkKMSVersion(req.Version); err != nil {
+		return nil, err
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(req.Cipher, &envelope); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cipher is not a kvcrypt envelope: %v", err)
+	}
+	plain, err := p.open(ctx, &envelope)
+	if err != nil {
+		return nil, kmsError(err)
+	}
+	return &kmsV1DecryptResponse{Plain: plain}, nil
+}
+
+func checkKMSVersion(version string) error {
+	if version != kmsAPIVersionV1 {
+		return status.Errorf(codes.InvalidArgument, "unsupported KMS API version %q, expected %s", version, kmsAPIVersionV1)
+	}
+	return nil
+}
+
+type kmsV2Plugin struct {
+	*KMSPlugin
+}
+
+// Status reports the key ID new ciphertext is sealed with, which the API
+// server watches to notice rotations, after checking that the data key still
+// unwraps in Key Vault.
+func (p kmsV2Plugin) Status(ctx context.Context, req *kmsV2StatusRequest) (*kmsV2StatusResponse, error) {
+	response := &kmsV2StatusResponse{Version: kmsAPIVersionV2, Healthz: "ok"}
+
+	key, err := p.dataKey(ctx)
+	if err == nil {
+		response.KeyID = key.KeyID
+		_, err = p.wrapper.UnwrapDataKey(ctx, key.KeyID, key.Wrapped)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "kms health check failed", slog.String("error", err.Error()))
+		response.Healthz = errorLabel(err)
+	}
+	return response, nil
+}
+
+func (p kmsV2Plugin) Encrypt(ctx context.Context, req *kmsV2EncryptRequest) (*kmsV2EncryptResponse, error) {
+	envelope, err := p.seal(ctx, req.Plaintext)
+	if err != nil {
+		return nil, kmsError(err)
+	}
+	return &kmsV2EncryptResponse{
+		Ciphertext:  envelope.Ciphertext,
+		KeyID:       envelope.KeyID,
+		Annotations: map[string][]byte{kmsWrappedKeyAnnotation: []byte(envelope.WrappedKey)},
+	}, nil
+}
+
+func (p kmsV2Plugin) Decrypt(ctx context.Context, req *kmsV2DecryptRequest) (*kmsV2DecryptResponse, error) {
+	wrapped, ok := req.Annotations[kmsWrappedKeyAnnotation]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s annotation", kmsWrappedKeyAnnotation)
+	}
+	plaintext, err := p.open(ctx, &Envelope{KeyID: req.KeyID, WrappedKey: string(wrapped), Ciphertext: req.Ciphertext})
+	if err != nil {
+		return nil, kmsError(err)
+	}
+	return &kmsV2DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// kmsError maps an operation error to a gRPC status the way errorStatus maps
+// it to an HTTP status.
+func kmsError(err error) error {
+	kind := errorLabel(err)
+	code := codes.Internal
+	switch kind {
+	case "invalid_ciphertext", "unsupported_algorithm", "invalid_key_identifier":
+		code = codes.InvalidArgument
+	case "key_not_found", "key_soft_deleted":
+		code = codes.NotFound
+	case "forbidden", "key_disabled", "key_expired":
+		code = codes.PermissionDenied
+	case "throttled":
+		code = codes.ResourceExhausted
+	case "authentication":
+		code = codes.Unauthenticated
+	case "canceled":
+		code = codes.Canceled
+	default:
+		if IsTemporary(err) {
+			code = codes.Unavailable
+		}
+	}
+	return status.Error(code, kind+": "+err.Error())
+}
+
+func logKMSErrors(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		code := status.Code(err)
+		if code != codes.Canceled {
+			slog.WarnContext(ctx, "kms request failed", slog.String("method", info.FullMethod), slog.String("code", code.String()), slog.String("error", err.Error()))
+		}
+	}
+	return resp, err
+}
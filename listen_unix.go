@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// listenUnix creates the socket at path readable and writable by its owner
+// and group only. The umask is set while the socket is bound rather than
+// chmod-ing it afterwards, so that it is never reachable by others.
+func listenUnix(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0117)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
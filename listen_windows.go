@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "net"
+
+// listenUnix creates the socket at path, which Windows protects with the
+// ACL of its directory.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/logger"
+)
+
+const redacted = "**REDACTED**"
+
+// redactedHeaders never reach the HTTP debug log.
+var redactedHeaders = map[string]bool{
+	"authorization":             true,
+	"ocp-apim-subscription-key": true,
+	"cookie":                    true,
+	"set-cookie":                true,
+}
+
+// redactedFields are the JSON and form fields that can carry plaintext,
+// ciphertext, key material or credentials.
+var redactedFields = map[string]bool{
+	"value":         true,
+	"digest":        true,
+	"k":             true,
+	"d":             true,
+	"dp":            true,
+	"dq":            true,
+	"qi":            true,
+	"p":             true,
+	"q":             true,
+	"key_hsm":       true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"client_secret": true,
+	"assertion":     true,
+	"password":      true,
+}
+
+// SetLogger sets the logger key operations are written to. Successful
+// operations are logged at debug level, failures at warn. A nil logger
+// restores slog.Default.
+func (e *EncryptionClient) SetLogger(l *slog.Logger) {
+	e.logger = l
+}
+
+func (e *EncryptionClient) log() *slog.Logger {
+	if e.logger == nil {
+		return slog.Default()
+	}
+	return e.logger
+}
+
+func (e *EncryptionClient) logOperation(op *keyOperation, err error) {
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	l := e.log()
+	if !l.Enabled(op.ctx, level) {
+		return
+	}
+
+	op.mu.Lock()
+	requestIDs := append([]string(nil), op.requestIDs...)
+	op.mu.Unlock()
+
+	attrs := []slog.Attr{
+		slog.String("operation", op.name),
+		slog.String("key_id", e.kvInfo.keyID()),
+		slog.Duration("duration", time.Since(op.start)),
+		slog.Int("payload_bytes", op.payloadSize),
+		slog.Any("request_ids", requestIDs),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("outcome", "error"), slog.String("error_kind", errorLabel(err)), slog.String("error", err.Error()))
+	} else {
+		attrs = append(attrs, slog.String("outcome", "ok"))
+	}
+	l.LogAttrs(op.ctx, level, "key operation", attrs...)
+}
+
+// EnableHTTPLogging routes go-autorest's request and response logging to l at
+// debug level. Bearer tokens, client secrets and every field that can carry
+// plaintext, ciphertext or key material are redacted before they are logged.
+func EnableHTTPLogging(l *slog.Logger) {
+	logger.Instance = redactingHTTPLogger{l}
+}
+
+type redactingHTTPLogger struct {
+	l *slog.Logger
+}
+
+func (r redactingHTTPLogger) Writeln(level logger.LevelType, message string) {
+	r.l.Log(context.Background(), slogLevel(level), message)
+}
+
+func (r redactingHTTPLogger) Writef(level logger.LevelType, format string, a ...interface{}) {
+	r.l.Log(context.Background(), slogLevel(level), fmt.Sprintf(format, a...))
+}
+
+func (r redactingHTTPLogger) WriteRequest(req *http.Request, _ logger.Filter) {
+	if req == nil || !r.l.Enabled(req.Context(), slog.LevelDebug) {
+		return
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	r.l.LogAttrs(req.Context(), slog.LevelDebug, "http request",
+		slog.String("method", req.Method),
+		slog.String("url", redactURL(req.URL)),
+		slog.Any("headers", redactHeaders(req.Header)),
+		slog.String("body", redactBody(body, req.Header.Get("Content-Type"))),
+	)
+}
+
+func (r redactingHTTPLogger) WriteResponse(resp *http.Response, _ logger.Filter) {
+	if resp == nil || !r.l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	var body []byte
+	if resp.Body != nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	attrs := []slog.Attr{
+		slog.Int("status", resp.StatusCode),
+		slog.String("request_id", resp.Header.Get(headerRequestID)),
+		slog.Any("headers", redactHeaders(resp.Header)),
+		slog.String("body", redactBody(body, resp.Header.Get("Content-Type"))),
+	}
+	if resp.Request != nil {
+		attrs = append(attrs, slog.String("method", resp.Request.Method), slog.String("url", redactURL(resp.Request.URL)))
+	}
+	r.l.LogAttrs(context.Background(), slog.LevelDebug, "http response", attrs...)
+}
+
+func slogLevel(level logger.LevelType) slog.Level {
+	switch level {
+	case logger.LogPanic, logger.LogFatal, logger.LogError:
+		return slog.LevelError
+	case logger.LogWarning:
+		return slog.LevelWarn
+	case logger.LogInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	clean := *u
+	clean.User = nil
+	query := clean.Query()
+	for k := range query {
+		if redactedFields[strings.ToLower(k)] {
+			query.Set(k, redacted)
+		}
+	}
+	clean.RawQuery = query.Encode()
+	return clean.String()
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for k, v := range header {
+		if redactedHeaders[strings.ToLower(k)] {
+			headers[k] = redacted
+			continue
+		}
+		headers[k] = strings.Join(v, ", ")
+	}
+	return headers
+}
+
+// redactBody returns body with sensitive fields replaced. Bodies that are
+// neither JSON nor form encoded are summarized by their size only.
+func redactBody(body []byte, contentType string) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err == nil {
+		switch doc.(type) {
+		case map[string]interface{}, []interface{}:
+			if b, err := json.Marshal(redactJSON(doc)); err == nil {
+				return string(b)
+			}
+		}
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for k := range form {
+				if redactedFields[strings.ToLower(k)] {
+					form.Set(k, redacted)
+				}
+			}
+			return form.Encode()
+		}
+	}
+
+	return fmt.Sprintf("<%d bytes>", len(body))
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if redactedFields[strings.ToLower(k)] {
+				t[k] = redacted
+			} else {
+				t[k] = redactJSON(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = redactJSON(child)
+		}
+	}
+	return v
+}
+
+// NewLogger builds a logger writing to w as configured.
+func NewLogger(w io.Writer, configuration LoggingConfiguration) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(configuration.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", configuration.Level, err)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch configuration.Format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, errors.New("log format must be text or json: " + configuration.Format)
+}
@@ -2,11 +2,122 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
 )
 
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+	// writesData is set for commands whose standard output is data, such as
+	// a stream or git's filter protocol, rather than messages.
+	writesData bool
+}
+
+var commands = []command{
+	{"replicate", "replicate the configured key into another vault", runReplicate, false},
+	{"deleted", "list, recover or purge soft-deleted keys", runDeleted, false},
+	{"doctor", "check configuration, connectivity and key capabilities", runDoctor, false},
+	{"serve", "serve encrypt, decrypt, sign, verify and rewrap over HTTP", runServe, false},
+	{"tf-backend", "serve a Terraform HTTP backend storing state encrypted", runTerraformBackend, false},
+	{"file", "encrypt, decrypt or edit the values of a YAML, JSON or dotenv file", runFile, true},
+	{"csv", "encrypt or decrypt columns of a CSV file", runCSV, true},
+	{"stream", "encrypt or decrypt data of any size as a stream", runStream, true},
+	{"archive", "create, extract or list a signed, encrypted archive of a directory", runArchive, true},
+	{"git-filter", "clean, smudge or diff files for git, as configured by git-init", runGitFilter, true},
+	{"git-init", "set up a git repository to commit matching files encrypted", runGitInit, false},
+	{"exec", "run a command with the encrypted values of its environment decrypted", runExec, true},
+	{"kms-plugin", "serve or check the Kubernetes KMS provider for etcd encryption", runKMSPlugin, false},
+}
+
 func main() {
-	println("Start!")
+	if len(os.Args) < 2 {
+		runDemo()
+		return
+	}
+
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := runCommand(c)
+		var status exitStatus
+		if errors.As(err, &status) {
+			os.Exit(int(status))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kvcrypt %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	printUsage()
+	if name != "help" && name != "-h" && name != "--help" {
+		os.Exit(2)
+	}
+}
+
+func runCommand(c command) error {
+	if err := configureLogging(); err != nil {
+		return err
+	}
+
+	tracingConfiguration, err := ParseTracingEnvironment()
+	if err != nil {
+		return err
+	}
+	if c.writesData && tracingConfiguration.Exporter == "stdout" {
+		return fmt.Errorf("KVCRYPT_TRACE_EXPORTER=stdout would mix spans into the output of %s: use stderr or ocagent", c.name)
+	}
+	flush, err := EnableTracing(tracingConfiguration)
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	if metricsConfiguration := ParseMetricsEnvironment(); metricsConfiguration.Address != "" {
+		stop, err := ServeMetrics(metricsConfiguration.Address)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	return c.run(os.Args[2:])
+}
+
+func configureLogging() error {
+	loggingConfiguration := ParseLoggingEnvironment()
+	l, err := NewLogger(os.Stderr, loggingConfiguration)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	if loggingConfiguration.HTTP {
+		EnableHTTPLogging(l)
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: kvcrypt <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.description)
+	}
+}
+
+func runDemo() {
+	if err := configureLogging(); err != nil {
+		panic(err)
+	}
+	slog.Info("start")
 
 	ctx := context.Background()
 
@@ -21,13 +132,11 @@ func main() {
 	}
 
 	msg := "this a (not so) random text!"
-	fmt.Printf("msg: %s\n", msg)
 
 	encryptedText, err := client.Encrypt(ctx, []byte(msg))
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("enc: %s\n", *encryptedText)
 
 	decryptedText, err := client.Decrypt(ctx, encryptedText)
 	if err != nil {
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestRunCommandRefusesStdoutSpansWithData(t *testing.T) {
+	t.Setenv("KVCRYPT_TRACE_EXPORTER", "stdout")
+	ran := false
+	c := command{name: "stream", run: func([]string) error { ran = true; return nil }, writesData: true}
+	if err := runCommand(c); err == nil {
+		t.Error("stdout exporter accepted for a command writing data to stdout")
+	}
+	if ran {
+		t.Error("command ran with spans going to its output")
+	}
+}
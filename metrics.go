@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	measureLatency        = stats.Float64("kvcrypt/operation_latency", "Latency of key operations", stats.UnitMilliseconds)
+	measureBytes          = stats.Int64("kvcrypt/operation_bytes", "Payload bytes processed by key operations", stats.UnitBytes)
+	measureErrors         = stats.Int64("kvcrypt/operation_errors", "Failed key operations", stats.UnitDimensionless)
+	measureThrottled      = stats.Int64("kvcrypt/throttled", "Key Vault responses with status 429", stats.UnitDimensionless)
+	measureTokenRefreshes = stats.Int64("kvcrypt/token_refreshes", "Azure AD token acquisitions", stats.UnitDimensionless)
+	measureCacheLookups   = stats.Int64("kvcrypt/cache_lookups", "Local cache lookups", stats.UnitDimensionless)
+
+	tagOperation = mustTagKey("operation")
+	tagOutcome   = mustTagKey("outcome")
+	tagError     = mustTagKey("error")
+	tagCache     = mustTagKey("cache")
+	tagResult    = mustTagKey("result")
+)
+
+// MetricViews are the OpenCensus views recorded by EncryptionClient. Register
+// them with RegisterMetricViews, or with view.Register alongside your own views.
+var MetricViews = []*view.View{
+	{
+		Name:        "kvcrypt/operation_latency",
+		Description: "Latency of key operations in milliseconds",
+		Measure:     measureLatency,
+		TagKeys:     []tag.Key{tagOperation, tagOutcome},
+		Aggregation: view.Distribution(5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+	},
+	{
+		Name:        "kvcrypt/operation_bytes_total",
+		Description: "Payload bytes processed by key operations",
+		Measure:     measureBytes,
+		TagKeys:     []tag.Key{tagOperation},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "kvcrypt/operation_errors_total",
+		Description: "Failed key operations by error kind",
+		Measure:     measureErrors,
+		TagKeys:     []tag.Key{tagOperation, tagError},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "kvcrypt/throttled_total",
+		Description: "Key Vault responses with status 429, including retried ones",
+		Measure:     measureThrottled,
+		TagKeys:     []tag.Key{tagOperation},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "kvcrypt/token_refreshes_total",
+		Description: "Azure AD token acquisitions",
+		Measure:     measureTokenRefreshes,
+		TagKeys:     []tag.Key{tagOutcome},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "kvcrypt/cache_lookups_total",
+		Description: "Local cache lookups by result; the hit ratio is hits over all lookups",
+		Measure:     measureCacheLookups,
+		TagKeys:     []tag.Key{tagCache, tagResult},
+		Aggregation: view.Count(),
+	},
+}
+
+// errorLabels names the typed errors in the error tag, most specific first.
+var errorLabels = []struct {
+	err   error
+	label string
+}{
+	{ErrAuthentication, "authentication"},
+	{ErrForbidden, "forbidden"},
+	{ErrKeyDisabled, "key_disabled"},
+	{ErrKeyExpired, "key_expired"},
+	{ErrKeyNotFound, "key_not_found"},
+	{ErrThrottled, "throttled"},
+	{ErrInvalidCiphertext, "invalid_ciphertext"},
+	{ErrUnsupportedAlgorithm, "unsupported_algorithm"},
+	{ErrInvalidKeyIdentifier, "invalid_key_identifier"},
+}
+
+// RegisterMetricViews registers MetricViews with OpenCensus.
+func RegisterMetricViews() error {
+	return view.Register(MetricViews...)
+}
+
+func mustTagKey(name string) tag.Key {
+	k, err := tag.NewKey(name)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func errorLabel(err error) string {
+	var softDeleted *KeySoftDeletedError
+	if errors.As(err, &softDeleted) {
+		return "key_soft_deleted"
+	}
+	for _, l := range errorLabels {
+		if errors.Is(err, l.err) {
+			return l.label
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "canceled"
+	}
+	return "unknown"
+}
+
+func recordOperation(ctx context.Context, operation string, start time.Time, payloadSize int, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(tagOperation, operation), tag.Upsert(tagError, errorLabel(err))},
+			measureErrors.M(1))
+	}
+
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(tagOperation, operation), tag.Upsert(tagOutcome, outcome)},
+		measureLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+		measureBytes.M(int64(payloadSize)))
+}
+
+func recordThrottled(ctx context.Context, operation string) {
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(tagOperation, operation)}, measureThrottled.M(1))
+}
+
+func recordTokenRefresh(ctx context.Context, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(tagOutcome, outcome)}, measureTokenRefreshes.M(1))
+}
+
+func recordCacheLookup(ctx context.Context, cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(tagCache, cache), tag.Upsert(tagResult, result)}, measureCacheLookups.M(1))
+}
+
+// ServeMetrics registers MetricViews and serves them on address under
+// /metrics until the returned function is called.
+func ServeMetrics(address string) (func(), error) {
+	if err := RegisterMetricViews(); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// MetricsHandler serves the registered views in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, v := range MetricViews {
+			if view.Find(v.Name) == nil {
+				continue
+			}
+			rows, err := view.RetrieveData(v.Name)
+			if err != nil {
+				continue
+			}
+			writePrometheusView(w, v, rows)
+		}
+	})
+}
+
+var prometheusNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+func writePrometheusView(w http.ResponseWriter, v *view.View, rows []*view.Row) {
+	name := prometheusNameRegexp.ReplaceAllString(v.Name, "_")
+
+	metricType := "counter"
+	if v.Aggregation.Type == view.AggTypeDistribution {
+		metricType = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, v.Description, name, metricType)
+
+	sort.Slice(rows, func(i, j int) bool { return prometheusLabels(rows[i].Tags, "") < prometheusLabels(rows[j].Tags, "") })
+	for _, row := range rows {
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			fmt.Fprintf(w, "%s%s %d\n", name, prometheusLabels(row.Tags, ""), data.Value)
+		case *view.SumData:
+			fmt.Fprintf(w, "%s%s %g\n", name, prometheusLabels(row.Tags, ""), data.Value)
+		case *view.LastValueData:
+			fmt.Fprintf(w, "%s%s %g\n", name, prometheusLabels(row.Tags, ""), data.Value)
+		case *view.DistributionData:
+			var cumulative int64
+			for i, bound := range v.Aggregation.Buckets {
+				if i < len(data.CountPerBucket) {
+					cumulative += data.CountPerBucket[i]
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(row.Tags, fmt.Sprintf(`le="%g"`, bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(row.Tags, `le="+Inf"`), data.Count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, prometheusLabels(row.Tags, ""), data.Mean*float64(data.Count))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, prometheusLabels(row.Tags, ""), data.Count)
+		}
+	}
+}
+
+func prometheusLabels(tags []tag.Tag, extra string) string {
+	labels := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(t.Value)
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, t.Key.Name(), value))
+	}
+	if extra != "" {
+		labels = append(labels, extra)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
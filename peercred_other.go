@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, errors.New("unix peer credentials are only supported on linux")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+const (
+	minRSAKeyBits    = 2048
+	expiryWarnWindow = 30 * 24 * time.Hour
+	preflightProbe   = "kvcrypt-preflight"
+)
+
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+type PreflightCheck struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+type PreflightReport struct {
+	KeyID  string
+	Checks []PreflightCheck
+}
+
+func (r *PreflightReport) add(name string, status CheckStatus, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{name, status, fmt.Sprintf(format, args...)})
+}
+
+// OK reports whether no check failed. Warnings do not count as failures.
+func (r *PreflightReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns an error listing the failed checks, or nil.
+func (r *PreflightReport) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if c.Status == CheckFail {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("preflight failed for %s: %s", r.KeyID, strings.Join(failed, "; "))
+}
+
+// NewCheckedEncryptionClient is NewEncryptionClient followed by Preflight. It
+// fails when any preflight check fails, so a misconfigured key is caught at
+// startup rather than on first use.
+func NewCheckedEncryptionClient(ctx context.Context, tenantID, clientID, clientSecret, keyVaultKeyIdentifier string) (*EncryptionClient, *PreflightReport, error) {
+	client, err := NewEncryptionClient(tenantID, clientID, clientSecret, keyVaultKeyIdentifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := client.Preflight(ctx)
+	if err := report.Err(); err != nil {
+		return nil, report, err
+	}
+	return client, report, nil
+}
+
+// Preflight fetches the configured key and checks that it can be used for
+// Encrypt, Decrypt and envelope encryption: key type and size, permitted
+// operations, enabled flag, validity period and, by encrypting and wrapping a
+// probe value and reversing both, the caller's permissions.
+func (e *EncryptionClient) Preflight(ctx context.Context) *PreflightReport {
+	report := &PreflightReport{KeyID: e.kvInfo.keyID()}
+
+	bundle, err := e.kvClient.GetKey(ctx, e.kvInfo.vaultURL, e.kvInfo.keyName, e.kvInfo.keyVersion)
+	if err != nil {
+		err = wrapKeyOperationError("get key", err)
+		if errors.Is(err, ErrForbidden) {
+			report.add("get", CheckWarn, "no 'get' permission, key properties cannot be checked")
+		} else {
+			report.add("get", CheckFail, "%v", err)
+		}
+	} else {
+		report.add("get", CheckOK, "key found")
+		checkKeyBundle(report, bundle, time.Now())
+	}
+
+	e.checkPermissions(ctx, report)
+	return report
+}
+
+func checkKeyBundle(report *PreflightReport, bundle keyvault.KeyBundle, now time.Time) {
+	key := bundle.Key
+	if key == nil {
+		report.add("key", CheckFail, "vault returned no key material")
+		return
+	}
+	if key.Kid != nil {
+		report.KeyID = *key.Kid
+	}
+
+	switch key.Kty {
+	case keyvault.RSA, keyvault.RSAHSM:
+		report.add("type", CheckOK, "%s", key.Kty)
+	default:
+		report.add("type", CheckFail, "%s keys do not support %s", key.Kty, keyvault.RSAOAEP256)
+	}
+
+	if key.N != nil {
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*key.N, "="))
+		bits := new(big.Int).SetBytes(n).BitLen()
+		switch {
+		case err != nil:
+			report.add("size", CheckWarn, "cannot decode modulus: %v", err)
+		case bits < minRSAKeyBits:
+			report.add("size", CheckFail, "%d bits, at least %d required", bits, minRSAKeyBits)
+		default:
+			report.add("size", CheckOK, "%d bits", bits)
+		}
+	}
+
+	ops := map[string]bool{}
+	if key.KeyOps != nil {
+		for _, op := range *key.KeyOps {
+			ops[op] = true
+		}
+	}
+	// envelope encryption, which every file, stream and field format uses,
+	// needs wrapKey and unwrapKey
+	var missing []string
+	for _, op := range []keyvault.JSONWebKeyOperation{keyvault.Encrypt, keyvault.Decrypt, keyvault.WrapKey, keyvault.UnwrapKey} {
+		if !ops[string(op)] {
+			missing = append(missing, string(op))
+		}
+	}
+	if len(missing) > 0 {
+		report.add("key_ops", CheckFail, "key does not allow %s", strings.Join(missing, ", "))
+	} else {
+		report.add("key_ops", CheckOK, "encrypt, decrypt, wrapKey and unwrapKey allowed")
+	}
+
+	attributes := bundle.Attributes
+	if attributes == nil {
+		attributes = &keyvault.KeyAttributes{}
+	}
+	if attributes.Enabled != nil && !*attributes.Enabled {
+		report.add("enabled", CheckFail, "key is disabled")
+	} else {
+		report.add("enabled", CheckOK, "key is enabled")
+	}
+
+	nbf, exp := unixTimeToTime(attributes.NotBefore), unixTimeToTime(attributes.Expires)
+	switch {
+	case nbf != nil && now.Before(*nbf):
+		report.add("validity", CheckFail, "key is not valid before %s", formatTime(nbf))
+	case exp != nil && !now.Before(*exp):
+		report.add("validity", CheckFail, "key expired at %s", formatTime(exp))
+	case exp != nil && exp.Sub(now) < expiryWarnWindow:
+		report.add("validity", CheckWarn, "key expires at %s", formatTime(exp))
+	default:
+		report.add("validity", CheckOK, "nbf %s, exp %s", formatTime(nbf), formatTime(exp))
+	}
+}
+
+func (e *EncryptionClient) checkPermissions(ctx context.Context, report *PreflightReport) {
+	encrypted, err := e.Encrypt(ctx, []byte(preflightProbe))
+	if err != nil {
+		report.add("encrypt", CheckFail, "%v", err)
+		return
+	}
+	report.add("encrypt", CheckOK, "probe encrypted")
+
+	decrypted, err := e.Decrypt(ctx, encrypted)
+	switch {
+	case err != nil:
+		report.add("decrypt", CheckFail, "%v", err)
+	case string(decrypted) != preflightProbe:
+		report.add("decrypt", CheckFail, "probe did not round-trip")
+	default:
+		report.add("decrypt", CheckOK, "probe decrypted")
+	}
+
+	wrapped, keyID, err := e.WrapDataKey(ctx, []byte(preflightProbe))
+	if err != nil {
+		report.add("wrap", CheckFail, "%v", err)
+		return
+	}
+	report.add("wrap", CheckOK, "probe wrapped")
+
+	unwrapped, err := e.UnwrapDataKey(ctx, keyID, wrapped)
+	switch {
+	case err != nil:
+		report.add("unwrap", CheckFail, "%v", err)
+	case string(unwrapped) != preflightProbe:
+		report.add("unwrap", CheckFail, "probe did not round-trip")
+	default:
+		report.add("unwrap", CheckOK, "probe unwrapped")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+func TestCheckKeyBundleRequiresWrapOperations(t *testing.T) {
+	tests := []struct {
+		ops  []string
+		want CheckStatus
+	}{
+		{[]string{"encrypt", "decrypt", "wrapKey", "unwrapKey"}, CheckOK},
+		{[]string{"encrypt", "decrypt"}, CheckFail},
+		{[]string{"encrypt", "decrypt", "wrapKey"}, CheckFail},
+		{[]string{"wrapKey", "unwrapKey"}, CheckFail},
+	}
+	for _, tc := range tests {
+		ops := tc.ops
+		report := &PreflightReport{}
+		checkKeyBundle(report, keyvault.KeyBundle{Key: &keyvault.JSONWebKey{Kty: keyvault.RSA, KeyOps: &ops}}, time.Now())
+		var got CheckStatus
+		for _, c := range report.Checks {
+			if c.Name == "key_ops" {
+				got = c.Status
+			}
+		}
+		if got != tc.want {
+			t.Errorf("key_ops for %v = %q, want %q", tc.ops, got, tc.want)
+		}
+	}
+}
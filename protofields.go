@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Protobuf field encryption seals the string and bytes fields marked with the
+// (kvcrypt.encrypted) option of kvcrypt.proto, anywhere in a message. Each
+// field is replaced by its JSON Envelope, sealed with the field's path from
+// the root message, such as cards[0].number, as additional data. Fields are
+// found through the descriptors protoc-gen-go embeds in generated messages.
+
+// E_Encrypted is the (kvcrypt.encrypted) extension of kvcrypt.proto, written
+// out by hand as protoc-gen-go would generate it.
+var E_Encrypted = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         50800,
+	Name:          "kvcrypt.encrypted",
+	Tag:           "varint,50800,opt,name=encrypted",
+	Filename:      "kvcrypt.proto",
+}
+
+func init() {
+	proto.RegisterExtension(E_Encrypted)
+}
+
+// describedMessage is implemented by messages generated by protoc-gen-go.
+type describedMessage interface {
+	proto.Message
+	Descriptor() ([]byte, []int)
+}
+
+type protoField struct {
+	name      string
+	tag       int
+	index     int          // of the struct field holding the value
+	oneof     reflect.Type // the wrapper type, for fields of a oneof
+	encrypted bool
+}
+
+// protoFieldCache maps message types to their []protoField.
+var protoFieldCache sync.Map
+
+// EncryptProtoFields encrypts every marked field of msg and the messages it
+// holds, under one new data key wrapped by w. Empty fields stay empty. msg is
+// only changed when all fields were encrypted.
+func EncryptProtoFields(ctx context.Context, w KeyWrapper, msg proto.Message) error {
+	clone := proto.Clone(msg)
+	var key *DataKey
+	err := walkProtoFields(clone, "", func(path string, value []byte) ([]byte, error) {
+		if key == nil {
+			var err error
+			if key, err = NewDataKey(ctx, w); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(key.Envelope(value, []byte(path)))
+	})
+	if err != nil {
+		return err
+	}
+	msg.Reset()
+	proto.Merge(msg, clone)
+	return nil
+}
+
+// DecryptProtoFields decrypts every marked field of a message encrypted by
+// EncryptProtoFields. msg is only changed when all fields were decrypted.
+func DecryptProtoFields(ctx context.Context, w KeyWrapper, msg proto.Message) error {
+	clone := proto.Clone(msg)
+	keys := map[string]*DataKey{}
+	err := walkProtoFields(clone, "", func(path string, value []byte) ([]byte, error) {
+		var envelope Envelope
+		if err := json.Unmarshal(value, &envelope); err != nil {
+			return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("%s: %v", path, err)}
+		}
+		cacheKey := envelope.KeyID + "\x00" + envelope.WrappedKey
+		key, ok := keys[cacheKey]
+		if !ok {
+			var err error
+			if key, err = OpenDataKey(ctx, w, envelope.KeyID, envelope.WrappedKey); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			keys[cacheKey] = key
+		}
+		plaintext, err := key.Open(envelope.Ciphertext, []byte(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return plaintext, nil
+	})
+	if err != nil {
+		return err
+	}
+	msg.Reset()
+	proto.Merge(msg, clone)
+	return nil
+}
+
+// walkProtoFields replaces the value of every non-empty marked field in msg
+// and its nested messages with what fn returns for it.
+func walkProtoFields(msg proto.Message, path string, fn func(path string, value []byte) ([]byte, error)) error {
+	fields, err := protoFields(msg)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(msg).Elem()
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if f.oneof != nil {
+			if fv.IsNil() || fv.Elem().Type() != f.oneof {
+				continue
+			}
+			fv = fv.Elem().Elem().Field(0)
+		}
+		fieldPath := f.name
+		if path != "" {
+			fieldPath = path + "." + f.name
+		}
+
+		if f.encrypted {
+			if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+				for i := 0; i < fv.Len(); i++ {
+					if err := replaceProtoValue(fv.Index(i), fieldPath+"["+strconv.Itoa(i)+"]", fn); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := replaceProtoValue(fv, fieldPath, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch fv.Kind() {
+		case reflect.Ptr:
+			if nested, ok := fv.Interface().(proto.Message); ok && !fv.IsNil() {
+				if err := walkProtoFields(nested, fieldPath, fn); err != nil {
+					return err
+				}
+			}
+		case reflect.Slice:
+			for i := 0; i < fv.Len(); i++ {
+				if nested, ok := fv.Index(i).Interface().(proto.Message); ok && !fv.Index(i).IsNil() {
+					if err := walkProtoFields(nested, fieldPath+"["+strconv.Itoa(i)+"]", fn); err != nil {
+						return err
+					}
+				}
+			}
+		case reflect.Map:
+			keys := fv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+			for _, k := range keys {
+				value := fv.MapIndex(k)
+				if nested, ok := value.Interface().(proto.Message); ok && !value.IsNil() {
+					if err := walkProtoFields(nested, fieldPath+"["+strconv.Quote(fmt.Sprint(k))+"]", fn); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// replaceProtoValue replaces the string, *string or []byte v.
+func replaceProtoValue(v reflect.Value, path string, fn func(path string, value []byte) ([]byte, error)) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	var value []byte
+	if v.Kind() == reflect.String {
+		value = []byte(v.String())
+	} else {
+		value = v.Bytes()
+	}
+	if len(value) == 0 {
+		return nil
+	}
+
+	replacement, err := fn(path, value)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(string(replacement))
+	} else {
+		v.SetBytes(replacement)
+	}
+	return nil
+}
+
+// protoFields lists the fields of msg's type, noting which are marked.
+func protoFields(msg proto.Message) ([]protoField, error) {
+	t := reflect.TypeOf(msg)
+	if fields, ok := protoFieldCache.Load(t); ok {
+		return fields.([]protoField), nil
+	}
+
+	described, ok := msg.(describedMessage)
+	if !ok {
+		return nil, fmt.Errorf("%s has no descriptor: only messages generated by protoc-gen-go are supported", t)
+	}
+	md, err := messageDescriptor(described)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", t, err)
+	}
+
+	encrypted := map[int]bool{}
+	for _, fd := range md.Field {
+		if fd.Options == nil {
+			continue
+		}
+		marked, err := proto.GetExtension(fd.Options, E_Encrypted)
+		if err != nil || !*marked.(*bool) {
+			continue
+		}
+		if fd.GetType() != descriptor.FieldDescriptorProto_TYPE_STRING && fd.GetType() != descriptor.FieldDescriptorProto_TYPE_BYTES {
+			return nil, fmt.Errorf("%s.%s: (kvcrypt.encrypted) is only supported on string and bytes fields", md.GetName(), fd.GetName())
+		}
+		encrypted[int(fd.GetNumber())] = true
+	}
+
+	props := proto.GetProperties(t.Elem())
+	var fields []protoField
+	for i, p := range props.Prop {
+		if p.Tag > 0 {
+			fields = append(fields, protoField{name: p.OrigName, tag: p.Tag, index: i, encrypted: encrypted[p.Tag]})
+		}
+	}
+	for _, oneof := range props.OneofTypes {
+		fields = append(fields, protoField{name: oneof.Prop.OrigName, tag: oneof.Prop.Tag, index: oneof.Field, oneof: oneof.Type, encrypted: encrypted[oneof.Prop.Tag]})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	protoFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+// messageDescriptor decodes the descriptor of msg from the gzipped file
+// descriptor it was generated from.
+func messageDescriptor(msg describedMessage) (*descriptor.DescriptorProto, error) {
+	gz, indexes := msg.Descriptor()
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var fd descriptor.FileDescriptorProto
+	if err := proto.Unmarshal(b, &fd); err != nil {
+		return nil, err
+	}
+
+	if len(indexes) == 0 || indexes[0] >= len(fd.MessageType) {
+		return nil, fmt.Errorf("bad descriptor path %v", indexes)
+	}
+	md := fd.MessageType[indexes[0]]
+	for _, i := range indexes[1:] {
+		if i >= len(md.NestedType) {
+			return nil, fmt.Errorf("bad descriptor path %v", indexes)
+		}
+		md = md.NestedType[i]
+	}
+	return md, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/allantargino/key-vault-encrypt-operations/testdata/kvcrypttest"
+)
+
+func testCustomer() *kvcrypttest.Customer {
+	return &kvcrypttest.Customer{
+		Name:    "Ada",
+		Ssn:     "078-05-1120",
+		Photo:   []byte{0x89, 'P', 'N', 'G'},
+		Avatar:  []byte{0x47, 0x49, 0x46},
+		Address: &kvcrypttest.Address{Street: "12 Analytical Row", City: "London"},
+		Cards: []*kvcrypttest.Card{
+			{Number: "4111111111111111", Brand: "visa"},
+			{Number: "5500000000000004", Brand: "mastercard"},
+		},
+		Notes: []string{"first note", "", "third note"},
+		Addresses: map[string]*kvcrypttest.Address{
+			"home": {Street: "1 Home Lane", City: "Bath"},
+			"work": {Street: "2 Work Street", City: "Oxford"},
+		},
+		Contact: &kvcrypttest.Customer_Email{Email: "ada@example.com"},
+	}
+}
+
+func TestProtoFieldsRoundTrip(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	original := testCustomer()
+	msg := testCustomer()
+
+	if err := EncryptProtoFields(ctx, vault, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := []struct {
+		field string
+		value string
+		plain string
+	}{
+		{"ssn", msg.Ssn, original.Ssn},
+		{"photo", string(msg.Photo), string(original.Photo)},
+		{"address.street", msg.Address.Street, original.Address.Street},
+		{"cards[0].number", msg.Cards[0].Number, original.Cards[0].Number},
+		{"cards[1].number", msg.Cards[1].Number, original.Cards[1].Number},
+		{"notes[0]", msg.Notes[0], original.Notes[0]},
+		{"notes[2]", msg.Notes[2], original.Notes[2]},
+		{`addresses["home"].street`, msg.Addresses["home"].Street, original.Addresses["home"].Street},
+		{`addresses["work"].street`, msg.Addresses["work"].Street, original.Addresses["work"].Street},
+		{"email", msg.GetEmail(), original.GetEmail()},
+	}
+	for _, e := range encrypted {
+		if e.value == e.plain || strings.Contains(e.value, e.plain) {
+			t.Errorf("%s left in plaintext: %q", e.field, e.value)
+		}
+	}
+
+	unmarked := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{"name", msg.Name, original.Name},
+		{"avatar", string(msg.Avatar), string(original.Avatar)},
+		{"address.city", msg.Address.City, original.Address.City},
+		{"cards[0].brand", msg.Cards[0].Brand, original.Cards[0].Brand},
+		{"cards[1].brand", msg.Cards[1].Brand, original.Cards[1].Brand},
+		{"notes[1]", msg.Notes[1], ""},
+		{`addresses["home"].city`, msg.Addresses["home"].City, original.Addresses["home"].City},
+		{`addresses["work"].city`, msg.Addresses["work"].City, original.Addresses["work"].City},
+	}
+	for _, u := range unmarked {
+		if u.got != u.want {
+			t.Errorf("unmarked %s = %q, want %q", u.field, u.got, u.want)
+		}
+	}
+
+	if err := DecryptProtoFields(ctx, vault, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(msg, original) {
+		t.Errorf("round trip = %v, want %v", msg, original)
+	}
+}
+
+func TestProtoFieldsUnmarkedOneof(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	msg := &kvcrypttest.Customer{Contact: &kvcrypttest.Customer_Phone{Phone: "+44 20 7946 0000"}}
+
+	if err := EncryptProtoFields(ctx, vault, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetPhone() != "+44 20 7946 0000" {
+		t.Errorf("unmarked oneof field changed to %q", msg.GetPhone())
+	}
+	if err := DecryptProtoFields(ctx, vault, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetPhone() != "+44 20 7946 0000" {
+		t.Errorf("round trip of unmarked oneof field = %q", msg.GetPhone())
+	}
+}
+
+func TestProtoFieldsBoundToPath(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	msg := testCustomer()
+	if err := EncryptProtoFields(ctx, vault, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// a ciphertext moved to another field must not decrypt
+	msg.Cards[0].Number, msg.Cards[1].Number = msg.Cards[1].Number, msg.Cards[0].Number
+	before := proto.Clone(msg)
+	if err := DecryptProtoFields(ctx, vault, msg); err == nil {
+		t.Fatal("swapped ciphertexts decrypted")
+	}
+	if !proto.Equal(msg, before) {
+		t.Error("message changed by a failed decryption")
+	}
+}
+
+func TestProtoFieldsEmptyStayEmpty(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &kvcrypttest.Customer{Name: "Ada"}
+	if err := EncryptProtoFields(context.Background(), vault, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Ssn != "" || !bytes.Equal(msg.Photo, nil) || msg.Contact != nil {
+		t.Errorf("empty fields were filled: %v", msg)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+const (
+	purgeRetries  = 10
+	purgeInterval = 3 * time.Second
+)
+
+type ReplicationActionKind string
+
+const (
+	// ReplicationRestore restores the source key into a target vault that does not have it.
+	ReplicationRestore ReplicationActionKind = "restore"
+	// ReplicationRecreate deletes, purges and restores a target key that is missing versions.
+	ReplicationRecreate ReplicationActionKind = "recreate"
+	// ReplicationUpdate copies the attributes and tags of a version onto the target.
+	ReplicationUpdate ReplicationActionKind = "update"
+	// ReplicationConflict is drift that replication will not resolve on its own.
+	ReplicationConflict ReplicationActionKind = "conflict"
+)
+
+type ReplicationAction struct {
+	Kind    ReplicationActionKind
+	Version string
+	Detail  string
+
+	attributes *keyvault.KeyAttributes
+	tags       map[string]*string
+}
+
+type ReplicationPlan struct {
+	KeyName     string
+	SourceVault string
+	TargetVault string
+	Actions     []ReplicationAction
+}
+
+// InSync reports whether the target vault already matches the source.
+func (p *ReplicationPlan) InSync() bool {
+	return len(p.Actions) == 0
+}
+
+// Conflicts returns the actions that Apply will not resolve.
+func (p *ReplicationPlan) Conflicts() []ReplicationAction {
+	var conflicts []ReplicationAction
+	for _, a := range p.Actions {
+		if a.Kind == ReplicationConflict {
+			conflicts = append(conflicts, a)
+		}
+	}
+	return conflicts
+}
+
+// PlanReplication compares the configured key with the key of the same name in
+// targetVaultURL and returns the changes needed to make the target match. Restoring
+// over an existing key is not supported by Key Vault, so when the target is missing
+// versions the key has to be recreated; this only happens with allowRecreate.
+func (e *EncryptionClient) PlanReplication(ctx context.Context, targetVaultURL string, allowRecreate bool) (*ReplicationPlan, error) {
+	plan := &ReplicationPlan{
+		KeyName:     e.kvInfo.keyName,
+		SourceVault: e.kvInfo.vaultURL,
+		TargetVault: targetVaultURL,
+	}
+	if strings.EqualFold(plan.SourceVault, plan.TargetVault) {
+		return nil, fmt.Errorf("source and target vault are the same: %s", plan.SourceVault)
+	}
+
+	source, err := e.listKeyVersions(ctx, plan.SourceVault, plan.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	if len(source) == 0 {
+		return nil, fmt.Errorf("key %s not found in %s", plan.KeyName, plan.SourceVault)
+	}
+
+	target, err := e.listKeyVersions(ctx, plan.TargetVault, plan.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	if len(target) == 0 {
+		plan.Actions = append(plan.Actions, ReplicationAction{
+			Kind:   ReplicationRestore,
+			Detail: fmt.Sprintf("key does not exist in target, restoring %d version(s)", len(source)),
+		})
+		return plan, nil
+	}
+
+	missing := versionsNotIn(source, target)
+	targetOnly := versionsNotIn(target, source)
+	// updates cannot clear a date, only recreating the key does
+	var uncleared []string
+	for _, version := range sortedVersions(source) {
+		if tgt := target[version]; tgt.Kid != nil && len(clearedDates(source[version], tgt)) > 0 {
+			uncleared = append(uncleared, version)
+		}
+	}
+
+	var reasons []string
+	if len(missing) > 0 {
+		reasons = append(reasons, fmt.Sprintf("target is missing version(s) %s", strings.Join(missing, ", ")))
+	}
+	if len(uncleared) > 0 {
+		reasons = append(reasons, fmt.Sprintf("target version(s) %s have dates the source does not, which cannot be cleared", strings.Join(uncleared, ", ")))
+	}
+	recreate := len(reasons) > 0 && allowRecreate && len(targetOnly) == 0
+	if len(reasons) > 0 {
+		reason := strings.Join(reasons, "; ")
+		kind := ReplicationConflict
+		detail := reason + "; re-run with recreate allowed to replace it"
+		switch {
+		case recreate:
+			kind = ReplicationRecreate
+			detail = reason
+		case allowRecreate:
+			// recreating purges the target key, and with it every version
+			// only the target has
+			detail = reason + ", but recreating it would destroy the version(s) only it has"
+		}
+		plan.Actions = append(plan.Actions, ReplicationAction{Kind: kind, Detail: detail})
+	}
+
+	for _, version := range targetOnly {
+		plan.Actions = append(plan.Actions, ReplicationAction{
+			Kind:    ReplicationConflict,
+			Version: version,
+			Detail:  "version exists only in target",
+		})
+	}
+
+	if recreate {
+		// the restored key takes its attributes from the backup
+		return plan, nil
+	}
+
+	for _, version := range sortedVersions(source) {
+		src, tgt := source[version], target[version]
+		if tgt.Kid == nil {
+			continue
+		}
+		// dates that cannot be cleared are reported as a conflict above
+		diffs := withoutDiffs(keyItemDiff(src, tgt), clearedDates(src, tgt))
+		if len(diffs) == 0 {
+			continue
+		}
+		plan.Actions = append(plan.Actions, ReplicationAction{
+			Kind:       ReplicationUpdate,
+			Version:    version,
+			Detail:     strings.Join(diffs, ", "),
+			attributes: src.Attributes,
+			tags:       src.Tags,
+		})
+	}
+
+	return plan, nil
+}
+
+// ApplyReplication performs the restore, recreate and update actions of plan.
+// Conflicts are left untouched.
+func (e *EncryptionClient) ApplyReplication(ctx context.Context, plan *ReplicationPlan) error {
+	for _, a := range plan.Actions {
+		var err error
+		switch a.Kind {
+		case ReplicationRestore:
+			err = e.restoreKey(ctx, plan)
+		case ReplicationRecreate:
+			err = e.recreateKey(ctx, plan)
+		case ReplicationUpdate:
+			// nil tags would be left out of the request, keeping the
+			// target's
+			tags := a.tags
+			if tags == nil {
+				tags = map[string]*string{}
+			}
+			parameters := keyvault.KeyUpdateParameters{Tags: tags}
+			if a.attributes != nil {
+				parameters.KeyAttributes = &keyvault.KeyAttributes{
+					Enabled:   a.attributes.Enabled,
+					NotBefore: a.attributes.NotBefore,
+					Expires:   a.attributes.Expires,
+				}
+			}
+			_, err = e.kvClient.UpdateKey(ctx, plan.TargetVault, plan.KeyName, a.Version, parameters)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", a.Kind, plan.KeyName, err)
+		}
+	}
+	return nil
+}
+
+func (e *EncryptionClient) restoreKey(ctx context.Context, plan *ReplicationPlan) error {
+	backup, err := e.kvClient.BackupKey(ctx, plan.SourceVault, plan.KeyName)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.kvClient.RestoreKey(ctx, plan.TargetVault, keyvault.KeyRestoreParameters{KeyBundleBackup: backup.Value})
+	return err
+}
+
+func (e *EncryptionClient) recreateKey(ctx context.Context, plan *ReplicationPlan) error {
+	purge, err := e.checkRecreate(ctx, plan)
+	if err != nil {
+		return err
+	}
+	if _, err := e.kvClient.DeleteKey(ctx, plan.TargetVault, plan.KeyName); err != nil {
+		return err
+	}
+	if !purge {
+		return e.restoreKey(ctx, plan)
+	}
+
+	// deletion completes asynchronously, so the purge conflicts until it is done
+	for i := 0; ; i++ {
+		_, err := e.kvClient.PurgeDeletedKey(ctx, plan.TargetVault, plan.KeyName)
+		if err == nil {
+			break
+		}
+		status := responseStatusCode(err)
+		if status != http.StatusConflict && status != http.StatusNotFound || i == purgeRetries {
+			return fmt.Errorf("target key was deleted but not purged, restore it or purge it by hand: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(purgeInterval):
+		}
+	}
+
+	return e.restoreKey(ctx, plan)
+}
+
+// checkRecreate makes sure the target key can be deleted and restored before
+// anything is deleted, and reports whether it has to be purged in between:
+// a key left soft-deleted would make the restore conflict and leave the
+// target without a key.
+func (e *EncryptionClient) checkRecreate(ctx context.Context, plan *ReplicationPlan) (purge bool, err error) {
+	bundle, err := e.kvClient.GetKey(ctx, plan.TargetVault, plan.KeyName, "")
+	if err != nil {
+		return false, err
+	}
+	var level keyvault.DeletionRecoveryLevel
+	if bundle.Attributes != nil {
+		level = bundle.Attributes.RecoveryLevel
+	}
+	switch level {
+	case keyvault.Purgeable:
+		// no soft-delete: deleting the key is enough
+		return false, nil
+	case keyvault.RecoverablePurgeable:
+	default:
+		return false, fmt.Errorf("target key has recovery level %q: it could not be purged once deleted, so it cannot be recreated", level)
+	}
+
+	// purging a key that does not exist fails with 404 when the caller may
+	// purge, and 403 when it may not
+	probe := "kvcrypt-purge-probe-" + strings.ToLower(fmt.Sprintf("%x", time.Now().UnixNano()))
+	_, err = e.kvClient.PurgeDeletedKey(ctx, plan.TargetVault, probe)
+	switch responseStatusCode(err) {
+	case http.StatusNotFound:
+		return true, nil
+	case http.StatusForbidden:
+		return false, fmt.Errorf("no purge permission on %s, which recreating the key needs: %v", plan.TargetVault, err)
+	}
+	if err == nil {
+		return true, nil
+	}
+	return false, err
+}
+
+func (e *EncryptionClient) listKeyVersions(ctx context.Context, vaultURL, keyName string) (map[string]keyvault.KeyItem, error) {
+	versions := make(map[string]keyvault.KeyItem)
+
+	iter, err := e.kvClient.GetKeyVersionsComplete(ctx, vaultURL, keyName, nil)
+	if responseStatusCode(err) == http.StatusNotFound {
+		return versions, nil
+	}
+	for ; err == nil && iter.NotDone(); err = iter.NextWithContext(ctx) {
+		item := iter.Value()
+		if item.Kid != nil {
+			versions[keyVersionFromID(*item.Kid)] = item
+		}
+	}
+	if responseStatusCode(err) == http.StatusNotFound {
+		return versions, nil
+	}
+	return versions, err
+}
+
+func keyItemDiff(src, tgt keyvault.KeyItem) []string {
+	var diffs []string
+
+	srcAttr, tgtAttr := src.Attributes, tgt.Attributes
+	if srcAttr == nil {
+		srcAttr = &keyvault.KeyAttributes{}
+	}
+	if tgtAttr == nil {
+		tgtAttr = &keyvault.KeyAttributes{}
+	}
+	if formatBool(srcAttr.Enabled) != formatBool(tgtAttr.Enabled) {
+		diffs = append(diffs, fmt.Sprintf("enabled: %s -> %s", formatBool(tgtAttr.Enabled), formatBool(srcAttr.Enabled)))
+	}
+	if formatUnixTime(srcAttr.NotBefore) != formatUnixTime(tgtAttr.NotBefore) {
+		diffs = append(diffs, fmt.Sprintf("nbf: %s -> %s", formatUnixTime(tgtAttr.NotBefore), formatUnixTime(srcAttr.NotBefore)))
+	}
+	if formatUnixTime(srcAttr.Expires) != formatUnixTime(tgtAttr.Expires) {
+		diffs = append(diffs, fmt.Sprintf("exp: %s -> %s", formatUnixTime(tgtAttr.Expires), formatUnixTime(srcAttr.Expires)))
+	}
+	if formatTags(src.Tags) != formatTags(tgt.Tags) {
+		diffs = append(diffs, fmt.Sprintf("tags: %s -> %s", formatTags(tgt.Tags), formatTags(src.Tags)))
+	}
+
+	return diffs
+}
+
+// clearedDates names the dates tgt has and src does not, which an update
+// cannot clear since unset dates are left out of the request.
+func clearedDates(src, tgt keyvault.KeyItem) []string {
+	srcAttr, tgtAttr := src.Attributes, tgt.Attributes
+	if srcAttr == nil {
+		srcAttr = &keyvault.KeyAttributes{}
+	}
+	if tgtAttr == nil {
+		return nil
+	}
+	var cleared []string
+	if srcAttr.NotBefore == nil && tgtAttr.NotBefore != nil {
+		cleared = append(cleared, "nbf")
+	}
+	if srcAttr.Expires == nil && tgtAttr.Expires != nil {
+		cleared = append(cleared, "exp")
+	}
+	return cleared
+}
+
+// withoutDiffs drops the differences of keyItemDiff about the given fields.
+func withoutDiffs(diffs, fields []string) []string {
+	var kept []string
+	for _, d := range diffs {
+		if !containsString(fields, d[:strings.IndexByte(d, ':')]) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func versionsNotIn(a, b map[string]keyvault.KeyItem) []string {
+	var versions []string
+	for _, v := range sortedVersions(a) {
+		if _, ok := b[v]; !ok {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+func sortedVersions(items map[string]keyvault.KeyItem) []string {
+	versions := make([]string, 0, len(items))
+	for v := range items {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func keyVersionFromID(kid string) string {
+	return kid[strings.LastIndex(kid, "/")+1:]
+}
+
+func responseStatusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var detailed autorest.DetailedError
+	if errors.As(err, &detailed) {
+		if status, ok := detailed.StatusCode.(int); ok {
+			return status
+		}
+	}
+	return 0
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%t", *b)
+}
+
+func formatUnixTime(t *date.UnixTime) string {
+	return formatTime(unixTimeToTime(t))
+}
+
+func formatTags(tags map[string]*string) string {
+	if len(tags) == 0 {
+		return "{}"
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		value := ""
+		if v != nil {
+			value = *v
+		}
+		pairs = append(pairs, k+"="+value)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// replicationVault serves the versions of one key and records updates.
+type replicationVault struct {
+	versions      []map[string]interface{}
+	recoveryLevel string
+	purgeStatus   int
+
+	mu      sync.Mutex
+	updates map[string]map[string]interface{}
+	deleted bool
+}
+
+func (v *replicationVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/versions"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": v.versions})
+	case r.Method == http.MethodGet && r.URL.Path == "/keys/k/":
+		json.NewEncoder(w).Encode(map[string]interface{}{"attributes": map[string]interface{}{"recoveryLevel": v.recoveryLevel}})
+	case r.Method == http.MethodDelete && r.URL.Path == "/keys/k":
+		v.mu.Lock()
+		v.deleted = true
+		v.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/deletedkeys/"):
+		w.WriteHeader(v.purgeStatus)
+	case r.Method == http.MethodPatch:
+		body, _ := ioutil.ReadAll(r.Body)
+		var update map[string]interface{}
+		json.Unmarshal(body, &update)
+		v.mu.Lock()
+		if v.updates == nil {
+			v.updates = map[string]map[string]interface{}{}
+		}
+		v.updates[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]] = update
+		v.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func replicationTestClient(t *testing.T, source, target *replicationVault) (*EncryptionClient, string) {
+	sourceServer := httptest.NewServer(source)
+	t.Cleanup(sourceServer.Close)
+	targetServer := httptest.NewServer(target)
+	t.Cleanup(targetServer.Close)
+
+	kv := keyvault.New()
+	kv.Authorizer = autorest.NullAuthorizer{}
+	return &EncryptionClient{kvClient: &kv, kvInfo: &KeyVaultKeyInfo{vaultURL: sourceServer.URL, keyName: "k"}}, targetServer.URL
+}
+
+func keyVersion(version string, attributes map[string]interface{}, tags map[string]string) map[string]interface{} {
+	item := map[string]interface{}{"kid": "https://v.vault.azure.net/keys/k/" + version, "attributes": attributes}
+	if tags != nil {
+		item["tags"] = tags
+	}
+	return item
+}
+
+func TestReplicationClearsTags(t *testing.T) {
+	source := &replicationVault{versions: []map[string]interface{}{
+		keyVersion("v1", map[string]interface{}{"enabled": true}, nil),
+	}}
+	target := &replicationVault{versions: []map[string]interface{}{
+		keyVersion("v1", map[string]interface{}{"enabled": true}, map[string]string{"stale": "yes"}),
+	}}
+	client, targetURL := replicationTestClient(t, source, target)
+	ctx := context.Background()
+
+	plan, err := client.PlanReplication(ctx, targetURL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 1 || plan.Actions[0].Kind != ReplicationUpdate {
+		t.Fatalf("actions = %+v, want one update", plan.Actions)
+	}
+	if err := client.ApplyReplication(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+	tags, ok := target.updates["v1"]["tags"]
+	if !ok {
+		t.Fatalf("update %v leaves the target's tags alone", target.updates["v1"])
+	}
+	if len(tags.(map[string]interface{})) != 0 {
+		t.Errorf("update sets tags %v, want none", tags)
+	}
+}
+
+func TestReplicationDateThatCannotBeCleared(t *testing.T) {
+	source := &replicationVault{versions: []map[string]interface{}{
+		keyVersion("v1", map[string]interface{}{"enabled": true}, map[string]string{"a": "1"}),
+	}}
+	target := &replicationVault{versions: []map[string]interface{}{
+		keyVersion("v1", map[string]interface{}{"enabled": true, "exp": 1900000000}, nil),
+	}}
+	client, targetURL := replicationTestClient(t, source, target)
+	ctx := context.Background()
+
+	plan, err := client.PlanReplication(ctx, targetURL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, a := range plan.Actions {
+		kinds = append(kinds, string(a.Kind))
+		if a.Kind == ReplicationUpdate && strings.Contains(a.Detail, "exp") {
+			t.Errorf("update %q cannot clear exp", a.Detail)
+		}
+	}
+	if strings.Join(kinds, ",") != "conflict,update" {
+		t.Errorf("actions = %+v, want a conflict and the tag update", plan.Actions)
+	}
+
+	plan, err = client.PlanReplication(ctx, targetURL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 1 || plan.Actions[0].Kind != ReplicationRecreate {
+		t.Errorf("actions with recreate allowed = %+v, want one recreate", plan.Actions)
+	}
+}
+
+func TestRecreateChecksPurgeFirst(t *testing.T) {
+	source := &replicationVault{versions: []map[string]interface{}{
+		keyVersion("v1", map[string]interface{}{"enabled": true}, nil),
+		keyVersion("v2", map[string]interface{}{"enabled": true}, nil),
+	}}
+	for _, tc := range []struct {
+		name          string
+		recoveryLevel string
+		purgeStatus   int
+	}{
+		{"no purge permission", "Recoverable+Purgeable", http.StatusForbidden},
+		{"purge protection", "Recoverable", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := &replicationVault{
+				versions:      []map[string]interface{}{keyVersion("v1", map[string]interface{}{"enabled": true}, nil)},
+				recoveryLevel: tc.recoveryLevel,
+				purgeStatus:   tc.purgeStatus,
+			}
+			client, targetURL := replicationTestClient(t, source, target)
+			ctx := context.Background()
+
+			plan, err := client.PlanReplication(ctx, targetURL, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Actions) != 1 || plan.Actions[0].Kind != ReplicationRecreate {
+				t.Fatalf("actions = %+v, want one recreate", plan.Actions)
+			}
+			if err := client.ApplyReplication(ctx, plan); err == nil {
+				t.Error("recreate succeeded")
+			}
+			if target.deleted {
+				t.Error("target key deleted before the purge was known to work")
+			}
+		})
+	}
+}
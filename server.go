@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultProfile         = "default"
+	defaultMaxRequestBytes = 64 << 10
+	// maxEncryptPlaintext is the most RSA-OAEP-256 encrypts under the
+	// smallest key preflight accepts: /v1/encrypt encrypts with the key
+	// itself, so larger plaintexts are refused before calling Key Vault.
+	maxEncryptPlaintext = minRSAKeyBits/8 - 2*sha256.Size - 2
+)
+
+// EncryptionServer exposes EncryptionClient over HTTP for callers that cannot
+// link this package. Every request names a key profile; requests without one
+// use the "default" profile.
+type EncryptionServer struct {
+	profiles        map[string]*EncryptionClient
+	maxRequestBytes int64
+	ready           int32
+	policy          *CallerPolicy
+	audit           *slog.Logger
+	tlsConfig       *tls.Config
+}
+
+func NewEncryptionServer(profiles map[string]*EncryptionClient, maxRequestBytes int64) *EncryptionServer {
+	if maxRequestBytes <= 0 {
+		maxRequestBytes = defaultMaxRequestBytes
+	}
+	return &EncryptionServer{profiles: profiles, maxRequestBytes: maxRequestBytes}
+}
+
+type encryptRequest struct {
+	Profile   string `json:"profile"`
+	Plaintext []byte `json:"plaintext"`
+}
+
+type encryptResponse struct {
+	Ciphertext string `json:"ciphertext"`
+	KeyID      string `json:"key_id"`
+}
+
+type decryptRequest struct {
+	Profile    string `json:"profile"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type decryptResponse struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+// signRequest carries either the SHA-256 digest to sign or the data to hash.
+type signRequest struct {
+	Profile   string `json:"profile"`
+	Digest    []byte `json:"digest"`
+	Data      []byte `json:"data"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type signResponse struct {
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id"`
+}
+
+type verifyResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// rewrapRequest decrypts ciphertext with FromProfile and encrypts it again
+// with Profile, without the plaintext leaving the server.
+type rewrapRequest struct {
+	FromProfile string `json:"from_profile"`
+	Profile     string `json:"profile"`
+	Ciphertext  string `json:"ciphertext"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+// SetPolicy restricts requests to the callers, profiles and operations policy
+// allows. Every decision is written to audit, denials at warn level. Without
+// a policy any caller that can reach the server may use every profile.
+func (s *EncryptionServer) SetPolicy(policy *CallerPolicy, audit *slog.Logger) {
+	s.policy = policy
+	s.audit = audit
+}
+
+// SetTLSConfig serves over TLS. Callers are identified by their client
+// certificate when config verifies one.
+func (s *EncryptionServer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetReady marks the server as ready, or not, to take traffic on /readyz.
+func (s *EncryptionServer) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *EncryptionServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/v1/encrypt", s.operation("encrypt", s.encrypt))
+	mux.Handle("/v1/decrypt", s.operation("decrypt", s.decrypt))
+	mux.Handle("/v1/sign", s.operation("sign", s.sign))
+	mux.Handle("/v1/verify", s.operation("verify", s.verify))
+	mux.Handle("/v1/rewrap", s.operation("rewrap", s.rewrap))
+	return mux
+}
+
+type operationFunc func(ctx context.Context, body []byte) (interface{}, error)
+
+func (s *EncryptionServer) operation(name string, fn operationFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Errorf("%s requires POST", r.URL.Path))
+			return
+		}
+
+		body, err := readLimited(w, r, s.maxRequestBytes)
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", err)
+			return
+		}
+
+		response, err := fn(r.Context(), body)
+		if err != nil {
+			status, kind := errorStatus(err)
+			if status >= http.StatusInternalServerError {
+				// the details stay in the server log
+				slog.WarnContext(r.Context(), "operation failed", slog.String("operation", name), slog.String("error", err.Error()))
+				err = errors.New(strings.ToLower(http.StatusText(status)))
+			}
+			var opErr *KeyOperationError
+			if errors.As(err, &opErr) && opErr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(opErr.RetryAfter.Seconds())))
+			}
+			writeError(w, status, kind, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// client returns the client for profile once the caller is authorized to run
+// operation with it.
+func (s *EncryptionServer) client(ctx context.Context, operation, profile string) (*EncryptionClient, error) {
+	if profile == "" {
+		profile = defaultProfile
+	}
+	client, ok := s.profiles[profile]
+	if !ok {
+		return nil, &badRequestError{fmt.Errorf("unknown key profile: %s", profile)}
+	}
+	if err := s.authorize(ctx, operation, profile); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s *EncryptionServer) authorize(ctx context.Context, operation, profile string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	caller := callerFromContext(ctx)
+	allowed, rule := s.policy.Allows(caller, operation, profile)
+	attrs := []slog.Attr{
+		slog.String("caller", caller.String()),
+		slog.String("operation", operation),
+		slog.String("profile", profile),
+	}
+	if !allowed {
+		s.audit.LogAttrs(ctx, slog.LevelWarn, "denied", attrs...)
+		return &permissionDeniedError{caller: caller.String(), operation: operation, profile: profile}
+	}
+	s.audit.LogAttrs(ctx, slog.LevelInfo, "allowed", append(attrs, slog.String("rule", rule))...)
+	return nil
+}
+
+func (s *EncryptionServer) encrypt(ctx context.Context, body []byte) (interface{}, error) {
+	var req encryptRequest
+	if err := decodeRequest(body, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Plaintext) > maxEncryptPlaintext {
+		return nil, &requestTooLargeError{fmt.Errorf("plaintext is %d bytes, at most %d can be encrypted with the key: encrypt a data key instead", len(req.Plaintext), maxEncryptPlaintext)}
+	}
+	client, err := s.client(ctx, "encrypt", req.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := client.Encrypt(ctx, req.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return encryptResponse{Ciphertext: *ciphertext, KeyID: client.kvInfo.keyID()}, nil
+}
+
+func (s *EncryptionServer) decrypt(ctx context.Context, body []byte) (interface{}, error) {
+	var req decryptRequest
+	if err := decodeRequest(body, &req); err != nil {
+		return nil, err
+	}
+	client, err := s.client(ctx, "decrypt", req.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := client.Decrypt(ctx, &req.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return decryptResponse{Plaintext: plaintext}, nil
+}
+
+func (s *EncryptionServer) sign(ctx context.Context, body []byte) (interface{}, error) {
+	var req signRequest
+	if err := decodeRequest(body, &req); err != nil {
+		return nil, err
+	}
+	client, err := s.client(ctx, "sign", req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := req.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := client.Sign(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	return signResponse{Signature: *signature, KeyID: client.kvInfo.keyID()}, nil
+}
+
+func (s *EncryptionServer) verify(ctx context.Context, body []byte) (interface{}, error) {
+	var req signRequest
+	if err := decodeRequest(body, &req); err != nil {
+		return nil, err
+	}
+	client, err := s.client(ctx, "verify", req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := req.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := client.Verify(ctx, digest, &req.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return verifyResponse{Valid: valid}, nil
+}
+
+func (s *EncryptionServer) rewrap(ctx context.Context, body []byte) (interface{}, error) {
+	var req rewrapRequest
+	if err := decodeRequest(body, &req); err != nil {
+		return nil, err
+	}
+	// rewrapping decrypts with one profile and encrypts with the other, so the
+	// caller needs both permissions
+	from, err := s.client(ctx, "decrypt", req.FromProfile)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.client(ctx, "encrypt", req.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := from.Decrypt(ctx, &req.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := to.Encrypt(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return encryptResponse{Ciphertext: *ciphertext, KeyID: to.kvInfo.keyID()}, nil
+}
+
+func (r *signRequest) digest() ([]byte, error) {
+	switch {
+	case len(r.Digest) > 0 && len(r.Data) > 0:
+		return nil, &badRequestError{errors.New("set either digest or data, not both")}
+	case len(r.Digest) > 0:
+		if len(r.Digest) != sha256.Size {
+			return nil, &badRequestError{fmt.Errorf("digest must be a %d byte SHA-256 hash", sha256.Size)}
+		}
+		return r.Digest, nil
+	case len(r.Data) > 0:
+		sum := sha256.Sum256(r.Data)
+		return sum[:], nil
+	}
+	return nil, &badRequestError{errors.New("digest or data is required")}
+}
+
+// badRequestError is a malformed request, as opposed to a key operation failure.
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *badRequestError) Unwrap() error {
+	return e.err
+}
+
+// requestTooLargeError is a request too large for the operation, whatever
+// the body limit.
+type requestTooLargeError struct {
+	err error
+}
+
+func (e *requestTooLargeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestTooLargeError) Unwrap() error {
+	return e.err
+}
+
+func decodeRequest(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &badRequestError{fmt.Errorf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+func readLimited(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("request body exceeds %d bytes", limit)
+	}
+	return body, nil
+}
+
+// errorStatus maps an operation error to the HTTP status returned to the
+// caller and the kind reported in the error body.
+func errorStatus(err error) (int, string) {
+	var badRequest *badRequestError
+	if errors.As(err, &badRequest) {
+		return http.StatusBadRequest, "bad_request"
+	}
+	var tooLarge *requestTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, "request_too_large"
+	}
+	var denied *permissionDeniedError
+	if errors.As(err, &denied) {
+		return http.StatusForbidden, "permission_denied"
+	}
+
+	kind := errorLabel(err)
+	switch kind {
+	case "invalid_ciphertext", "unsupported_algorithm", "invalid_key_identifier":
+		return http.StatusBadRequest, kind
+	case "key_not_found", "key_soft_deleted":
+		return http.StatusNotFound, kind
+	case "forbidden", "key_disabled", "key_expired":
+		return http.StatusForbidden, kind
+	case "throttled":
+		return http.StatusTooManyRequests, kind
+	case "authentication":
+		return http.StatusBadGateway, kind
+	case "canceled":
+		return http.StatusServiceUnavailable, kind
+	}
+	if IsTemporary(err) {
+		return http.StatusServiceUnavailable, kind
+	}
+	return http.StatusInternalServerError, kind
+}
+
+func writeError(w http.ResponseWriter, status int, kind string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error(), Kind: kind})
+}
+
+// ListenAndServe serves s on address until ctx is done, then shuts down
+// gracefully. Addresses of the form unix:///path listen on a unix socket,
+// where callers are identified by their peer credentials.
+func (s *EncryptionServer) ListenAndServe(ctx context.Context, address string, extra map[string]http.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", identify(s.Handler()))
+	for pattern, handler := range extra {
+		mux.Handle(pattern, handler)
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.SetReady(false)
+	}()
+	return serveHTTP(ctx, address, mux, s.tlsConfig)
+}
+
+// serveHTTP serves handler on address, over TLS when tlsConfig is set, until
+// ctx is done, then shuts down gracefully.
+func serveHTTP(ctx context.Context, address string, handler http.Handler, tlsConfig *tls.Config) error {
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ConnContext:       connContext,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+	slog.Info("serving", slog.String("address", address))
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	slog.Info("shutting down")
+	return server.Shutdown(shutdownCtx)
+}
+
+func listen(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix://"); path != address {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return listenUnix(path)
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// sivCipher is AES-SIV (RFC 5297): deterministic authenticated encryption,
+// where the synthetic IV is a CMAC of the associated data and plaintext, and
+// the plaintext is encrypted in CTR mode under that IV. The key is split in
+// two halves: the first for S2V, the second for CTR.
+
+const (
+	sivBlockSize = aes.BlockSize
+	// sivMaxComponents is the limit RFC 5297 sets on the associated data
+	// components, the plaintext being one more.
+	sivMaxComponents = 126
+)
+
+type sivCipher struct {
+	mac cipher.Block
+	ctr cipher.Block
+	// k1 and k2 are the CMAC subkeys.
+	k1, k2 [sivBlockSize]byte
+}
+
+func newSIVCipher(key []byte) (*sivCipher, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, fmt.Errorf("AES-SIV key is %d bytes, expected 32, 48 or 64", len(key))
+	}
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sivCipher{mac: mac, ctr: ctr}
+	var l [sivBlockSize]byte
+	mac.Encrypt(l[:], l[:])
+	c.k1 = sivDouble(l)
+	c.k2 = sivDouble(c.k1)
+	return c, nil
+}
+
+// sivDouble multiplies by x in GF(2^128), the "dbl" of RFC 5297.
+func sivDouble(b [sivBlockSize]byte) [sivBlockSize]byte {
+	var out [sivBlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < sivBlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[sivBlockSize-1] = b[sivBlockSize-1]<<1 ^ carry*0x87
+	return out
+}
+
+func sivXOR(dst *[sivBlockSize]byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// cmac is AES-CMAC (RFC 4493) of message.
+func (c *sivCipher) cmac(message []byte) [sivBlockSize]byte {
+	var x [sivBlockSize]byte
+	for len(message) > sivBlockSize {
+		sivXOR(&x, message[:sivBlockSize])
+		c.mac.Encrypt(x[:], x[:])
+		message = message[sivBlockSize:]
+	}
+	if len(message) == sivBlockSize {
+		sivXOR(&x, message)
+		sivXOR(&x, c.k1[:])
+	} else {
+		sivXOR(&x, message)
+		x[len(message)] ^= 0x80
+		sivXOR(&x, c.k2[:])
+	}
+	c.mac.Encrypt(x[:], x[:])
+	return x
+}
+
+// s2v derives the synthetic IV from the associated data components and the
+// plaintext.
+func (c *sivCipher) s2v(associatedData [][]byte, plaintext []byte) [sivBlockSize]byte {
+	var zero [sivBlockSize]byte
+	d := c.cmac(zero[:])
+	for _, ad := range associatedData {
+		d = sivDouble(d)
+		mac := c.cmac(ad)
+		sivXOR(&d, mac[:])
+	}
+
+	if len(plaintext) >= sivBlockSize {
+		t := make([]byte, len(plaintext))
+		copy(t, plaintext)
+		end := t[len(t)-sivBlockSize:]
+		for i := range end {
+			end[i] ^= d[i]
+		}
+		return c.cmac(t)
+	}
+	d = sivDouble(d)
+	var t [sivBlockSize]byte
+	copy(t[:], plaintext)
+	t[len(plaintext)] = 0x80
+	sivXOR(&d, t[:])
+	return c.cmac(d[:])
+}
+
+func (c *sivCipher) xorKeyStream(v [sivBlockSize]byte, dst, src []byte) {
+	// clearing bits 63 and 31 lets implementations use 32-bit counters
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(c.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// seal returns the synthetic IV followed by the encrypted plaintext.
+func (c *sivCipher) seal(plaintext []byte, associatedData [][]byte) ([]byte, error) {
+	if len(associatedData) > sivMaxComponents {
+		return nil, fmt.Errorf("AES-SIV takes at most %d associated data components", sivMaxComponents)
+	}
+	v := c.s2v(associatedData, plaintext)
+	out := make([]byte, sivBlockSize+len(plaintext))
+	copy(out, v[:])
+	c.xorKeyStream(v, out[sivBlockSize:], plaintext)
+	return out, nil
+}
+
+// open decrypts and authenticates a ciphertext made by seal.
+func (c *sivCipher) open(ciphertext []byte, associatedData [][]byte) ([]byte, error) {
+	if len(associatedData) > sivMaxComponents {
+		return nil, fmt.Errorf("AES-SIV takes at most %d associated data components", sivMaxComponents)
+	}
+	if len(ciphertext) < sivBlockSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	var v [sivBlockSize]byte
+	copy(v[:], ciphertext)
+	plaintext := make([]byte, len(ciphertext)-sivBlockSize)
+	c.xorKeyStream(v, plaintext, ciphertext[sivBlockSize:])
+
+	expected := c.s2v(associatedData, plaintext)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		return nil, errors.New("message authentication failed")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+type DeletedKey struct {
+	Name               string
+	RecoveryID         string
+	RecoveryLevel      string
+	DeletedDate        *time.Time
+	ScheduledPurgeDate *time.Time
+}
+
+// KeySoftDeletedError is returned by key operations when the key they target
+// has been soft-deleted and can still be recovered.
+type KeySoftDeletedError struct {
+	VaultURL string
+	Key      DeletedKey
+	Err      error
+}
+
+func (e *KeySoftDeletedError) Error() string {
+	until := "its scheduled purge date"
+	if e.Key.ScheduledPurgeDate != nil {
+		until = e.Key.ScheduledPurgeDate.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("key %s has been deleted from %s but can be recovered until %s: run 'kvcrypt deleted recover -name %s' or call RecoverDeletedKey",
+		e.Key.Name, e.VaultURL, until, e.Key.Name)
+}
+
+func (e *KeySoftDeletedError) Unwrap() error {
+	return e.Err
+}
+
+// DeletedKeys lists the soft-deleted keys of the configured vault.
+func (e *EncryptionClient) DeletedKeys(ctx context.Context) ([]DeletedKey, error) {
+	var keys []DeletedKey
+
+	iter, err := e.kvClient.GetDeletedKeysComplete(ctx, e.kvInfo.vaultURL, nil)
+	for ; err == nil && iter.NotDone(); err = iter.NextWithContext(ctx) {
+		item := iter.Value()
+		keys = append(keys, newDeletedKey(item.Kid, item.RecoveryID, item.Attributes, item.DeletedDate, item.ScheduledPurgeDate))
+	}
+	if err != nil {
+		return nil, wrapKeyOperationError("list deleted keys", err)
+	}
+
+	return keys, nil
+}
+
+// DeletedKey returns the soft-deleted key keyName of the configured vault.
+func (e *EncryptionClient) DeletedKey(ctx context.Context, keyName string) (*DeletedKey, error) {
+	bundle, err := e.kvClient.GetDeletedKey(ctx, e.kvInfo.vaultURL, keyName)
+	if err != nil {
+		return nil, wrapKeyOperationError("get deleted key", err)
+	}
+
+	var kid *string
+	if bundle.Key != nil {
+		kid = bundle.Key.Kid
+	}
+	key := newDeletedKey(kid, bundle.RecoveryID, bundle.Attributes, bundle.DeletedDate, bundle.ScheduledPurgeDate)
+	return &key, nil
+}
+
+// RecoverDeletedKey undoes the deletion of keyName, restoring all its versions.
+func (e *EncryptionClient) RecoverDeletedKey(ctx context.Context, keyName string) error {
+	_, err := e.kvClient.RecoverDeletedKey(ctx, e.kvInfo.vaultURL, keyName)
+	return wrapKeyOperationError("recover deleted key", err)
+}
+
+// PurgeDeletedKey permanently removes the soft-deleted key keyName. Anything
+// encrypted with it can no longer be decrypted.
+func (e *EncryptionClient) PurgeDeletedKey(ctx context.Context, keyName string) error {
+	_, err := e.kvClient.PurgeDeletedKey(ctx, e.kvInfo.vaultURL, keyName)
+	return wrapKeyOperationError("purge deleted key", err)
+}
+
+// checkSoftDeleted turns a key not found error into a KeySoftDeletedError
+// when the configured key is waiting in the vault's recycle bin.
+func (e *EncryptionClient) checkSoftDeleted(ctx context.Context, err error) error {
+	if responseStatusCode(err) != http.StatusNotFound {
+		return err
+	}
+
+	deleted, lookupErr := e.DeletedKey(ctx, e.kvInfo.keyName)
+	if lookupErr != nil {
+		return err
+	}
+
+	return &KeySoftDeletedError{VaultURL: e.kvInfo.vaultURL, Key: *deleted, Err: err}
+}
+
+func newDeletedKey(kid, recoveryID *string, attributes *keyvault.KeyAttributes, deletedDate, scheduledPurgeDate *date.UnixTime) DeletedKey {
+	key := DeletedKey{
+		DeletedDate:        unixTimeToTime(deletedDate),
+		ScheduledPurgeDate: unixTimeToTime(scheduledPurgeDate),
+	}
+	if kid != nil {
+		key.Name = keyNameFromID(*kid)
+	}
+	if recoveryID != nil {
+		key.RecoveryID = *recoveryID
+	}
+	if attributes != nil {
+		key.RecoveryLevel = string(attributes.RecoveryLevel)
+	}
+	return key
+}
+
+func keyNameFromID(kid string) string {
+	r := keyIdentifierRegexp()
+	if str := r.FindStringSubmatch(kid); len(str) >= 4 {
+		return str[2]
+	}
+	return keyVersionFromID(kid)
+}
+
+func unixTimeToTime(t *date.UnixTime) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := time.Time(*t)
+	return &v
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EncryptedString and EncryptedBytes are column types that are encrypted as
+// they are written to a database and decrypted as they are scanned, so that
+// encrypting a column is a change of field type. Columns hold the tagged
+// ciphertext objects of JSON field encryption, as text:
+//
+//	{"kvcrypt":"1","kid":"https://...","wrapped_key":"...","ciphertext":"..."}
+//
+// Values are sealed by a ColumnEncrypter, either the one set on the value or
+// the package default. Values are not bound to their row or column, so
+// someone able to write the database can copy a ciphertext from one to
+// another.
+
+const (
+	defaultColumnCacheSize = 1024
+	defaultColumnCacheTTL  = time.Hour
+	// columnDataKeyMaxUses keeps the random nonces of one data key far from
+	// colliding, however long the rotation period.
+	columnDataKeyMaxUses = 1 << 20
+)
+
+// ColumnJSONOutput is what EncryptedString and EncryptedBytes marshal to.
+type ColumnJSONOutput int
+
+const (
+	// ColumnJSONRedacted marshals values as "[REDACTED]".
+	ColumnJSONRedacted ColumnJSONOutput = iota
+	// ColumnJSONCiphertext marshals values as their tagged ciphertext
+	// object, which unmarshalling decrypts.
+	ColumnJSONCiphertext
+)
+
+// ColumnEncrypter seals column values under a data key it reuses for a
+// while, so that writes only call Key Vault when the key is rotated, and
+// opens them with a DataKeyCache.
+type ColumnEncrypter struct {
+	// JSONOutput chooses what values marshal to; they are redacted by
+	// default.
+	JSONOutput ColumnJSONOutput
+
+	wrapper  KeyWrapper
+	cache    *DataKeyCache
+	rotation time.Duration
+
+	mu      sync.Mutex
+	current *DataKey
+	expires time.Time
+	uses    int
+}
+
+// NewColumnEncrypter returns a ColumnEncrypter wrapping data keys with w and
+// generating a new one every rotation.
+func NewColumnEncrypter(w KeyWrapper, rotation time.Duration) (*ColumnEncrypter, error) {
+	if rotation <= 0 {
+		return nil, fmt.Errorf("data key rotation must be positive, got %v", rotation)
+	}
+	cache, err := NewDataKeyCache(defaultColumnCacheSize, defaultColumnCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &ColumnEncrypter{wrapper: w, cache: cache, rotation: rotation}, nil
+}
+
+var (
+	defaultColumnEncrypterMu sync.RWMutex
+	defaultColumnEncrypter   *ColumnEncrypter
+)
+
+// SetDefaultColumnEncrypter sets the ColumnEncrypter of values that have
+// none of their own.
+func SetDefaultColumnEncrypter(e *ColumnEncrypter) {
+	defaultColumnEncrypterMu.Lock()
+	defaultColumnEncrypter = e
+	defaultColumnEncrypterMu.Unlock()
+}
+
+func columnEncrypter(e *ColumnEncrypter) (*ColumnEncrypter, error) {
+	if e != nil {
+		return e, nil
+	}
+	defaultColumnEncrypterMu.RLock()
+	defer defaultColumnEncrypterMu.RUnlock()
+	if defaultColumnEncrypter == nil {
+		return nil, errors.New("no column encrypter: set one on the value or call SetDefaultColumnEncrypter")
+	}
+	return defaultColumnEncrypter, nil
+}
+
+func (e *ColumnEncrypter) dataKey(ctx context.Context) (*DataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current == nil || !time.Now().Before(e.expires) || e.uses >= columnDataKeyMaxUses {
+		key, err := NewDataKey(ctx, e.wrapper)
+		if err != nil {
+			return nil, err
+		}
+		e.current, e.expires, e.uses = key, time.Now().Add(e.rotation), 0
+	}
+	e.uses++
+	return e.current, nil
+}
+
+// Seal encrypts plaintext into a tagged ciphertext object.
+func (e *ColumnEncrypter) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := e.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&EncryptedJSONValue{Version: jsonFieldVersion, Envelope: *key.Envelope(plaintext, nil)})
+}
+
+// Open decrypts a tagged ciphertext object made by Seal.
+func (e *ColumnEncrypter) Open(ctx context.Context, sealed []byte) ([]byte, error) {
+	var value EncryptedJSONValue
+	if err := json.Unmarshal(sealed, &value); err != nil || value.Version == "" {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: errors.New("column value is not a tagged ciphertext object")}
+	}
+	if value.Version != jsonFieldVersion {
+		return nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: fmt.Errorf("unsupported encrypted value version %q", value.Version)}
+	}
+
+	e.mu.Lock()
+	key := e.current
+	e.mu.Unlock()
+	if key == nil || key.KeyID != value.KeyID || key.Wrapped != value.WrappedKey {
+		var err error
+		if key, err = e.cache.OpenDataKey(ctx, e.wrapper, value.KeyID, value.WrappedKey); err != nil {
+			return nil, err
+		}
+	}
+	return key.Open(value.Ciphertext, nil)
+}
+
+// marshalColumnJSON redacts plaintext unless e, or the default encrypter
+// when e is nil, marshals ciphertexts. Redacting needs no encrypter.
+func marshalColumnJSON(e *ColumnEncrypter, plaintext []byte) ([]byte, error) {
+	if e == nil {
+		defaultColumnEncrypterMu.RLock()
+		e = defaultColumnEncrypter
+		defaultColumnEncrypterMu.RUnlock()
+	}
+	if e == nil || e.JSONOutput != ColumnJSONCiphertext {
+		return []byte(strconv.Quote(redactedText)), nil
+	}
+	return e.Seal(context.Background(), plaintext)
+}
+
+// unmarshalColumnJSON decrypts a tagged ciphertext object with e, or the
+// default encrypter when e is nil, and takes any other JSON string as
+// plaintext, base64 encoded when binary is set. Plaintext needs no
+// encrypter. "[REDACTED]" is refused, so that a redacted value read back
+// is not written to the database in place of the secret.
+func unmarshalColumnJSON(e *ColumnEncrypter, data []byte, binary bool) ([]byte, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		e, err := columnEncrypter(e)
+		if err != nil {
+			return nil, err
+		}
+		return e.Open(context.Background(), trimmed)
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if s == redactedText {
+		return nil, errors.New("cannot unmarshal a redacted value: marshal with ColumnJSONCiphertext to read values back")
+	}
+	if !binary {
+		return []byte(s), nil
+	}
+	var plaintext []byte
+	if err := json.Unmarshal(data, &plaintext); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// scanColumn decrypts a column value, which NULL leaves empty.
+func scanColumn(e *ColumnEncrypter, src interface{}) ([]byte, error) {
+	var sealed []byte
+	switch src := src.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		sealed = []byte(src)
+	case []byte:
+		sealed = src
+	default:
+		return nil, fmt.Errorf("cannot scan %T into an encrypted column", src)
+	}
+	e, err := columnEncrypter(e)
+	if err != nil {
+		return nil, err
+	}
+	return e.Open(context.Background(), sealed)
+}
+
+func columnValue(e *ColumnEncrypter, plaintext []byte) (driver.Value, error) {
+	e, err := columnEncrypter(e)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := e.Seal(context.Background(), plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return string(sealed), nil
+}
+
+// EncryptedString is a string column stored encrypted. NULL scans as the
+// empty string; use *EncryptedString for nullable columns. It prints as
+// [REDACTED].
+type EncryptedString struct {
+	Plaintext string
+	// Encrypter seals and opens the value; the default one when nil.
+	Encrypter *ColumnEncrypter
+}
+
+func (s *EncryptedString) Scan(src interface{}) error {
+	plaintext, err := scanColumn(s.Encrypter, src)
+	if err != nil {
+		return err
+	}
+	s.Plaintext = string(plaintext)
+	return nil
+}
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	return columnValue(s.Encrypter, []byte(s.Plaintext))
+}
+
+func (s EncryptedString) MarshalJSON() ([]byte, error) {
+	return marshalColumnJSON(s.Encrypter, []byte(s.Plaintext))
+}
+
+func (s *EncryptedString) UnmarshalJSON(data []byte) error {
+	plaintext, err := unmarshalColumnJSON(s.Encrypter, data, false)
+	if err != nil {
+		return err
+	}
+	s.Plaintext = string(plaintext)
+	return nil
+}
+
+func (s EncryptedString) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redactedText))
+}
+
+// EncryptedBytes is a binary column stored encrypted, as text. NULL scans
+// as nil; use *EncryptedBytes for nullable columns. It prints as
+// [REDACTED].
+type EncryptedBytes struct {
+	Plaintext []byte
+	// Encrypter seals and opens the value; the default one when nil.
+	Encrypter *ColumnEncrypter
+}
+
+func (b *EncryptedBytes) Scan(src interface{}) error {
+	plaintext, err := scanColumn(b.Encrypter, src)
+	if err != nil {
+		return err
+	}
+	b.Plaintext = plaintext
+	return nil
+}
+
+func (b EncryptedBytes) Value() (driver.Value, error) {
+	return columnValue(b.Encrypter, b.Plaintext)
+}
+
+func (b EncryptedBytes) MarshalJSON() ([]byte, error) {
+	return marshalColumnJSON(b.Encrypter, b.Plaintext)
+}
+
+// UnmarshalJSON takes a tagged ciphertext object, or plaintext as a base64
+// JSON string.
+func (b *EncryptedBytes) UnmarshalJSON(data []byte) error {
+	plaintext, err := unmarshalColumnJSON(b.Encrypter, data, true)
+	if err != nil {
+		return err
+	}
+	b.Plaintext = plaintext
+	return nil
+}
+
+func (b EncryptedBytes) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redactedText))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedColumnsJSON(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewColumnEncrypter(vault, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// redacted values must not read back as the secret "[REDACTED]"
+	redacted, err := json.Marshal(EncryptedString{Plaintext: "078-05-1120", Encrypter: e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(redacted) != `"[REDACTED]"` {
+		t.Fatalf("marshalled to %s, want it redacted", redacted)
+	}
+	if err := json.Unmarshal(redacted, &EncryptedString{Encrypter: e}); err == nil {
+		t.Error("EncryptedString unmarshalled a redacted value")
+	}
+	if err := json.Unmarshal(redacted, &EncryptedBytes{Encrypter: e}); err == nil {
+		t.Error("EncryptedBytes unmarshalled a redacted value")
+	}
+
+	e.JSONOutput = ColumnJSONCiphertext
+	sealed, err := json.Marshal(EncryptedBytes{Plaintext: []byte{0, 1, 2}, Encrypter: e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(sealed), "{") {
+		t.Fatalf("marshalled to %s, want a ciphertext object", sealed)
+	}
+	b := EncryptedBytes{Encrypter: e}
+	if err := json.Unmarshal(sealed, &b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Plaintext) != "\x00\x01\x02" {
+		t.Errorf("round trip = %q", b.Plaintext)
+	}
+	if err := json.Unmarshal(sealed, &EncryptedBytes{}); err == nil {
+		t.Error("ciphertext unmarshalled without an encrypter")
+	}
+}
+
+func TestEncryptedColumnsPlaintextJSONNeedsNoEncrypter(t *testing.T) {
+	var s EncryptedString
+	if err := json.Unmarshal([]byte(`"078-05-1120"`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Plaintext != "078-05-1120" {
+		t.Errorf("EncryptedString = %q", s.Plaintext)
+	}
+	var b EncryptedBytes
+	if err := json.Unmarshal([]byte(`"AAEC"`), &b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Plaintext) != "\x00\x01\x02" {
+		t.Errorf("EncryptedBytes = %q", b.Plaintext)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streams encrypt data of any size with a data key using the STREAM
+// construction: the plaintext is cut into fixed-size chunks, each sealed with
+// AES-256-GCM under a nonce made of a random prefix, the chunk counter and a
+// flag set only on the final chunk. Reordered, dropped or appended chunks and
+// a truncated stream all fail authentication. A stream is laid out as:
+//
+//	magic "KVCS" | version | chunk size (uint32) | nonce prefix (7 bytes)
+//	| key identifier length (uint16) | key identifier
+//	| wrapped key length (uint16) | wrapped key
+//	| chunks, each chunk size + 16 bytes except the final one
+//
+// Every chunk is sealed with the SHA-256 of the header as additional data.
+
+const (
+	streamMagic           = "KVCS"
+	streamVersion         = 1
+	streamChunkSize       = 64 << 10
+	streamMaxChunkSize    = 16 << 20
+	streamNoncePrefixSize = 7
+)
+
+type streamHeader struct {
+	keyID       string
+	wrapped     string
+	chunkSize   int
+	noncePrefix []byte
+	// additionalData is the hash of the encoded header.
+	additionalData []byte
+}
+
+func newStreamHeader(key *DataKey, chunkSize int) (*streamHeader, error) {
+	h := &streamHeader{keyID: key.KeyID, wrapped: key.Wrapped, chunkSize: chunkSize, noncePrefix: make([]byte, streamNoncePrefixSize)}
+	if _, err := io.ReadFull(rand.Reader, h.noncePrefix); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *streamHeader) encode() ([]byte, error) {
+	if len(h.keyID) > 0xffff || len(h.wrapped) > 0xffff {
+		return nil, errors.New("key identifier or wrapped key too long for a stream header")
+	}
+	b := append([]byte(streamMagic), streamVersion)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.chunkSize))
+	b = append(b, h.noncePrefix...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(h.keyID)))
+	b = append(b, h.keyID...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(h.wrapped)))
+	b = append(b, h.wrapped...)
+
+	sum := sha256.Sum256(b)
+	h.additionalData = sum[:]
+	return b, nil
+}
+
+// readStreamHeader reads the header at the start of r, returning it along
+// with its encoded length.
+func readStreamHeader(r io.Reader) (*streamHeader, int, error) {
+	fixed := make([]byte, len(streamMagic)+1+4+streamNoncePrefixSize+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, 0, invalidStream(fmt.Errorf("reading header: %v", err))
+	}
+	if string(fixed[:len(streamMagic)]) != streamMagic {
+		return nil, 0, invalidStream(errors.New("not an encrypted stream"))
+	}
+	if version := fixed[len(streamMagic)]; version != streamVersion {
+		return nil, 0, invalidStream(fmt.Errorf("unsupported stream version %d", version))
+	}
+
+	h := &streamHeader{}
+	rest := fixed[len(streamMagic)+1:]
+	h.chunkSize = int(binary.BigEndian.Uint32(rest))
+	if h.chunkSize < 1 || h.chunkSize > streamMaxChunkSize {
+		return nil, 0, invalidStream(fmt.Errorf("bad chunk size %d", h.chunkSize))
+	}
+	h.noncePrefix = append([]byte(nil), rest[4:4+streamNoncePrefixSize]...)
+
+	encoded := fixed
+	keyID := make([]byte, binary.BigEndian.Uint16(rest[4+streamNoncePrefixSize:]))
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, 0, invalidStream(fmt.Errorf("reading header: %v", err))
+	}
+	encoded = append(encoded, keyID...)
+	n := make([]byte, 2)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return nil, 0, invalidStream(fmt.Errorf("reading header: %v", err))
+	}
+	encoded = append(encoded, n...)
+	wrapped := make([]byte, binary.BigEndian.Uint16(n))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, 0, invalidStream(fmt.Errorf("reading header: %v", err))
+	}
+	encoded = append(encoded, wrapped...)
+
+	h.keyID, h.wrapped = string(keyID), string(wrapped)
+	sum := sha256.Sum256(encoded)
+	h.additionalData = sum[:]
+	return h, len(encoded), nil
+}
+
+// nonce returns the nonce of chunk i.
+func (h *streamHeader) nonce(i uint64, final bool) []byte {
+	nonce := make([]byte, 0, streamNoncePrefixSize+5)
+	nonce = append(nonce, h.noncePrefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(i))
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func invalidStream(err error) error {
+	return &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	key    *DataKey
+	header *streamHeader
+	buf    []byte
+	out    []byte
+	chunk  uint64
+	err    error
+}
+
+// NewEncryptWriter returns a writer encrypting what is written to it into w,
+// under a new data key wrapped by kw. Close must be called to write the
+// final chunk; it does not close w. Memory use is bounded by the chunk size.
+func NewEncryptWriter(ctx context.Context, kw KeyWrapper, w io.Writer) (io.WriteCloser, error) {
+	key, err := NewDataKey(ctx, kw)
+	if err != nil {
+		return nil, err
+	}
+	header, err := newStreamHeader(key, streamChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptWriter(w, key, header)
+}
+
+func newEncryptWriter(w io.Writer, key *DataKey, header *streamHeader) (*encryptWriter, error) {
+	encoded, err := header.encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		key:    key,
+		header: header,
+		buf:    make([]byte, 0, header.chunkSize),
+		out:    make([]byte, 0, header.chunkSize+key.aead.Overhead()),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if e.err != nil {
+			return written, e.err
+		}
+		// a full chunk is only sealed once more data shows it is not the
+		// final one
+		if len(e.buf) == cap(e.buf) {
+			e.err = e.seal(false)
+			continue
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	if e.chunk > 0xffffffff {
+		return errors.New("stream too long")
+	}
+	e.out = e.key.aead.Seal(e.out[:0], e.header.nonce(e.chunk, final), e.buf, e.header.additionalData)
+	e.buf = e.buf[:0]
+	e.chunk++
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// Close seals and writes the final chunk.
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("write to closed stream")
+		return nil
+	}
+	return e.err
+}
+
+type decryptReader struct {
+	r      io.Reader
+	key    *DataKey
+	header *streamHeader
+	// buf holds a sealed chunk and the first byte of the next one, which
+	// tells whether the chunk is the final one.
+	buf       []byte
+	buffered  int
+	plaintext []byte
+	unread    []byte
+	chunk     uint64
+	done      bool
+	err       error
+}
+
+// NewDecryptReader returns a reader decrypting the stream written by an
+// encrypt writer from r. It reports an error wrapping ErrInvalidCiphertext
+// when the stream was modified or truncated, and only returns io.EOF once
+// the final chunk was authenticated. Plaintext is returned chunk by chunk, as
+// each is authenticated.
+func NewDecryptReader(ctx context.Context, kw KeyWrapper, r io.Reader) (io.Reader, error) {
+	header, _, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := OpenDataKey(ctx, kw, header.keyID, header.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:         r,
+		key:       key,
+		header:    header,
+		buf:       make([]byte, header.chunkSize+key.aead.Overhead()+1),
+		plaintext: make([]byte, 0, header.chunkSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.unread) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.unread)
+	d.unread = d.unread[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.buf[d.buffered:])
+	n += d.buffered
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.done = true
+	case err != nil:
+		return err
+	}
+
+	sealed := d.buf[:n]
+	if !d.done {
+		sealed = d.buf[:n-1]
+	}
+	if len(sealed) < d.key.aead.Overhead() {
+		return invalidStream(errors.New("stream truncated"))
+	}
+	if d.chunk > 0xffffffff {
+		return invalidStream(errors.New("stream too long"))
+	}
+
+	plaintext, err := d.key.aead.Open(d.plaintext[:0], d.header.nonce(d.chunk, d.done), sealed, d.header.additionalData)
+	if err != nil {
+		if d.done {
+			return invalidStream(fmt.Errorf("chunk %d: stream truncated or modified", d.chunk))
+		}
+		return invalidStream(fmt.Errorf("chunk %d: %v", d.chunk, err))
+	}
+	d.chunk++
+	d.unread = plaintext
+	if !d.done {
+		d.buf[0] = d.buf[n-1]
+		d.buffered = 1
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+type sealJob struct {
+	index     uint64
+	final     bool
+	plaintext []byte
+	sealed    []byte
+	ready     chan struct{}
+}
+
+// parallelEncryptWriter seals chunks on several goroutines. Chunks are
+// handed to the workers and, in order, to a goroutine writing them out as
+// they are ready; the number of chunks in flight is bounded, so Write blocks
+// when the workers or the underlying writer fall behind.
+type parallelEncryptWriter struct {
+	key    *DataKey
+	header *streamHeader
+	buf    []byte
+	chunk  uint64
+	closed bool
+
+	jobs    chan *sealJob
+	ordered chan *sealJob
+	buffers sync.Pool
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewParallelEncryptWriter is NewEncryptWriter sealing chunks on workers
+// goroutines, one per CPU when workers is 0. Its output has the same format,
+// and memory use stays bounded by a few chunks per worker.
+func NewParallelEncryptWriter(ctx context.Context, kw KeyWrapper, w io.Writer, workers int) (io.WriteCloser, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	key, err := NewDataKey(ctx, kw)
+	if err != nil {
+		return nil, err
+	}
+	header, err := newStreamHeader(key, streamChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return newParallelEncryptWriter(w, key, header, workers)
+}
+
+func newParallelEncryptWriter(w io.Writer, key *DataKey, header *streamHeader, workers int) (*parallelEncryptWriter, error) {
+	encoded, err := header.encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return nil, err
+	}
+
+	e := &parallelEncryptWriter{
+		key:     key,
+		header:  header,
+		jobs:    make(chan *sealJob, workers),
+		ordered: make(chan *sealJob, 2*workers),
+		done:    make(chan struct{}),
+	}
+	e.buffers.New = func() interface{} { return make([]byte, 0, header.chunkSize) }
+	e.buf = e.buffers.Get().([]byte)
+
+	for i := 0; i < workers; i++ {
+		go e.seal()
+	}
+	go e.write(w)
+	return e, nil
+}
+
+func (e *parallelEncryptWriter) seal() {
+	for job := range e.jobs {
+		job.sealed = e.key.aead.Seal(nil, e.header.nonce(job.index, job.final), job.plaintext, e.header.additionalData)
+		close(job.ready)
+	}
+}
+
+func (e *parallelEncryptWriter) write(w io.Writer) {
+	defer close(e.done)
+	for job := range e.ordered {
+		<-job.ready
+		if e.error() == nil {
+			if _, err := w.Write(job.sealed); err != nil {
+				e.setError(err)
+			}
+		}
+		e.buffers.Put(job.plaintext[:0])
+	}
+}
+
+func (e *parallelEncryptWriter) error() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (e *parallelEncryptWriter) setError(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// dispatch hands the buffered chunk to the workers.
+func (e *parallelEncryptWriter) dispatch(final bool) error {
+	if e.chunk > 0xffffffff {
+		return errors.New("stream too long")
+	}
+	job := &sealJob{index: e.chunk, final: final, plaintext: e.buf, ready: make(chan struct{})}
+	e.ordered <- job
+	e.jobs <- job
+	e.chunk++
+	if !final {
+		e.buf = e.buffers.Get().([]byte)
+	}
+	return nil
+}
+
+func (e *parallelEncryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		if err := e.error(); err != nil {
+			return written, err
+		}
+		// as with encryptWriter, a full chunk waits for more data
+		if len(e.buf) == cap(e.buf) {
+			if err := e.dispatch(false); err != nil {
+				e.setError(err)
+			}
+			continue
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final chunk and waits for every chunk to be written.
+func (e *parallelEncryptWriter) Close() error {
+	if e.closed {
+		return e.error()
+	}
+	e.closed = true
+	if err := e.dispatch(true); err != nil {
+		e.setError(err)
+	}
+	close(e.jobs)
+	close(e.ordered)
+	<-e.done
+	return e.error()
+}
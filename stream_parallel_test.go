@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParallelEncryptMatchesSerial(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one chunk", streamChunkSize},
+		{"one chunk and one byte", streamChunkSize + 1},
+		{"many chunks", 7*streamChunkSize + 123},
+	}
+	for _, tc := range sizes {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := make([]byte, tc.size)
+			if _, err := rand.Read(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			key, err := NewDataKey(ctx, vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, err := newStreamHeader(key, streamChunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var serial bytes.Buffer
+			sw, err := newEncryptWriter(&serial, key, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeInPieces(t, sw, plaintext)
+
+			var parallel bytes.Buffer
+			pw, err := newParallelEncryptWriter(&parallel, key, header, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeInPieces(t, pw, plaintext)
+
+			if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+				t.Fatalf("parallel output (%d bytes) differs from serial output (%d bytes)", parallel.Len(), serial.Len())
+			}
+
+			r, err := NewDecryptReader(ctx, vault, &parallel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("decrypted %d bytes, want the %d written", len(decrypted), len(plaintext))
+			}
+		})
+	}
+}
+
+// writeInPieces writes p in pieces that do not line up with chunks, then
+// closes w.
+func writeInPieces(t *testing.T, w io.WriteCloser, p []byte) {
+	t.Helper()
+	for len(p) > 0 {
+		n := 10007
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const benchmarkStreamSize = 64 << 20
+
+func benchmarkEncrypt(b *testing.B, newWriter func(ctx context.Context, kw KeyWrapper, w io.Writer) (io.WriteCloser, error)) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	plaintext := make([]byte, benchmarkStreamSize)
+	if _, err := rand.Read(plaintext); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(benchmarkStreamSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := newWriter(ctx, vault, ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptSerial(b *testing.B) {
+	benchmarkEncrypt(b, NewEncryptWriter)
+}
+
+func BenchmarkEncryptParallel(b *testing.B) {
+	benchmarkEncrypt(b, func(ctx context.Context, kw KeyWrapper, w io.Writer) (io.WriteCloser, error) {
+		return NewParallelEncryptWriter(ctx, kw, w, 0)
+	})
+}
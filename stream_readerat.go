@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DecryptReaderAt decrypts ranges of an encrypted stream without reading it
+// from the start. Chunks have a fixed size, so the position of the chunk
+// holding any plaintext offset follows from the header, and only the chunks
+// covering a range are read and authenticated. It implements io.ReaderAt,
+// safe for concurrent use, and io.ReadSeeker, so it can be handed to
+// http.ServeContent to serve ranged downloads.
+type DecryptReaderAt struct {
+	r      io.ReaderAt
+	key    *DataKey
+	header *streamHeader
+	// offset is where the first chunk starts.
+	offset int64
+	chunks int64
+	size   int64
+
+	mu sync.Mutex
+	// the last chunk read, for reads smaller than a chunk
+	cachedChunk     int64
+	cachedPlaintext []byte
+	pos             int64
+}
+
+// NewDecryptReaderAt opens the encrypted stream of size bytes in r, unwrapping
+// its data key with kw. The final chunk is authenticated up front, so that a
+// truncated stream is rejected before any range is read.
+func NewDecryptReaderAt(ctx context.Context, kw KeyWrapper, r io.ReaderAt, size int64) (*DecryptReaderAt, error) {
+	header, headerSize, err := readStreamHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	key, err := OpenDataKey(ctx, kw, header.keyID, header.wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := int64(key.aead.Overhead())
+	sealedChunk := int64(header.chunkSize) + overhead
+	body := size - int64(headerSize)
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if body < overhead || body-(chunks-1)*sealedChunk < overhead {
+		return nil, invalidStream(errors.New("stream truncated"))
+	}
+
+	d := &DecryptReaderAt{
+		r:           r,
+		key:         key,
+		header:      header,
+		offset:      int64(headerSize),
+		chunks:      chunks,
+		size:        body - chunks*overhead,
+		cachedChunk: -1,
+	}
+	if _, err := d.readChunk(chunks - 1); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Size returns the size of the plaintext.
+func (d *DecryptReaderAt) Size() int64 {
+	return d.size
+}
+
+// readChunk returns the plaintext of chunk i.
+func (d *DecryptReaderAt) readChunk(i int64) ([]byte, error) {
+	d.mu.Lock()
+	if d.cachedChunk == i {
+		plaintext := d.cachedPlaintext
+		d.mu.Unlock()
+		return plaintext, nil
+	}
+	d.mu.Unlock()
+
+	sealedChunk := int64(d.header.chunkSize + d.key.aead.Overhead())
+	start := d.offset + i*sealedChunk
+	length := sealedChunk
+	final := i == d.chunks-1
+	if final {
+		length = d.size - i*int64(d.header.chunkSize) + int64(d.key.aead.Overhead())
+	}
+
+	sealed := make([]byte, length)
+	if _, err := d.r.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	plaintext, err := d.key.aead.Open(sealed[:0], d.header.nonce(uint64(i), final), sealed, d.header.additionalData)
+	if err != nil {
+		return nil, invalidStream(fmt.Errorf("chunk %d: %v", i, err))
+	}
+
+	d.mu.Lock()
+	d.cachedChunk, d.cachedPlaintext = i, plaintext
+	d.mu.Unlock()
+	return plaintext, nil
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off.
+func (d *DecryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < d.size {
+		chunkSize := int64(d.header.chunkSize)
+		plaintext, err := d.readChunk(off / chunkSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plaintext[off%chunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *DecryptReaderAt) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	pos := d.pos
+	d.mu.Unlock()
+	if pos >= d.size {
+		return 0, io.EOF
+	}
+
+	n, err := d.ReadAt(p, pos)
+	d.mu.Lock()
+	d.pos = pos + int64(n)
+	d.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *DecryptReaderAt) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestReaderAt(t *testing.T, vault KeyWrapper, plaintext []byte) *DecryptReaderAt {
+	t.Helper()
+	stream, _ := encryptTestStream(t, vault, plaintext)
+	d, err := NewDecryptReaderAt(context.Background(), vault, bytes.NewReader(stream), int64(len(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != int64(len(plaintext)) {
+		t.Fatalf("Size() = %d, want %d", d.Size(), len(plaintext))
+	}
+	return d
+}
+
+func TestDecryptReaderAtRanges(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"partial final chunk", 3*testStreamChunkSize + 5},
+		{"full final chunk", 3 * testStreamChunkSize},
+		{"one byte", 1},
+	}
+	for _, tc := range sizes {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := make([]byte, tc.size)
+			for i := range plaintext {
+				plaintext[i] = byte(i)
+			}
+			d := newTestReaderAt(t, vault, plaintext)
+
+			// every range, including those crossing chunk boundaries and
+			// those running past the end
+			for off := 0; off <= tc.size; off++ {
+				for length := 1; length <= 2*testStreamChunkSize+2; length++ {
+					p := make([]byte, length)
+					n, err := d.ReadAt(p, int64(off))
+					want := plaintext[off:]
+					if len(want) > length {
+						want = want[:length]
+					}
+					if !bytes.Equal(p[:n], want) {
+						t.Fatalf("ReadAt(%d bytes, %d) = %v, want %v", length, off, p[:n], want)
+					}
+					switch {
+					case n < length && err != io.EOF:
+						t.Fatalf("short ReadAt(%d bytes, %d) returned %v, want io.EOF", length, off, err)
+					case n == length && err != nil:
+						t.Fatalf("ReadAt(%d bytes, %d): %v", length, off, err)
+					}
+				}
+			}
+
+			if n, err := d.ReadAt(make([]byte, 1), int64(tc.size)+10); n != 0 || err != io.EOF {
+				t.Errorf("ReadAt past the end = %d, %v, want 0, io.EOF", n, err)
+			}
+			if _, err := d.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			all, err := ioutil.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(all, plaintext) {
+				t.Errorf("Read returned %v, want %v", all, plaintext)
+			}
+			if n, err := d.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("Read at the end = %d, %v, want 0, io.EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestNewDecryptReaderAtRejectsTruncatedStreams(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, headerSize := encryptTestStream(t, vault, bytes.Repeat([]byte{7}, 3*testStreamChunkSize))
+	sealedSize := testStreamChunkSize + 16
+	for _, size := range []int{
+		headerSize + 2*sealedSize, // at a chunk boundary
+		headerSize + 2*sealedSize + 8,
+		len(stream) - 1,
+		headerSize,
+		headerSize - 1,
+		0,
+	} {
+		_, err := NewDecryptReaderAt(context.Background(), vault, bytes.NewReader(stream[:size]), int64(size))
+		if !errors.Is(err, ErrInvalidCiphertext) {
+			t.Errorf("stream truncated to %d of %d bytes: got %v, want ErrInvalidCiphertext", size, len(stream), err)
+		}
+	}
+}
+
+func TestDecryptReaderAtServeContent(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 5*testStreamChunkSize+3)
+	for i := range plaintext {
+		plaintext[i] = byte('a' + i%26)
+	}
+	d := newTestReaderAt(t, vault, plaintext)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, d)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		rangeHeader string
+		status      int
+		want        []byte
+	}{
+		{"", http.StatusOK, plaintext},
+		{"bytes=10-40", http.StatusPartialContent, plaintext[10:41]},
+		{"bytes=16-31", http.StatusPartialContent, plaintext[16:32]},
+		{"bytes=-5", http.StatusPartialContent, plaintext[len(plaintext)-5:]},
+		{"bytes=70-", http.StatusPartialContent, plaintext[70:]},
+		{"bytes=1000-", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.rangeHeader != "" {
+			req.Header.Set("Range", tc.rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Errorf("Range %q: status %d, want %d", tc.rangeHeader, resp.StatusCode, tc.status)
+			continue
+		}
+		if tc.want != nil && !bytes.Equal(body, tc.want) {
+			t.Errorf("Range %q: body %q, want %q", tc.rangeHeader, body, tc.want)
+		}
+	}
+}
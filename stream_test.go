@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+const testStreamChunkSize = 16
+
+// encryptTestStream encrypts plaintext in chunks of testStreamChunkSize,
+// returning the stream and the length of its header.
+func encryptTestStream(t *testing.T, vault KeyWrapper, plaintext []byte) ([]byte, int) {
+	t.Helper()
+	key, err := NewDataKey(context.Background(), vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := newStreamHeader(key, testStreamChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := header.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(&buf, key, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), len(encoded)
+}
+
+func decryptTestStream(vault KeyWrapper, stream []byte) ([]byte, error) {
+	r, err := NewDecryptReader(context.Background(), vault, bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestDecryptReaderRejectsModifiedStreams(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three full chunks: the last one is the final chunk
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 3)
+	stream, headerSize := encryptTestStream(t, vault, plaintext)
+	sealedSize := testStreamChunkSize + 16
+	if len(stream) != headerSize+3*sealedSize {
+		t.Fatalf("stream is %d bytes, want a %d byte header and 3 chunks of %d", len(stream), headerSize, sealedSize)
+	}
+	chunk := func(i int) []byte {
+		return stream[headerSize+i*sealedSize : headerSize+(i+1)*sealedSize]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	decrypted, err := decryptTestStream(vault, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted %q, want %q", decrypted, plaintext)
+	}
+
+	tamperedHeader := append([]byte(nil), stream...)
+	tamperedHeader[len(streamMagic)+1+4] ^= 1 // nonce prefix
+	badMagic := append([]byte(nil), stream...)
+	badMagic[0] ^= 1
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"truncated at a chunk boundary", stream[:headerSize+2*sealedSize]},
+		{"truncated inside a chunk", stream[:len(stream)-1]},
+		{"header only", stream[:headerSize]},
+		{"dropped chunk", join(stream[:headerSize], chunk(0), chunk(2))},
+		{"swapped chunks", join(stream[:headerSize], chunk(1), chunk(0), chunk(2))},
+		{"appended byte", join(stream, []byte{0})},
+		{"appended chunk", join(stream, chunk(2))},
+		{"tampered header", tamperedHeader},
+		{"bad magic", badMagic},
+		{"empty", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decryptTestStream(vault, tc.stream); !errors.Is(err, ErrInvalidCiphertext) {
+				t.Errorf("got %v, want ErrInvalidCiphertext", err)
+			}
+		})
+	}
+}
+
+func TestDecryptReaderEmptyPlaintext(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, headerSize := encryptTestStream(t, vault, nil)
+	if len(stream) != headerSize+16 {
+		t.Fatalf("stream is %d bytes, want a header and an empty final chunk", len(stream))
+	}
+	decrypted, err := decryptTestStream(vault, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decrypted) != 0 {
+		t.Errorf("decrypted %q, want nothing", decrypted)
+	}
+}
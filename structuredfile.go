@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Structured files are YAML, JSON or dotenv files whose values are encrypted
+// one by one while keys, structure and comments stay readable, so reviewers
+// can see which settings a change touches. All values are sealed with one data
+// key, using their path as additional data so they cannot be moved around.
+// A metadata block under the "kvcrypt" key holds the wrapped data key and an
+// encrypted MAC over every value, which catches values being added, removed
+// or reordered.
+
+const (
+	fileMetadataKey   = "kvcrypt"
+	fileFormatVersion = "2"
+	fileValuePrefix   = "ENC[AES256_GCM,data:"
+	fileValueSuffix   = "]"
+)
+
+type fileMetadata struct {
+	KeyID        string `json:"kid"`
+	WrappedKey   string `json:"wrapped_key"`
+	LastModified string `json:"lastmodified"`
+	MAC          string `json:"mac"`
+	Version      string `json:"version"`
+}
+
+// fields lists the metadata in the order it is written.
+func (m *fileMetadata) fields() [][2]string {
+	return [][2]string{
+		{"kid", m.KeyID},
+		{"wrapped_key", m.WrappedKey},
+		{"lastmodified", m.LastModified},
+		{"mac", m.MAC},
+		{"version", m.Version},
+	}
+}
+
+func fileMetadataFromFields(fields map[string]string) (*fileMetadata, error) {
+	m := &fileMetadata{
+		KeyID:        fields["kid"],
+		WrappedKey:   fields["wrapped_key"],
+		LastModified: fields["lastmodified"],
+		MAC:          fields["mac"],
+		Version:      fields["version"],
+	}
+	if m.Version != fileFormatVersion {
+		return nil, fmt.Errorf("unsupported %s metadata version %q", fileMetadataKey, m.Version)
+	}
+	if m.KeyID == "" || m.WrappedKey == "" || m.MAC == "" || m.LastModified == "" {
+		return nil, fmt.Errorf("incomplete %s metadata", fileMetadataKey)
+	}
+	return m, nil
+}
+
+// valueFunc is called with the path and the exact text of every value in a
+// structured file, and returns the text to replace it with.
+type valueFunc func(path, raw string) (string, error)
+
+type fileFormat interface {
+	// transform replaces every value in data, which holds no metadata, with
+	// what fn returns for it.
+	transform(data []byte, fn valueFunc) ([]byte, error)
+	appendMetadata(data []byte, m *fileMetadata) ([]byte, error)
+	// splitMetadata returns data without its metadata block, and the
+	// metadata, which is nil for files that are not encrypted.
+	splitMetadata(data []byte) ([]byte, *fileMetadata, error)
+	// hasMetadataKey reports whether data has a top-level key where the
+	// metadata goes.
+	hasMetadataKey(data []byte) bool
+	// quote and unquote convert between an encrypted value and how it is
+	// written in the file.
+	quote(encrypted string) string
+	unquote(raw string) (string, bool)
+}
+
+func fileFormatByName(name string) (fileFormat, error) {
+	switch name {
+	case "yaml":
+		return yamlFormat{}, nil
+	case "json":
+		return jsonFormat{}, nil
+	case "dotenv":
+		return dotenvFormat{}, nil
+	}
+	return nil, fmt.Errorf("unknown file format %q: expected yaml, json or dotenv", name)
+}
+
+// FileFormatForPath guesses the format of path from its name, returning ""
+// when it cannot tell.
+func FileFormatForPath(path string) string {
+	base := filepath.Base(path)
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	case ".env":
+		return "dotenv"
+	}
+	if base == ".env" || strings.HasPrefix(base, ".env.") {
+		return "dotenv"
+	}
+	return ""
+}
+
+type fileValue struct {
+	plaintext string
+	encrypted string
+}
+
+// EncryptFile encrypts every value of a structured file under a new data key
+// wrapped by w.
+func EncryptFile(ctx context.Context, w KeyWrapper, format string, plaintext []byte) ([]byte, error) {
+	f, err := fileFormatByName(format)
+	if err != nil {
+		return nil, err
+	}
+	_, m, err := f.splitMetadata(plaintext)
+	if m != nil {
+		return nil, errors.New("file is already encrypted")
+	}
+	if f.hasMetadataKey(plaintext) {
+		return nil, fmt.Errorf("file has its own top-level %s key, which is reserved for encryption metadata", fileMetadataKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewDataKey(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFile(f, key, plaintext, nil)
+}
+
+// DecryptFile decrypts a file encrypted by EncryptFile, after checking its MAC.
+func DecryptFile(ctx context.Context, w KeyWrapper, format string, data []byte) ([]byte, error) {
+	f, err := fileFormatByName(format)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, _, err := decryptFile(ctx, w, f, data)
+	return plaintext, err
+}
+
+// ReencryptFile encrypts plaintext, an edited version of the decrypted
+// encrypted file, with the same data key. Values that did not change keep
+// their ciphertext, so diffs only show what was edited.
+func ReencryptFile(ctx context.Context, w KeyWrapper, format string, encrypted, plaintext []byte) ([]byte, error) {
+	f, err := fileFormatByName(format)
+	if err != nil {
+		return nil, err
+	}
+	_, key, previous, err := decryptFile(ctx, w, f, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFile(f, key, plaintext, previous)
+}
+
+// FileKeyID returns the identifier of the key the data key of an encrypted
+// file is wrapped with.
+func FileKeyID(format string, data []byte) (string, error) {
+	f, err := fileFormatByName(format)
+	if err != nil {
+		return "", err
+	}
+	_, m, err := f.splitMetadata(data)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return "", fmt.Errorf("file has no %s metadata: not encrypted", fileMetadataKey)
+	}
+	return m.KeyID, nil
+}
+
+func encryptFile(f fileFormat, key *DataKey, plaintext []byte, previous map[string]fileValue) ([]byte, error) {
+	mac := sha256.New()
+	out, err := f.transform(plaintext, func(path, raw string) (string, error) {
+		if _, ok := f.unquote(raw); ok {
+			return "", fmt.Errorf("%s: value is already encrypted", path)
+		}
+		writeMACValue(mac, path, raw)
+		if p, ok := previous[path]; ok && p.plaintext == raw {
+			return p.encrypted, nil
+		}
+		return f.quote(encodeFileValue(key.Seal([]byte(raw), []byte(path)))), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &fileMetadata{
+		KeyID:        key.KeyID,
+		WrappedKey:   key.Wrapped,
+		LastModified: time.Now().UTC().Format(time.RFC3339),
+		Version:      fileFormatVersion,
+	}
+	m.MAC = encodeFileValue(key.Seal(mac.Sum(nil), []byte(m.LastModified)))
+	return f.appendMetadata(out, m)
+}
+
+func decryptFile(ctx context.Context, w KeyWrapper, f fileFormat, data []byte) ([]byte, *DataKey, map[string]fileValue, error) {
+	body, m, err := f.splitMetadata(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if m == nil {
+		return nil, nil, nil, fmt.Errorf("file has no %s metadata: not encrypted", fileMetadataKey)
+	}
+	key, err := OpenDataKey(ctx, w, m.KeyID, m.WrappedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	mac := sha256.New()
+	values := map[string]fileValue{}
+	plaintext, err := f.transform(body, func(path, raw string) (string, error) {
+		encrypted, ok := f.unquote(raw)
+		if !ok {
+			// left for the MAC check to reject
+			writeMACValue(mac, path, raw)
+			return raw, nil
+		}
+		value, err := decodeFileValue(key, encrypted, path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		writeMACValue(mac, path, value)
+		values[path] = fileValue{plaintext: value, encrypted: raw}
+		return value, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	expected, err := decodeFileValue(key, m.MAC, m.LastModified)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("mac: %w", err)
+	}
+	if !hmac.Equal([]byte(expected), mac.Sum(nil)) {
+		return nil, nil, nil, &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: errors.New("MAC mismatch: values were added, removed or changed outside kvcrypt")}
+	}
+	return plaintext, key, values, nil
+}
+
+func writeMACValue(mac hash.Hash, path, value string) {
+	var n [8]byte
+	for _, s := range []string{path, value} {
+		binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+		mac.Write(n[:])
+		mac.Write([]byte(s))
+	}
+}
+
+func encodeFileValue(ciphertext []byte) string {
+	return fileValuePrefix + base64.StdEncoding.EncodeToString(ciphertext) + fileValueSuffix
+}
+
+func isFileValue(s string) bool {
+	return strings.HasPrefix(s, fileValuePrefix) && strings.HasSuffix(s, fileValueSuffix)
+}
+
+func decodeFileValue(key *DataKey, s, additionalData string) (string, error) {
+	if !isFileValue(s) {
+		return "", &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: errors.New("not an encrypted value")}
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(s, fileValuePrefix), fileValueSuffix))
+	if err != nil {
+		return "", &KeyOperationError{Op: "decrypt", Kind: ErrInvalidCiphertext, Err: err}
+	}
+	plaintext, err := key.Open(ciphertext, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// joinPath builds the path of a value from its keys and indexes, as a list
+// of quoted segments such as ["servers","0","a:b"], so that no two paths
+// are written the same.
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return "[" + strconv.Quote(name) + "]"
+	}
+	return strings.TrimSuffix(parent, "]") + "," + strconv.Quote(name) + "]"
+}
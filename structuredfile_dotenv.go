@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dotenvFormat encrypts the value of every KEY=value line. Quoted values may
+// span several lines.
+type dotenvFormat struct{}
+
+var dotenvKeyRegexp = regexp.MustCompile(`^(export\s+)?([A-Za-z_][A-Za-z0-9_.-]*)\s*=`)
+
+func dotenvMetadataKey(field string) string {
+	return strings.ToUpper(fileMetadataKey + "_" + field)
+}
+
+func (dotenvFormat) transform(data []byte, fn valueFunc) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	var out strings.Builder
+
+	for i := 0; i < len(lines); i++ {
+		text := strings.TrimRight(lines[i], "\r\n")
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			out.WriteString(lines[i])
+			continue
+		}
+
+		match := dotenvKeyRegexp.FindStringSubmatchIndex(text)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: expected KEY=value", i+1)
+		}
+		key := text[match[4]:match[5]]
+		valueStart := match[1]
+
+		// a quoted value continues until its closing quote
+		raw := text[valueStart:]
+		last := i
+		if v := strings.TrimLeft(raw, " "); v != "" && (v[0] == '"' || v[0] == '\'') && closingQuote(v) < 0 {
+			for last = i + 1; last < len(lines); last++ {
+				raw += lines[last-1][len(strings.TrimRight(lines[last-1], "\r\n")):] + strings.TrimRight(lines[last], "\r\n")
+				if strings.ContainsRune(lines[last], rune(v[0])) {
+					break
+				}
+			}
+			if last == len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated quoted value for %s", i+1, key)
+			}
+		}
+
+		replacement, err := fn(key, raw)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(text[:valueStart] + replacement + lines[last][len(strings.TrimRight(lines[last], "\r\n")):])
+		i = last
+	}
+	return []byte(out.String()), nil
+}
+
+func (dotenvFormat) appendMetadata(data []byte, m *fileMetadata) ([]byte, error) {
+	out := string(data)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	for _, f := range m.fields() {
+		out += dotenvMetadataKey(f[0]) + "=" + f[1] + "\n"
+	}
+	return []byte(out), nil
+}
+
+func (dotenvFormat) splitMetadata(data []byte) ([]byte, *fileMetadata, error) {
+	names := map[string]string{}
+	for _, f := range (&fileMetadata{}).fields() {
+		names[dotenvMetadataKey(f[0])] = f[0]
+	}
+
+	var body strings.Builder
+	fields := map[string]string{}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if i := strings.IndexByte(line, '='); i > 0 {
+			if field, ok := names[line[:i]]; ok {
+				fields[field] = strings.TrimSpace(line[i+1:])
+				continue
+			}
+		}
+		body.WriteString(line)
+	}
+	if len(fields) == 0 {
+		return data, nil, nil
+	}
+
+	m, err := fileMetadataFromFields(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(body.String()), m, nil
+}
+
+func (dotenvFormat) hasMetadataKey(data []byte) bool {
+	names := map[string]bool{}
+	for _, f := range (&fileMetadata{}).fields() {
+		names[dotenvMetadataKey(f[0])] = true
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := dotenvKeyRegexp.FindStringSubmatch(strings.TrimSpace(line)); match != nil && names[match[2]] {
+			return true
+		}
+	}
+	return false
+}
+
+func (dotenvFormat) quote(encrypted string) string {
+	return encrypted
+}
+
+func (dotenvFormat) unquote(raw string) (string, bool) {
+	return raw, isFileValue(raw)
+}
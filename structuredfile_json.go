@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// jsonFormat rewrites values in place, so the file keeps its formatting and
+// member order.
+type jsonFormat struct{}
+
+type jsonLeaf struct {
+	path       string
+	start, end int
+}
+
+// jsonSegment is a step of the path to a JSON value: a member key, or an
+// array index when index is not negative.
+type jsonSegment struct {
+	key   string
+	index int
+}
+
+// jsonNode is any value of the document, objects and arrays included.
+type jsonNode struct {
+	segments   []jsonSegment
+	start, end int
+	object     bool
+}
+
+// jsonMember is a member of the top-level object, from its key to the end of
+// its value.
+type jsonMember struct {
+	key        string
+	start, end int
+}
+
+type jsonScanner struct {
+	data    []byte
+	pos     int
+	leaves  []jsonLeaf
+	members []jsonMember
+	// nodes lists every value in document order, parents before children.
+	nodes []jsonNode
+	stack []jsonSegment
+}
+
+func scanJSON(data []byte) (*jsonScanner, error) {
+	s, err := scanJSONValue(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.nodes) == 0 || !s.nodes[0].object {
+		return nil, errors.New("JSON file must hold an object")
+	}
+	return s, nil
+}
+
+// scanJSONValue scans a document holding any JSON value.
+func scanJSONValue(data []byte) (*jsonScanner, error) {
+	if !json.Valid(data) {
+		var v interface{}
+		return nil, json.Unmarshal(data, &v)
+	}
+	s := &jsonScanner{data: data}
+	s.skipSpace()
+	s.value("", data[s.pos] == '{')
+	return s, nil
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) && strings.IndexByte(" \t\r\n", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+}
+
+// value scans the valid JSON value at s.pos.
+func (s *jsonScanner) value(path string, top bool) {
+	s.skipSpace()
+	n := len(s.nodes)
+	s.nodes = append(s.nodes, jsonNode{
+		segments: append([]jsonSegment(nil), s.stack...),
+		start:    s.pos,
+		object:   s.data[s.pos] == '{',
+	})
+	defer func() { s.nodes[n].end = s.pos }()
+
+	switch s.data[s.pos] {
+	case '{':
+		s.pos++
+		for {
+			s.skipSpace()
+			if s.data[s.pos] == '}' {
+				s.pos++
+				return
+			}
+			start := s.pos
+			s.str()
+			var key string
+			json.Unmarshal(s.data[start:s.pos], &key)
+			s.skipSpace()
+			s.pos++ // ':'
+			s.stack = append(s.stack, jsonSegment{key: key, index: -1})
+			s.value(joinPath(path, key), false)
+			s.stack = s.stack[:len(s.stack)-1]
+			if top {
+				s.members = append(s.members, jsonMember{key: key, start: start, end: s.pos})
+			}
+			s.skipSpace()
+			if s.data[s.pos] == ',' {
+				s.pos++
+			}
+		}
+	case '[':
+		s.pos++
+		for i := 0; ; i++ {
+			s.skipSpace()
+			if s.data[s.pos] == ']' {
+				s.pos++
+				return
+			}
+			s.stack = append(s.stack, jsonSegment{index: i})
+			s.value(joinPath(path, strconv.Itoa(i)), false)
+			s.stack = s.stack[:len(s.stack)-1]
+			s.skipSpace()
+			if s.data[s.pos] == ',' {
+				s.pos++
+			}
+		}
+	case '"':
+		start := s.pos
+		s.str()
+		s.leaves = append(s.leaves, jsonLeaf{path: path, start: start, end: s.pos})
+	default:
+		start := s.pos
+		for s.pos < len(s.data) && strings.IndexByte(",]} \t\r\n", s.data[s.pos]) < 0 {
+			s.pos++
+		}
+		s.leaves = append(s.leaves, jsonLeaf{path: path, start: start, end: s.pos})
+	}
+}
+
+func (s *jsonScanner) str() {
+	s.pos++
+	for s.data[s.pos] != '"' {
+		if s.data[s.pos] == '\\' {
+			s.pos++
+		}
+		s.pos++
+	}
+	s.pos++
+}
+
+func (jsonFormat) transform(data []byte, fn valueFunc) ([]byte, error) {
+	s, err := scanJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	last := 0
+	for _, leaf := range s.leaves {
+		replacement, err := fn(leaf.path, string(data[leaf.start:leaf.end]))
+		if err != nil {
+			return nil, err
+		}
+		out.Write(data[last:leaf.start])
+		out.WriteString(replacement)
+		last = leaf.end
+	}
+	out.Write(data[last:])
+	return out.Bytes(), nil
+}
+
+func (jsonFormat) appendMetadata(data []byte, m *fileMetadata) ([]byte, error) {
+	s, err := scanJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	end := bytes.LastIndexByte(data, '}')
+	head := bytes.TrimRight(data[:end], " \t\r\n")
+	separator := ""
+	if len(s.members) > 0 {
+		separator = ","
+	}
+
+	var out bytes.Buffer
+	out.Write(head)
+	if i := bytes.IndexByte(data, '\n'); i >= 0 && i < end {
+		indent := "  "
+		if len(s.members) > 0 {
+			lineStart := bytes.LastIndexByte(data[:s.members[0].start], '\n') + 1
+			indent = string(data[lineStart:s.members[0].start])
+		}
+		metadata, err := json.MarshalIndent(m, indent, indent)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(separator + "\n" + indent + strconv.Quote(fileMetadataKey) + ": ")
+		out.Write(metadata)
+		out.WriteString("\n")
+	} else {
+		metadata, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(separator + strconv.Quote(fileMetadataKey) + ":")
+		out.Write(metadata)
+	}
+	out.Write(data[end:])
+	return out.Bytes(), nil
+}
+
+func (jsonFormat) splitMetadata(data []byte) ([]byte, *fileMetadata, error) {
+	s, err := scanJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, member := range s.members {
+		if member.key != fileMetadataKey {
+			continue
+		}
+
+		var raw struct {
+			Value map[string]string `json:"kvcrypt"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, nil, err
+		}
+		m, err := fileMetadataFromFields(raw.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start, end := member.start, member.end
+		switch {
+		case i > 0:
+			start = s.members[i-1].end
+		case len(s.members) > 1:
+			end = s.members[1].start
+		}
+		body := append(append([]byte(nil), data[:start]...), data[end:]...)
+		return body, m, nil
+	}
+	return data, nil, nil
+}
+
+func (jsonFormat) hasMetadataKey(data []byte) bool {
+	s, err := scanJSON(data)
+	if err != nil {
+		return false
+	}
+	for _, member := range s.members {
+		if member.key == fileMetadataKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (jsonFormat) quote(encrypted string) string {
+	return strconv.Quote(encrypted)
+}
+
+func (jsonFormat) unquote(raw string) (string, bool) {
+	var s string
+	if !strings.HasPrefix(raw, `"`) || json.Unmarshal([]byte(raw), &s) != nil || !isFileValue(s) {
+		return "", false
+	}
+	return s, true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestYAMLBlockScalarTrailingComment(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	plaintext := "script: |\n  echo hi\n  # secret trailing line\nother: x\n"
+
+	encrypted, err := EncryptFile(ctx, vault, "yaml", []byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encrypted), "secret trailing line") {
+		t.Fatalf("comment line of a block scalar left in plaintext:\n%s", encrypted)
+	}
+	decrypted, err := DecryptFile(ctx, vault, "yaml", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != plaintext {
+		t.Errorf("round trip = %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestFilePathsAreUnambiguous(t *testing.T) {
+	paths := map[string]string{
+		joinPath("", "a:b"):               "a:b",
+		joinPath(joinPath("", "a"), "b"):  "a.b",
+		joinPath("", "a\",\"b"):           "a\",\"b",
+		joinPath(joinPath("", "a"), "0"):  "a.0",
+		joinPath(joinPath("", "a]"), "0"): "a].0",
+		joinPath(joinPath("", "a"), "0]"): "a.0]",
+	}
+	if len(paths) != 6 {
+		t.Errorf("distinct values share additional data: %v", paths)
+	}
+}
+
+func TestEncryptFileRefusesMetadataKey(t *testing.T) {
+	vault, err := NewFakeVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ format, data string }{
+		{"yaml", "kvcrypt: mine\nother: x\n"},
+		{"yaml", "kvcrypt:\n  nested: x\n"},
+		{"json", `{"kvcrypt": {"a": "b"}}`},
+		{"dotenv", "KVCRYPT_MAC=x\n"},
+	} {
+		if _, err := EncryptFile(context.Background(), vault, c.format, []byte(c.data)); err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("EncryptFile(%s, %q) = %v, want the reserved key refused", c.format, c.data, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlFormat works line by line rather than through a YAML library, so that
+// comments, quoting and layout survive encryption untouched. It handles block
+// mappings and sequences with any scalar, flow collection or block scalar as
+// values, which covers configuration files; complex keys and multiple
+// documents are rejected.
+type yamlFormat struct{}
+
+type yamlFrame struct {
+	indent int
+	name   string
+	seq    bool
+	index  int
+}
+
+type yamlLine struct {
+	text    string // without line ending
+	ending  string
+	indent  int
+	content bool
+}
+
+func splitYAMLLines(data []byte) []yamlLine {
+	var lines []yamlLine
+	for _, l := range strings.SplitAfter(string(data), "\n") {
+		if l == "" {
+			continue
+		}
+		text := strings.TrimRight(l, "\r\n")
+		trimmed := strings.TrimLeft(text, " ")
+		lines = append(lines, yamlLine{
+			text:    text,
+			ending:  l[len(text):],
+			indent:  len(text) - len(trimmed),
+			content: trimmed != "" && !strings.HasPrefix(trimmed, "#"),
+		})
+	}
+	return lines
+}
+
+func (yamlFormat) transform(data []byte, fn valueFunc) ([]byte, error) {
+	lines := splitYAMLLines(data)
+	var out strings.Builder
+	var frames []yamlFrame
+	started := false
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !line.content {
+			out.WriteString(line.text + line.ending)
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(line.text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in YAML indentation", i+1)
+		}
+		if line.indent == 0 && (line.text == "---" || line.text == "..." || strings.HasPrefix(line.text, "%")) {
+			if started {
+				return nil, fmt.Errorf("line %d: multiple YAML documents are not supported", i+1)
+			}
+			out.WriteString(line.text + line.ending)
+			continue
+		}
+		started = true
+
+		var path string
+		var owner int
+		pos := line.indent
+		valueStart := -1
+		for valueStart < 0 {
+			content := line.text[pos:]
+			if content == "-" || strings.HasPrefix(content, "- ") {
+				// a sequence item, possibly holding the first key of a mapping
+				index := 0
+				for len(frames) > 0 && frames[len(frames)-1].indent > pos {
+					frames = frames[:len(frames)-1]
+				}
+				if n := len(frames); n > 0 && frames[n-1].seq && frames[n-1].indent == pos {
+					index = frames[n-1].index + 1
+					frames = frames[:n-1]
+				}
+				frames = append(frames, yamlFrame{indent: pos, name: strconv.Itoa(index), seq: true, index: index})
+
+				owner = pos
+				pos++
+				for pos < len(line.text) && line.text[pos] == ' ' {
+					pos++
+				}
+				rest := line.text[pos:]
+				if rest == "" || strings.HasPrefix(rest, "#") {
+					break
+				}
+				if _, _, ok := yamlKey(rest); !ok {
+					path = yamlPath(frames)
+					valueStart = pos
+				}
+				continue
+			}
+
+			key, offset, ok := yamlKey(content)
+			if !ok {
+				return nil, fmt.Errorf("line %d: unsupported YAML: %s", i+1, strings.TrimSpace(content))
+			}
+			for len(frames) > 0 && frames[len(frames)-1].indent >= pos {
+				frames = frames[:len(frames)-1]
+			}
+			value := content[offset:]
+			if value == "" || strings.HasPrefix(value, "#") || isYAMLProperty(value) {
+				// the value is the nested block on the following lines
+				frames = append(frames, yamlFrame{indent: pos, name: key})
+				break
+			}
+			path = joinPath(yamlPath(frames), key)
+			owner = pos
+			valueStart = pos + offset
+		}
+
+		if valueStart < 0 {
+			out.WriteString(line.text + line.ending)
+			continue
+		}
+
+		// values continue on following lines indented past their owner,
+		// comment lines included: in a block scalar they are content
+		last := i
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j].text) == "" {
+				continue
+			}
+			if lines[j].indent <= owner {
+				break
+			}
+			last = j
+		}
+
+		raw, suffix := line.text[valueStart:], ""
+		ending := line.ending
+		if last == i {
+			raw, suffix = splitYAMLComment(raw)
+		} else {
+			for j := i + 1; j <= last; j++ {
+				raw += lines[j-1].ending + lines[j].text
+			}
+			ending = lines[last].ending
+		}
+
+		replacement, err := fn(path, raw)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(line.text[:valueStart] + replacement + suffix + ending)
+		i = last
+	}
+	return []byte(out.String()), nil
+}
+
+func yamlPath(frames []yamlFrame) string {
+	path := ""
+	for _, f := range frames {
+		path = joinPath(path, f.name)
+	}
+	return path
+}
+
+// yamlKey parses the key of a "key: value" line, returning the offset of the
+// value.
+func yamlKey(content string) (string, int, bool) {
+	if strings.HasPrefix(content, "? ") {
+		return "", 0, false
+	}
+
+	end := 0
+	if content[0] == '"' || content[0] == '\'' {
+		end = closingQuote(content)
+		if end < 0 {
+			return "", 0, false
+		}
+	}
+	for i := end; i < len(content); i++ {
+		if content[i] == '#' && i > 0 && content[i-1] == ' ' {
+			return "", 0, false
+		}
+		if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ') {
+			if i == 0 || strings.ContainsAny(content[:1], "[{|>&*!%@`") {
+				return "", 0, false
+			}
+			key := strings.TrimRight(content[:i], " ")
+			offset := i + 1
+			for offset < len(content) && content[offset] == ' ' {
+				offset++
+			}
+			return key, offset, true
+		}
+	}
+	return "", 0, false
+}
+
+// closingQuote returns the index just past the quoted string content starts
+// with, or -1 if it does not end on this line.
+func closingQuote(content string) int {
+	quote := content[0]
+	for i := 1; i < len(content); i++ {
+		switch {
+		case quote == '"' && content[i] == '\\':
+			i++
+		case content[i] == quote && quote == '\'' && i+1 < len(content) && content[i+1] == '\'':
+			i++
+		case content[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// isYAMLProperty reports whether value is only an anchor or a tag, which
+// then applies to the nested block that follows.
+func isYAMLProperty(value string) bool {
+	value, _ = splitYAMLComment(value)
+	return (strings.HasPrefix(value, "&") || strings.HasPrefix(value, "!")) && !strings.Contains(value, " ")
+}
+
+// splitYAMLComment splits a single line value from its trailing comment.
+func splitYAMLComment(value string) (string, string) {
+	end := len(value)
+	start := 0
+	if value[0] == '"' || value[0] == '\'' {
+		if start = closingQuote(value); start < 0 {
+			start = 0
+		}
+	}
+	if i := strings.Index(value[start:], " #"); i >= 0 {
+		end = start + i
+	}
+	trimmed := strings.TrimRight(value[:end], " ")
+	return trimmed, value[len(trimmed):]
+}
+
+func (yamlFormat) appendMetadata(data []byte, m *fileMetadata) ([]byte, error) {
+	out := string(data)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	out += fileMetadataKey + ":\n"
+	for _, f := range m.fields() {
+		out += "    " + f[0] + ": " + f[1] + "\n"
+	}
+	return []byte(out), nil
+}
+
+func (yamlFormat) splitMetadata(data []byte) ([]byte, *fileMetadata, error) {
+	lines := splitYAMLLines(data)
+	for i, line := range lines {
+		if !line.content || line.indent != 0 || strings.TrimRight(line.text, " ") != fileMetadataKey+":" {
+			continue
+		}
+
+		fields := map[string]string{}
+		end := i + 1
+		for ; end < len(lines) && (!lines[end].content || lines[end].indent > 0); end++ {
+			if !lines[end].content {
+				continue
+			}
+			field := strings.TrimSpace(lines[end].text)
+			if j := strings.Index(field, ": "); j > 0 {
+				fields[field[:j]] = strings.TrimSpace(field[j+2:])
+			}
+		}
+		m, err := fileMetadataFromFields(fields)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var body strings.Builder
+		for _, l := range append(lines[:i:i], lines[end:]...) {
+			body.WriteString(l.text + l.ending)
+		}
+		return []byte(body.String()), m, nil
+	}
+	return data, nil, nil
+}
+
+func (yamlFormat) hasMetadataKey(data []byte) bool {
+	for _, line := range splitYAMLLines(data) {
+		if !line.content || line.indent != 0 {
+			continue
+		}
+		if key, _, ok := yamlKey(line.text); ok && key == fileMetadataKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (yamlFormat) quote(encrypted string) string {
+	return encrypted
+}
+
+func (yamlFormat) unquote(raw string) (string, bool) {
+	return raw, isFileValue(raw)
+}
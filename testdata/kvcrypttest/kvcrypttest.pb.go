@@ -0,0 +1,300 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: testdata/kvcrypttest/kvcrypttest.proto
+
+package kvcrypttest
+
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Customer struct {
+	Name      string              `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Ssn       string              `protobuf:"bytes,2,opt,name=ssn,proto3" json:"ssn,omitempty"`
+	Photo     []byte              `protobuf:"bytes,3,opt,name=photo,proto3" json:"photo,omitempty"`
+	Avatar    []byte              `protobuf:"bytes,4,opt,name=avatar,proto3" json:"avatar,omitempty"`
+	Address   *Address            `protobuf:"bytes,5,opt,name=address,proto3" json:"address,omitempty"`
+	Cards     []*Card             `protobuf:"bytes,6,rep,name=cards,proto3" json:"cards,omitempty"`
+	Notes     []string            `protobuf:"bytes,7,rep,name=notes,proto3" json:"notes,omitempty"`
+	Addresses map[string]*Address `protobuf:"bytes,8,rep,name=addresses,proto3" json:"addresses,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// Types that are valid to be assigned to Contact:
+	//	*Customer_Email
+	//	*Customer_Phone
+	Contact              isCustomer_Contact `protobuf_oneof:"contact"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
+}
+
+func (m *Customer) Reset()         { *m = Customer{} }
+func (m *Customer) String() string { return proto.CompactTextString(m) }
+func (*Customer) ProtoMessage()    {}
+func (*Customer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_d4880d85939751b3, []int{0}
+}
+
+func (m *Customer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Customer.Unmarshal(m, b)
+}
+func (m *Customer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Customer.Marshal(b, m, deterministic)
+}
+func (m *Customer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Customer.Merge(m, src)
+}
+func (m *Customer) XXX_Size() int {
+	return xxx_messageInfo_Customer.Size(m)
+}
+func (m *Customer) XXX_DiscardUnknown() {
+	xxx_messageInfo_Customer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Customer proto.InternalMessageInfo
+
+func (m *Customer) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Customer) GetSsn() string {
+	if m != nil {
+		return m.Ssn
+	}
+	return ""
+}
+
+func (m *Customer) GetPhoto() []byte {
+	if m != nil {
+		return m.Photo
+	}
+	return nil
+}
+
+func (m *Customer) GetAvatar() []byte {
+	if m != nil {
+		return m.Avatar
+	}
+	return nil
+}
+
+func (m *Customer) GetAddress() *Address {
+	if m != nil {
+		return m.Address
+	}
+	return nil
+}
+
+func (m *Customer) GetCards() []*Card {
+	if m != nil {
+		return m.Cards
+	}
+	return nil
+}
+
+func (m *Customer) GetNotes() []string {
+	if m != nil {
+		return m.Notes
+	}
+	return nil
+}
+
+func (m *Customer) GetAddresses() map[string]*Address {
+	if m != nil {
+		return m.Addresses
+	}
+	return nil
+}
+
+type isCustomer_Contact interface {
+	isCustomer_Contact()
+}
+
+type Customer_Email struct {
+	Email string `protobuf:"bytes,9,opt,name=email,proto3,oneof"`
+}
+
+type Customer_Phone struct {
+	Phone string `protobuf:"bytes,10,opt,name=phone,proto3,oneof"`
+}
+
+func (*Customer_Email) isCustomer_Contact() {}
+
+func (*Customer_Phone) isCustomer_Contact() {}
+
+func (m *Customer) GetContact() isCustomer_Contact {
+	if m != nil {
+		return m.Contact
+	}
+	return nil
+}
+
+func (m *Customer) GetEmail() string {
+	if x, ok := m.GetContact().(*Customer_Email); ok {
+		return x.Email
+	}
+	return ""
+}
+
+func (m *Customer) GetPhone() string {
+	if x, ok := m.GetContact().(*Customer_Phone); ok {
+		return x.Phone
+	}
+	return ""
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*Customer) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*Customer_Email)(nil),
+		(*Customer_Phone)(nil),
+	}
+}
+
+type Address struct {
+	Street               string   `protobuf:"bytes,1,opt,name=street,proto3" json:"street,omitempty"`
+	City                 string   `protobuf:"bytes,2,opt,name=city,proto3" json:"city,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Address) Reset()         { *m = Address{} }
+func (m *Address) String() string { return proto.CompactTextString(m) }
+func (*Address) ProtoMessage()    {}
+func (*Address) Descriptor() ([]byte, []int) {
+	return fileDescriptor_d4880d85939751b3, []int{1}
+}
+
+func (m *Address) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Address.Unmarshal(m, b)
+}
+func (m *Address) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Address.Marshal(b, m, deterministic)
+}
+func (m *Address) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Address.Merge(m, src)
+}
+func (m *Address) XXX_Size() int {
+	return xxx_messageInfo_Address.Size(m)
+}
+func (m *Address) XXX_DiscardUnknown() {
+	xxx_messageInfo_Address.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Address proto.InternalMessageInfo
+
+func (m *Address) GetStreet() string {
+	if m != nil {
+		return m.Street
+	}
+	return ""
+}
+
+func (m *Address) GetCity() string {
+	if m != nil {
+		return m.City
+	}
+	return ""
+}
+
+type Card struct {
+	Number               string   `protobuf:"bytes,1,opt,name=number,proto3" json:"number,omitempty"`
+	Brand                string   `protobuf:"bytes,2,opt,name=brand,proto3" json:"brand,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Card) Reset()         { *m = Card{} }
+func (m *Card) String() string { return proto.CompactTextString(m) }
+func (*Card) ProtoMessage()    {}
+func (*Card) Descriptor() ([]byte, []int) {
+	return fileDescriptor_d4880d85939751b3, []int{2}
+}
+
+func (m *Card) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Card.Unmarshal(m, b)
+}
+func (m *Card) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Card.Marshal(b, m, deterministic)
+}
+func (m *Card) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Card.Merge(m, src)
+}
+func (m *Card) XXX_Size() int {
+	return xxx_messageInfo_Card.Size(m)
+}
+func (m *Card) XXX_DiscardUnknown() {
+	xxx_messageInfo_Card.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Card proto.InternalMessageInfo
+
+func (m *Card) GetNumber() string {
+	if m != nil {
+		return m.Number
+	}
+	return ""
+}
+
+func (m *Card) GetBrand() string {
+	if m != nil {
+		return m.Brand
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*Customer)(nil), "kvcrypttest.Customer")
+	proto.RegisterMapType((map[string]*Address)(nil), "kvcrypttest.Customer.AddressesEntry")
+	proto.RegisterType((*Address)(nil), "kvcrypttest.Address")
+	proto.RegisterType((*Card)(nil), "kvcrypttest.Card")
+}
+
+func init() {
+	proto.RegisterFile("testdata/kvcrypttest/kvcrypttest.proto", fileDescriptor_d4880d85939751b3)
+}
+
+var fileDescriptor_d4880d85939751b3 = []byte{
+	// 414 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x92, 0x51, 0x8b, 0x13, 0x31,
+	0x10, 0xc7, 0x6f, 0x6f, 0xbb, 0xed, 0x75, 0xaa, 0xa2, 0xe1, 0x28, 0xa1, 0xdc, 0xc3, 0x52, 0x44,
+	0x8b, 0xd0, 0x16, 0xce, 0x17, 0x39, 0x9f, 0xec, 0x21, 0x28, 0xbe, 0xe5, 0x49, 0x7c, 0x9b, 0xee,
+	0x0e, 0x77, 0x4b, 0x77, 0x93, 0x92, 0xcc, 0x16, 0xf6, 0xcd, 0x8f, 0xe5, 0x37, 0xf2, 0x6b, 0x48,
+	0x36, 0x39, 0xdb, 0x82, 0xf8, 0x36, 0xf3, 0xfb, 0xcf, 0x4c, 0x26, 0xff, 0x04, 0xde, 0x30, 0x39,
+	0x2e, 0x91, 0x71, 0xbd, 0x3b, 0x14, 0xb6, 0xdb, 0xb3, 0xcf, 0x4f, 0xe3, 0xd5, 0xde, 0x1a, 0x36,
+	0x62, 0x72, 0x82, 0x66, 0xcf, 0x63, 0x12, 0xb4, 0xf9, 0xaf, 0x14, 0xae, 0xee, 0x5b, 0xc7, 0xa6,
+	0x21, 0x2b, 0x04, 0x0c, 0x34, 0x36, 0x24, 0x93, 0x3c, 0x59, 0x8c, 0x55, 0x1f, 0x8b, 0x29, 0xa4,
+	0xce, 0x69, 0x79, 0xe9, 0xd1, 0x66, 0xf0, 0xf3, 0xb7, 0x4c, 0x94, 0x07, 0x62, 0x06, 0xd9, 0xfe,
+	0xd1, 0xb0, 0x91, 0x69, 0x9e, 0x2c, 0x9e, 0x45, 0x25, 0x20, 0x31, 0x85, 0x21, 0x1e, 0x90, 0xd1,
+	0xca, 0x81, 0x17, 0x55, 0xcc, 0xc4, 0x0a, 0x46, 0x58, 0x96, 0x96, 0x9c, 0x93, 0x59, 0x9e, 0x2c,
+	0x26, 0xb7, 0xd7, 0xab, 0xd3, 0x6d, 0x3f, 0x05, 0x4d, 0x3d, 0x15, 0x89, 0xb7, 0x90, 0x15, 0x68,
+	0x4b, 0x27, 0x87, 0x79, 0xba, 0x98, 0xdc, 0xbe, 0x3a, 0xab, 0xbe, 0x47, 0x5b, 0xaa, 0xa0, 0xfb,
+	0x65, 0xb4, 0x61, 0x72, 0x72, 0x94, 0xa7, 0x7f, 0xd7, 0x0c, 0x48, 0x6c, 0x60, 0x1c, 0xe7, 0x91,
+	0x93, 0x57, 0xfd, 0xa0, 0xd7, 0xe7, 0x83, 0xe2, 0xf5, 0x9f, 0xce, 0x27, 0xf7, 0x59, 0xb3, 0xed,
+	0xd4, 0xb1, 0x4d, 0xdc, 0x40, 0x46, 0x0d, 0x56, 0xb5, 0x1c, 0x1f, 0x6d, 0xf8, 0x72, 0xa1, 0x02,
+	0x14, 0xd3, 0xde, 0x0a, 0x4d, 0x12, 0xbc, 0xea, 0x79, 0x9f, 0xce, 0x14, 0xbc, 0x38, 0x1f, 0x29,
+	0x5e, 0x42, 0xba, 0xa3, 0x2e, 0xfa, 0xeb, 0x43, 0xf1, 0x0e, 0xb2, 0x03, 0xd6, 0x2d, 0xc9, 0xcb,
+	0xff, 0x18, 0x12, 0x4a, 0xee, 0x2e, 0x3f, 0x24, 0x9b, 0x31, 0x8c, 0x0a, 0xa3, 0x19, 0x0b, 0x9e,
+	0x7f, 0x84, 0x51, 0x2c, 0x10, 0x37, 0x30, 0x74, 0x6c, 0x89, 0x58, 0x26, 0xc7, 0x05, 0x55, 0x64,
+	0xfe, 0x59, 0x8b, 0x8a, 0xbb, 0xf0, 0x86, 0xaa, 0x8f, 0xe7, 0x77, 0x30, 0xf0, 0x06, 0xfa, 0x4e,
+	0xdd, 0x36, 0x5b, 0xb2, 0xe7, 0x9d, 0x81, 0x89, 0x6b, 0xc8, 0xb6, 0x16, 0x75, 0x19, 0x5b, 0x43,
+	0xb2, 0xf9, 0xf6, 0xe3, 0xeb, 0x43, 0xc5, 0x8f, 0xed, 0x76, 0x55, 0x98, 0x66, 0x8d, 0x75, 0x8d,
+	0x9a, 0xd1, 0x3e, 0x54, 0xda, 0xac, 0x77, 0xd4, 0x2d, 0x0f, 0xd8, 0xd6, 0xbc, 0x24, 0xdd, 0xdf,
+	0x63, 0x69, 0xf6, 0x64, 0x91, 0x2b, 0xa3, 0xdd, 0xfa, 0x5f, 0xdf, 0xf5, 0xfb, 0xc5, 0x76, 0xd8,
+	0xff, 0xc4, 0xf7, 0x7f, 0x06, 0x00, 0x5f, 0x0c, 0x85, 0x0e, 0xcf, 0x02, 0x00, 0x00,
+}
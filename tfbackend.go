@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStateHistory = 20
+	maxStateBytes       = 64 << 20
+	maxLockInfoBytes    = 64 << 10
+
+	// Store keys under a state's name. Name segments cannot start with a dot,
+	// so these never collide with nested state names.
+	stateKey      = ".state"
+	lockKey       = ".lock"
+	historyPrefix = ".history/"
+)
+
+var stateNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(/[A-Za-z0-9][A-Za-z0-9._-]*)*$`)
+
+// TerraformBackend implements Terraform's HTTP backend protocol. The URL path
+// names the state; state is envelope encrypted before it reaches the store,
+// and every version written is kept as history.
+type TerraformBackend struct {
+	store   StateStore
+	wrapper KeyWrapper
+	history int
+
+	// mu serializes writes, so the serial checks and the write they guard
+	// happen atomically within this process.
+	mu sync.Mutex
+}
+
+// storedState is a state version as kept in the store. Lineage and serial stay
+// in plaintext so writes can be checked without unwrapping the data key.
+type storedState struct {
+	Lineage string    `json:"lineage"`
+	Serial  uint64    `json:"serial"`
+	Saved   time.Time `json:"saved"`
+	Envelope
+}
+
+// StateVersion describes one entry of a state's history.
+type StateVersion struct {
+	Version string    `json:"version"`
+	Lineage string    `json:"lineage"`
+	Serial  uint64    `json:"serial"`
+	Saved   time.Time `json:"saved"`
+}
+
+// lockInfo is the part of Terraform's lock info the backend looks at; the
+// rest is stored and returned as sent.
+type lockInfo struct {
+	ID string `json:"ID"`
+}
+
+// NewTerraformBackend keeps up to history previous versions of each state.
+func NewTerraformBackend(store StateStore, wrapper KeyWrapper, history int) *TerraformBackend {
+	if history < 0 {
+		history = defaultStateHistory
+	}
+	return &TerraformBackend{store: store, wrapper: wrapper, history: history}
+}
+
+func (b *TerraformBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if !stateNameRegexp.MatchString(name) {
+		http.Error(w, "invalid state name: "+name, http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := r.URL.Query()["history"]; ok {
+			err = b.listHistory(w, r, name)
+		} else {
+			err = b.get(w, r, name)
+		}
+	case http.MethodPost:
+		err = b.put(w, r, name)
+	case http.MethodDelete:
+		err = b.delete(w, r, name)
+	case "LOCK":
+		err = b.lock(w, r, name)
+	case "UNLOCK":
+		err = b.unlock(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE, LOCK, UNLOCK")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		status, _ := errorStatus(err)
+		slog.WarnContext(r.Context(), "terraform backend request failed", slog.String("method", r.Method), slog.String("state", name), slog.String("error", err.Error()))
+		if status >= http.StatusInternalServerError {
+			err = errors.New(strings.ToLower(http.StatusText(status)))
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (b *TerraformBackend) get(w http.ResponseWriter, r *http.Request, name string) error {
+	key := name + "/" + stateKey
+	if version := r.URL.Query().Get("version"); version != "" {
+		if !stateNameRegexp.MatchString(version) || strings.Contains(version, "/") {
+			return &badRequestError{fmt.Errorf("invalid version: %s", version)}
+		}
+		key = name + "/" + historyPrefix + version
+	}
+
+	stored, err := b.read(r.Context(), key)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state, err := OpenEnvelope(r.Context(), b.wrapper, &stored.Envelope, []byte(name))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(state)
+	return nil
+}
+
+func (b *TerraformBackend) put(w http.ResponseWriter, r *http.Request, name string) error {
+	state, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateBytes))
+	if err != nil {
+		return &badRequestError{fmt.Errorf("state exceeds %d bytes", maxStateBytes)}
+	}
+	var header struct {
+		Lineage string `json:"lineage"`
+		Serial  uint64 `json:"serial"`
+	}
+	if err := json.Unmarshal(state, &header); err != nil {
+		return &badRequestError{fmt.Errorf("invalid state: %v", err)}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok, err := b.holdsLock(w, r, name); !ok || err != nil {
+		return err
+	}
+
+	// optimistic concurrency: refuse writes based on an older or unrelated state
+	current, err := b.read(r.Context(), name+"/"+stateKey)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if current.Lineage != "" && header.Lineage != current.Lineage {
+			http.Error(w, fmt.Sprintf("state lineage %s does not match stored lineage %s", header.Lineage, current.Lineage), http.StatusConflict)
+			return nil
+		}
+		if header.Serial < current.Serial {
+			http.Error(w, fmt.Sprintf("state serial %d is older than stored serial %d", header.Serial, current.Serial), http.StatusConflict)
+			return nil
+		}
+	}
+
+	envelope, err := SealEnvelope(r.Context(), b.wrapper, state, []byte(name))
+	if err != nil {
+		return err
+	}
+	saved := time.Now().UTC()
+	data, err := json.Marshal(storedState{Lineage: header.Lineage, Serial: header.Serial, Saved: saved, Envelope: *envelope})
+	if err != nil {
+		return err
+	}
+
+	if b.history > 0 {
+		version := fmt.Sprintf("%020d-%d", saved.UnixNano(), header.Serial)
+		if err := b.store.Write(r.Context(), name+"/"+historyPrefix+version, data); err != nil {
+			return err
+		}
+	}
+	if err := b.store.Write(r.Context(), name+"/"+stateKey, data); err != nil {
+		return err
+	}
+	if err := b.pruneHistory(r.Context(), name); err != nil {
+		slog.WarnContext(r.Context(), "cannot prune state history", slog.String("state", name), slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// delete removes the current state; its history is kept.
+func (b *TerraformBackend) delete(w http.ResponseWriter, r *http.Request, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok, err := b.holdsLock(w, r, name); !ok || err != nil {
+		return err
+	}
+	return b.store.Delete(r.Context(), name+"/"+stateKey)
+}
+
+func (b *TerraformBackend) lock(w http.ResponseWriter, r *http.Request, name string) error {
+	body, info, err := readLockInfo(w, r)
+	if err != nil {
+		return err
+	}
+	if info.ID == "" {
+		return &badRequestError{errors.New("lock info has no ID")}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.store.Create(r.Context(), name+"/"+lockKey, body)
+	if err == nil {
+		return nil
+	}
+	if !os.IsExist(err) {
+		return err
+	}
+
+	held, heldInfo, err := b.readLock(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	if heldInfo.ID == info.ID {
+		return nil
+	}
+	writeLockInfo(w, http.StatusLocked, held)
+	return nil
+}
+
+// unlock releases the lock. A request without lock info, as sent by
+// terraform force-unlock, releases any lock.
+func (b *TerraformBackend) unlock(w http.ResponseWriter, r *http.Request, name string) error {
+	_, info, err := readLockInfo(w, r)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	held, heldInfo, err := b.readLock(r.Context(), name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ID != "" && info.ID != heldInfo.ID {
+		writeLockInfo(w, http.StatusConflict, held)
+		return nil
+	}
+	return b.store.Delete(r.Context(), name+"/"+lockKey)
+}
+
+// holdsLock reports whether the request may write name: either the state is
+// not locked, or the request carries the lock's ID. Otherwise it responds
+// with the lock holder.
+func (b *TerraformBackend) holdsLock(w http.ResponseWriter, r *http.Request, name string) (bool, error) {
+	held, heldInfo, err := b.readLock(r.Context(), name)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if r.URL.Query().Get("ID") != heldInfo.ID {
+		writeLockInfo(w, http.StatusLocked, held)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b *TerraformBackend) listHistory(w http.ResponseWriter, r *http.Request, name string) error {
+	keys, err := b.store.List(r.Context(), name+"/"+historyPrefix)
+	if err != nil {
+		return err
+	}
+
+	versions := make([]StateVersion, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		stored, err := b.read(r.Context(), keys[i])
+		if err != nil {
+			return err
+		}
+		versions = append(versions, StateVersion{
+			Version: strings.TrimPrefix(keys[i], name+"/"+historyPrefix),
+			Lineage: stored.Lineage,
+			Serial:  stored.Serial,
+			Saved:   stored.Saved,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(versions)
+}
+
+func (b *TerraformBackend) pruneHistory(ctx context.Context, name string) error {
+	keys, err := b.store.List(ctx, name+"/"+historyPrefix)
+	if err != nil {
+		return err
+	}
+	for len(keys) > b.history {
+		if err := b.store.Delete(ctx, keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+func (b *TerraformBackend) read(ctx context.Context, key string) (*storedState, error) {
+	data, err := b.store.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var stored storedState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return &stored, nil
+}
+
+func (b *TerraformBackend) readLock(ctx context.Context, name string) ([]byte, lockInfo, error) {
+	var info lockInfo
+	held, err := b.store.Read(ctx, name+"/"+lockKey)
+	if err != nil {
+		return nil, info, err
+	}
+	if err := json.Unmarshal(held, &info); err != nil {
+		return nil, info, fmt.Errorf("%s lock: %v", name, err)
+	}
+	return held, info, nil
+}
+
+func readLockInfo(w http.ResponseWriter, r *http.Request) ([]byte, lockInfo, error) {
+	var info lockInfo
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLockInfoBytes))
+	if err != nil {
+		return nil, info, &badRequestError{fmt.Errorf("lock info exceeds %d bytes", maxLockInfoBytes)}
+	}
+	if len(body) == 0 {
+		return body, info, nil
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, info, &badRequestError{fmt.Errorf("invalid lock info: %v", err)}
+	}
+	return body, info, nil
+}
+
+func writeLockInfo(w http.ResponseWriter, status int, held []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(held)
+}
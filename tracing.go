@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/ocagent"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/tracing"
+	"go.opencensus.io/trace"
+)
+
+const (
+	spanPrefix = "kvcrypt."
+
+	headerRequestID = "x-ms-request-id"
+
+	// adal refreshes tokens this long before they expire
+	tokenRefreshWindow = 5 * time.Minute
+)
+
+// Span attributes recorded on key operations. Plaintext and ciphertext are
+// never recorded, only their size.
+const (
+	attributeKeyName     = "kvcrypt.key.name"
+	attributeKeyVersion  = "kvcrypt.key.version"
+	attributeAlgorithm   = "kvcrypt.algorithm"
+	attributePayloadSize = "kvcrypt.payload.bytes"
+	attributeCacheHit    = "kvcrypt.cache.hit"
+	attributeRetries     = "kvcrypt.retries"
+)
+
+// EnableTracing registers the exporter selected by configuration and turns on
+// the Azure SDK's own HTTP spans, so Key Vault requests show up as children of
+// the key operation spans. The returned function flushes pending spans.
+func EnableTracing(configuration TracingConfiguration) (func(), error) {
+	var exporter trace.Exporter
+	flush := func() {}
+
+	switch configuration.Exporter {
+	case "":
+		return flush, nil
+	case "stdout":
+		exporter = &jsonSpanExporter{w: os.Stdout}
+	case "stderr":
+		exporter = &jsonSpanExporter{w: os.Stderr}
+	case "ocagent":
+		agent, err := ocagent.NewExporter(
+			ocagent.WithInsecure(),
+			ocagent.WithAddress(configuration.AgentAddress),
+			ocagent.WithServiceName(configuration.ServiceName))
+		if err != nil {
+			return flush, err
+		}
+		exporter = agent
+		flush = func() {
+			agent.Flush()
+			agent.Stop()
+		}
+	default:
+		return flush, fmt.Errorf("unknown trace exporter: %s", configuration.Exporter)
+	}
+
+	trace.RegisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(configuration.SampleRate)})
+	if err := tracing.Enable(); err != nil {
+		return flush, err
+	}
+	return flush, nil
+}
+
+// keyOperation tracks a single EncryptionClient call across the HTTP attempts
+// autorest makes for it.
+type keyOperation struct {
+	ctx         context.Context
+	client      *EncryptionClient
+	name        string
+	span        *trace.Span
+	start       time.Time
+	payloadSize int
+	attempts    int32
+
+	mu         sync.Mutex
+	requestIDs []string
+}
+
+type keyOperationKey struct{}
+
+func (e *EncryptionClient) startOperation(ctx context.Context, name string, algorithm string, payloadSize int) (context.Context, *keyOperation) {
+	op := &keyOperation{client: e, name: name, start: time.Now(), payloadSize: payloadSize}
+	ctx, op.span = trace.StartSpan(ctx, spanPrefix+name, trace.WithSpanKind(trace.SpanKindClient))
+	op.span.AddAttributes(
+		trace.StringAttribute(attributeKeyName, e.kvInfo.keyName),
+		trace.StringAttribute(attributeKeyVersion, e.kvInfo.keyVersion),
+		trace.StringAttribute(attributeAlgorithm, algorithm),
+		trace.Int64Attribute(attributePayloadSize, int64(payloadSize)),
+	)
+	op.ctx = context.WithValue(ctx, keyOperationKey{}, op)
+	return op.ctx, op
+}
+
+func (op *keyOperation) end(err error) {
+	retries := atomic.LoadInt32(&op.attempts) - 1
+	if retries < 0 {
+		retries = 0
+	}
+	op.span.AddAttributes(trace.Int64Attribute(attributeRetries, int64(retries)))
+
+	if err != nil {
+		status := trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()}
+		var opErr *KeyOperationError
+		if errors.As(err, &opErr) && opErr.Kind != nil {
+			status.Message = opErr.Kind.Error()
+		}
+		op.span.SetStatus(status)
+	}
+	op.span.End()
+
+	recordOperation(op.ctx, op.name, op.start, op.payloadSize, err)
+	op.client.logOperation(op, err)
+}
+
+// operationSender records the HTTP attempts made on behalf of the keyOperation
+// carried by the request context: how many there were, their request IDs and
+// which of them were throttled.
+type operationSender struct {
+	next autorest.Sender
+}
+
+func (s operationSender) Do(r *http.Request) (*http.Response, error) {
+	op, _ := r.Context().Value(keyOperationKey{}).(*keyOperation)
+	name := "unknown"
+	if op != nil {
+		atomic.AddInt32(&op.attempts, 1)
+		name = op.name
+	}
+
+	resp, err := s.next.Do(r)
+	if resp == nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		recordThrottled(r.Context(), name)
+	}
+	if requestID := resp.Header.Get(headerRequestID); op != nil && requestID != "" {
+		op.mu.Lock()
+		op.requestIDs = append(op.requestIDs, requestID)
+		op.mu.Unlock()
+	}
+	return resp, err
+}
+
+// newKeyVaultSender mirrors the sender autorest uses when none is set.
+func newKeyVaultSender() autorest.Sender {
+	transport := tracing.NewTransport()
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	transport.Base = base
+	return operationSender{next: &http.Client{Transport: transport}}
+}
+
+// tracedTokenProvider records a span and a metric whenever the service principal token has
+// to be (re)acquired from Azure AD.
+type tracedTokenProvider struct {
+	*adal.ServicePrincipalToken
+}
+
+func (t tracedTokenProvider) EnsureFreshWithContext(ctx context.Context) error {
+	if !t.Token().WillExpireIn(tokenRefreshWindow) {
+		return nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, spanPrefix+"AcquireToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	err := t.ServicePrincipalToken.EnsureFreshWithContext(ctx)
+	recordTokenRefresh(ctx, err)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnauthenticated, Message: err.Error()})
+	}
+	return err
+}
+
+// jsonSpanExporter writes finished spans to w as one JSON object per line. It
+// is meant for local testing.
+type jsonSpanExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonSpan struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"durationMs"`
+	StatusCode int32                  `json:"statusCode"`
+	Status     string                 `json:"status,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (e *jsonSpanExporter) ExportSpan(s *trace.SpanData) {
+	span := jsonSpan{
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		Name:       s.Name,
+		Kind:       s.SpanKind,
+		Start:      s.StartTime,
+		DurationMS: float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond),
+		StatusCode: s.Code,
+		Status:     s.Message,
+		Attributes: s.Attributes,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentID = s.ParentSpanID.String()
+	}
+
+	b, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(b, '\n'))
+}
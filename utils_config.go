@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type AzureConfiguration struct {
@@ -13,6 +17,22 @@ type AzureConfiguration struct {
 }
 
 func ParseEnvironment() (AzureConfiguration, error) {
+	configuration, err := ParseCredentialsEnvironment()
+	if err != nil {
+		return AzureConfiguration{}, err
+	}
+
+	configuration.KeyVaultKeyIdentifier, err = getMustEnv("AZURE_KEY_VAULT_KEY_IDENTIFIER")
+	if err != nil {
+		return AzureConfiguration{}, err
+	}
+
+	return configuration, nil
+}
+
+// ParseCredentialsEnvironment reads the service principal only, for commands
+// that take their key identifiers from elsewhere.
+func ParseCredentialsEnvironment() (AzureConfiguration, error) {
 	clientID, err := getMustEnv("AZURE_CLIENT_ID")
 	if err != nil {
 		return AzureConfiguration{}, err
@@ -27,12 +47,45 @@ func ParseEnvironment() (AzureConfiguration, error) {
 		return AzureConfiguration{}, err
 	}
 
-	KeyVaultKeyIdentifier, err := getMustEnv("AZURE_KEY_VAULT_KEY_IDENTIFIER")
+	return AzureConfiguration{clientID, clientSecret, tenantID, os.Getenv("AZURE_KEY_VAULT_KEY_IDENTIFIER")}, nil
+}
+
+// ParseAllowedKeys returns the key identifiers encrypted data may name: the
+// configured key and those listed, comma-separated, in KVCRYPT_ALLOWED_KEYS.
+// Their versions are ignored.
+func ParseAllowedKeys() []string {
+	var keys []string
+	if key := os.Getenv("AZURE_KEY_VAULT_KEY_IDENTIFIER"); key != "" {
+		keys = append(keys, key)
+	}
+	for _, key := range strings.Split(os.Getenv("KVCRYPT_ALLOWED_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// LoadKeyProfiles reads a JSON file mapping profile names to Key Vault key
+// identifiers:
+//
+//	{"profiles": {"default": "https://myvault.vault.azure.net/keys/myKey/99d67321dd9841af859129cd5551a871"}}
+func LoadKeyProfiles(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return AzureConfiguration{}, err
+		return nil, err
 	}
 
-	return AzureConfiguration{clientID, clientSecret, tenantID, KeyVaultKeyIdentifier}, nil
+	var file struct {
+		Profiles map[string]string `json:"profiles"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Profiles) == 0 {
+		return nil, fmt.Errorf("%s: no profiles defined", path)
+	}
+	return file.Profiles, nil
 }
 
 func getMustEnv(key string) (string, error) {
@@ -42,3 +95,77 @@ func getMustEnv(key string) (string, error) {
 	}
 	return value, nil
 }
+
+type TracingConfiguration struct {
+	// Exporter is one of "", "stdout", "stderr" or "ocagent". Tracing is off when empty.
+	Exporter     string
+	AgentAddress string
+	ServiceName  string
+	SampleRate   float64
+}
+
+func ParseTracingEnvironment() (TracingConfiguration, error) {
+	configuration := TracingConfiguration{
+		Exporter:     os.Getenv("KVCRYPT_TRACE_EXPORTER"),
+		AgentAddress: getEnvOrDefault("KVCRYPT_TRACE_AGENT_ADDRESS", "localhost:55678"),
+		ServiceName:  getEnvOrDefault("KVCRYPT_TRACE_SERVICE_NAME", "kvcrypt"),
+		SampleRate:   1,
+	}
+
+	if rate := os.Getenv("KVCRYPT_TRACE_SAMPLE_RATE"); rate != "" {
+		value, err := strconv.ParseFloat(rate, 64)
+		if err != nil || value < 0 || value > 1 {
+			return TracingConfiguration{}, fmt.Errorf("KVCRYPT_TRACE_SAMPLE_RATE must be a number between 0 and 1: %s", rate)
+		}
+		configuration.SampleRate = value
+	}
+
+	return configuration, nil
+}
+
+type MetricsConfiguration struct {
+	// Address is where the Prometheus endpoint listens, e.g. ":9464". Metrics are off when empty.
+	Address string
+}
+
+func ParseMetricsEnvironment() MetricsConfiguration {
+	return MetricsConfiguration{Address: os.Getenv("KVCRYPT_METRICS_ADDRESS")}
+}
+
+type LoggingConfiguration struct {
+	// Level is one of debug, info, warn or error.
+	Level string
+	// Format is text or json.
+	Format string
+	// HTTP enables redacted request and response logging at debug level.
+	HTTP bool
+}
+
+func ParseLoggingEnvironment() LoggingConfiguration {
+	return LoggingConfiguration{
+		Level:  getEnvOrDefault("KVCRYPT_LOG_LEVEL", "warn"),
+		Format: getEnvOrDefault("KVCRYPT_LOG_FORMAT", "text"),
+		HTTP:   os.Getenv("KVCRYPT_LOG_HTTP") == "true" || os.Getenv("KVCRYPT_LOG_HTTP") == "1",
+	}
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+type TerraformBackendConfiguration struct {
+	// When Password is set, requests must carry Username and Password as HTTP
+	// basic auth, the username and password of Terraform's http backend.
+	Username string
+	Password string
+}
+
+func ParseTerraformBackendEnvironment() TerraformBackendConfiguration {
+	return TerraformBackendConfiguration{
+		Username: os.Getenv("KVCRYPT_TF_BACKEND_USERNAME"),
+		Password: os.Getenv("KVCRYPT_TF_BACKEND_PASSWORD"),
+	}
+}